@@ -7,7 +7,7 @@ replace github.com/eltorocorp/nobslogger/v2 => ../
 
 require (
 	github.com/apex/log v1.1.1
-	github.com/eltorocorp/nobslogger/v2 v0.0.0-00010101000000-000000000000
+	github.com/eltorocorp/nobslogger/v2 v2.0.0-00010101000000-000000000000
 	github.com/go-kit/kit v0.9.0
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/rs/zerolog v1.16.0
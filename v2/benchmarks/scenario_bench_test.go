@@ -135,6 +135,23 @@ func BenchmarkWithoutFields(b *testing.B) {
 			}
 		})
 	})
+	b.Run("eltorocorp/logger.Info.logfmt", func(b *testing.B) {
+		logService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{
+			Environment:       "",
+			SystemName:        "",
+			ServiceName:       "",
+			ServiceInstanceID: "",
+		}, logger.LogServiceOptions{
+			Encoder: logger.NewLogfmtEncoder(),
+		})
+		logger := logService.NewContext("", "")
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				logger.Info(getMessage(0))
+			}
+		})
+	})
 }
 
 func BenchmarkAccumulatedContext(b *testing.B) {
@@ -254,6 +271,40 @@ func BenchmarkAccumulatedContext(b *testing.B) {
 			}
 		})
 	})
+	b.Run("eltorocorp/logger.Info.logfmt", func(b *testing.B) {
+		logService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{
+			Environment:       field1Value,
+			SystemName:        field2Value,
+			ServiceName:       field3Value,
+			ServiceInstanceID: field4Value,
+		}, logger.LogServiceOptions{
+			Encoder: logger.NewLogfmtEncoder(),
+		})
+		logger := logService.NewContext(field6Value, field7Value)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				logger.Info(getMessage(0))
+			}
+		})
+	})
+	b.Run("eltorocorp/logger.InfoD.logfmt", func(b *testing.B) {
+		logService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{
+			Environment:       field1Value,
+			SystemName:        field2Value,
+			ServiceName:       field3Value,
+			ServiceInstanceID: field4Value,
+		}, logger.LogServiceOptions{
+			Encoder: logger.NewLogfmtEncoder(),
+		})
+		logger := logService.NewContext(field6Value, field7Value)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				logger.InfoD(getMessage(0), getMessage(1))
+			}
+		})
+	})
 }
 
 func BenchmarkAddingFields(b *testing.B) {
@@ -0,0 +1,100 @@
+package logger
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+
+	// defaultMaxRetries is the number of times that the batching writers
+	// retry a failed batch by default.
+	defaultMaxRetries = 3
+)
+
+// backoff produces the delays between successive attempts at a failing
+// operation. Delays start at min, double with each attempt up to max, and
+// are jittered by up to half of their duration.
+type backoff struct {
+	min    time.Duration
+	max    time.Duration
+	next   time.Duration
+	random *rand.Rand
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{
+		min:    min,
+		max:    max,
+		next:   min,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// delay returns the delay before the next attempt.
+func (b *backoff) delay() time.Duration {
+	delay := b.next/2 + time.Duration(b.random.Int63n(int64(b.next/2)+1))
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay
+}
+
+// reset restores the delay to its minimum, i.e. after a success.
+func (b *backoff) reset() {
+	b.next = b.min
+}
+
+// sleep waits for d to elapse, or for ctx to be done, in which case it returns
+// ctx.Err().
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryLimit returns the number of times that a failed batch is retried,
+// given the MaxRetries option of a batching writer: zero defaults to
+// defaultMaxRetries, and a negative value disables retries.
+func retryLimit(maxRetries int) int {
+	switch {
+	case maxRetries == 0:
+		return defaultMaxRetries
+	case maxRetries < 0:
+		return 0
+	}
+	return maxRetries
+}
+
+// retry calls attempt until it succeeds, fails with an error that retryable
+// (if any) rejects, or has been retried maxRetries times. Before each retry,
+// it waits for the next delay from backoff, or the delay requested by the
+// server, if that is longer (see retryDelay). Retrying stops once ctx is done.
+// The last error is returned.
+func retry(ctx context.Context, maxRetries int, backoff *backoff, retryable func(error) bool, attempt func() error) error {
+	backoff.reset()
+	for n := 0; ; n++ {
+		err := attempt()
+		if err == nil || (retryable != nil && !retryable(err)) || n >= maxRetries {
+			return err
+		}
+		if sleep(ctx, retryDelay(err, backoff)) != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package logger_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func Test_Retry(t *testing.T) {
+	errFailed := errors.New("failed")
+	errFatal := errors.New("fatal")
+	retryable := func(err error) bool { return err != errFatal }
+
+	testCases := []struct {
+		name       string
+		maxRetries int
+		// failures is the number of attempts that fail before one succeeds.
+		failures         int
+		err              error
+		expectedAttempts int
+		expectedErr      error
+	}{
+		{"default", 0, 10, errFailed, 4, errFailed},
+		{"limited", 2, 10, errFailed, 3, errFailed},
+		{"disabled", -1, 10, errFailed, 1, errFailed},
+		{"succeeds", 2, 1, errFailed, 2, nil},
+		{"succeeds first", 2, 0, errFailed, 1, nil},
+		{"not retryable", 2, 10, errFatal, 1, errFatal},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			err := logger.Retry(context.Background(), tc.maxRetries, retryable, func() error {
+				attempts++
+				if attempts <= tc.failures {
+					return tc.err
+				}
+				return nil
+			})
+			if err != tc.expectedErr {
+				t.Errorf("expected %v, got %v", tc.expectedErr, err)
+			}
+			if attempts != tc.expectedAttempts {
+				t.Errorf("expected %v attempts, got %v", tc.expectedAttempts, attempts)
+			}
+		})
+	}
+}
+
+// Retrying must stop once the context is done.
+func Test_RetryContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- logger.Retry(ctx, 1000000, nil, func() error {
+			attempts++
+			if attempts == 2 {
+				cancel()
+			}
+			return errors.New("failed")
+		})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected retrying to stop")
+	}
+}
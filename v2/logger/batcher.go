@@ -0,0 +1,310 @@
+package logger
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBatchSize is the most entries that the batching writers send in
+	// a single request by default.
+	defaultBatchSize = 512
+
+	// defaultFlushInterval is the longest that the batching writers hold an
+	// entry by default.
+	defaultFlushInterval = time.Second
+
+	// maxPendingBatches is the most full batches that a batcher holds while
+	// an earlier batch is being flushed. Once they are all held, and the
+	// current batch is also full, writes are rejected with ErrBufferFull.
+	maxPendingBatches = 4
+
+	// batchErrorInterval is the interval at which failed batches are reported
+	// to os.Stderr by default (see batchErrorHandler).
+	batchErrorInterval = 10 * time.Second
+)
+
+// batchErrorHandler returns the ErrorHandler to which a batching writer,
+// established by one of the Initialize functions, passes the entries of
+// batches that it couldn't flush: the LogService's ErrorHandler, if one is
+// supplied, or otherwise a StderrErrorHandler. The LogService's own default
+// (which dumps each entry to os.Stderr) isn't used, as the entries are
+// encoded for the writer, and may not be readable.
+func batchErrorHandler(options LogServiceOptions) ErrorHandler {
+	if options.ErrorHandler != nil {
+		return options.ErrorHandler
+	}
+	return StderrErrorHandler(batchErrorInterval)
+}
+
+// batch is a sequence of entries, stored contiguously.
+type batch struct {
+	data []byte
+	ends []int
+}
+
+// batcher accumulates entries, and passes them to a flush function in
+// batches. A batch is flushed once it holds maxEntries entries, and
+// otherwise every flushInterval.
+//
+// Batches are flushed, in order, by the batcher's own goroutine, so that
+// slow flushes (i.e. network requests and their retries) never block Write.
+// Write only adds to the current batch; if the current batch is full, and
+// maxPendingBatches full batches are already awaiting the flush function,
+// the entry is rejected with ErrBufferFull.
+//
+// A batch that fails to flush is discarded; any retries are the
+// responsibility of the flush function. Each entry of a discarded batch is
+// passed to onError (if any), and the error is returned by the next call to
+// Flush or Close. Write only reports errors with the entry being written, so
+// that an entry that has been accepted is never mistaken for one that was
+// lost.
+type batcher struct {
+	flush      func(ctx context.Context, entries [][]byte) error
+	onError    ErrorHandler
+	maxEntries int
+
+	mu      sync.Mutex
+	current *batch
+	pending []*batch
+	free    []*batch
+	err     error
+	closed  bool
+
+	// queued counts the batches that have been handed to the flushing
+	// goroutine, and flushed those that it has finished with, so that
+	// Flush can wait for the batches queued before it.
+	queued  uint64
+	flushed uint64
+	done    *sync.Cond
+
+	// wake is signalled whenever a batch is queued. stopped is closed once
+	// the flushing goroutine has flushed every batch after Close.
+	wake    chan struct{}
+	stopped chan struct{}
+
+	// ctx is passed to the flush function, and is cancelled if the context
+	// passed to CloseContext is done before every batch has been flushed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// entries is only accessed by the flushing goroutine.
+	entries [][]byte
+}
+
+// batchError is returned by a flush function when only some of the entries
+// in a batch could not be flushed, so that only those entries are passed to
+// the batcher's ErrorHandler.
+type batchError struct {
+	err    error
+	failed [][]byte
+}
+
+func (e *batchError) Error() string {
+	return e.err.Error()
+}
+
+// newBatcher returns a batcher, and starts the goroutine that flushes it.
+// The goroutine runs until the batcher is closed. onError may be nil.
+func newBatcher(maxEntries int, flushInterval time.Duration, flush func(ctx context.Context, entries [][]byte) error, onError ErrorHandler) *batcher {
+	b := &batcher{
+		flush:      flush,
+		onError:    onError,
+		maxEntries: maxEntries,
+		current:    &batch{},
+		wake:       make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+	b.done = sync.NewCond(&b.mu)
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	go b.run(flushInterval)
+	return b
+}
+
+func (b *batcher) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	defer close(b.stopped)
+	for {
+		select {
+		case <-b.wake:
+		case <-ticker.C:
+			b.mu.Lock()
+			b.queueLocked(false)
+			b.mu.Unlock()
+		}
+		if !b.flushPending() {
+			return
+		}
+	}
+}
+
+// flushPending flushes every queued batch, and returns false if the batcher
+// has been closed, and so there will be no more batches.
+func (b *batcher) flushPending() bool {
+	for {
+		b.mu.Lock()
+		if len(b.pending) == 0 {
+			closed := b.closed
+			b.mu.Unlock()
+			return !closed
+		}
+		next := b.pending[0]
+		b.pending[0] = nil
+		b.pending = b.pending[1:]
+		b.mu.Unlock()
+
+		b.entries = b.entries[:0]
+		start := 0
+		for _, end := range next.ends {
+			b.entries = append(b.entries, next.data[start:end])
+			start = end
+		}
+		// Once the flushes have been cancelled, the remaining batches are
+		// discarded without being attempted.
+		err := b.ctx.Err()
+		if err == nil {
+			err = b.flush(b.ctx, b.entries)
+		}
+		if err != nil {
+			b.report(err)
+		}
+
+		b.mu.Lock()
+		next.data = next.data[:0]
+		next.ends = next.ends[:0]
+		b.free = append(b.free, next)
+		b.flushed++
+		b.done.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// report records the error from a failed flush, and passes the entries that
+// were lost to onError. It is only called by the flushing goroutine.
+func (b *batcher) report(err error) {
+	failed := b.entries
+	if partial, ok := err.(*batchError); ok {
+		failed = partial.failed
+		err = partial.err
+	}
+	b.mu.Lock()
+	b.err = err
+	b.mu.Unlock()
+	if b.onError == nil {
+		return
+	}
+	for _, entry := range failed {
+		b.onError(err, entry)
+	}
+}
+
+// Write adds a copy of p to the current batch, queueing the batch to be
+// flushed if it is full.
+func (b *batcher) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, ErrWriterClosed
+	}
+	if len(b.current.ends) >= b.maxEntries && !b.queueLocked(false) {
+		return 0, ErrBufferFull
+	}
+	b.current.data = append(b.current.data, p...)
+	b.current.ends = append(b.current.ends, len(b.current.data))
+	if len(b.current.ends) >= b.maxEntries {
+		b.queueLocked(false)
+	}
+	return len(p), nil
+}
+
+// Flush flushes the current batch, if any, and waits until it (and every
+// batch before it) has been flushed.
+func (b *batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return b.takeErr()
+	}
+	b.queueLocked(true)
+	for target := b.queued; b.flushed < target; {
+		b.done.Wait()
+	}
+	return b.takeErr()
+}
+
+// Close flushes the current batch, waits until every batch has been flushed,
+// and stops the flushing goroutine.
+func (b *batcher) Close() error {
+	return b.CloseContext(context.Background())
+}
+
+// CloseContext is the same as Close, but if ctx is done before every batch
+// has been flushed, the flush in progress is cancelled (via the context
+// passed to the flush function), and the remaining batches are discarded.
+// In that case, ctx.Err() is returned.
+func (b *batcher) CloseContext(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.queueLocked(true)
+	b.mu.Unlock()
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	var err error
+	select {
+	case <-b.stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+		b.cancel()
+		<-b.stopped
+	}
+	b.cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if flushErr := b.takeErr(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// takeErr returns and clears the error from the last failed flush. b.mu must
+// be held.
+func (b *batcher) takeErr() error {
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// queueLocked hands the current batch (if any) to the flushing goroutine,
+// and starts a new one. Unless force is set, the batch is only queued if
+// fewer than maxPendingBatches are already queued. queueLocked returns
+// whether the current batch is now empty. b.mu must be held.
+func (b *batcher) queueLocked(force bool) bool {
+	if len(b.current.ends) == 0 {
+		return true
+	}
+	if !force && len(b.pending) >= maxPendingBatches {
+		return false
+	}
+	b.pending = append(b.pending, b.current)
+	b.queued++
+	if n := len(b.free); n > 0 {
+		b.current = b.free[n-1]
+		b.free = b.free[:n-1]
+	} else {
+		b.current = &batch{}
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
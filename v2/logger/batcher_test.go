@@ -0,0 +1,127 @@
+package logger_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// closeService closes a LogService that writes to a batching sink. Anything
+// that the sink is still flushing or retrying is abandoned after a short
+// timeout, so that the sink doesn't outlive the test and report errors while
+// other tests are running.
+func closeService(loggerService *logger.LogService) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	loggerService.Close(ctx)
+}
+
+// closeWriter is the equivalent of closeService for a batching writer.
+func closeWriter(w interface{ CloseContext(context.Context) error }) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w.CloseContext(ctx)
+}
+
+// Writes to a batching writer must not wait for a flush that is in progress,
+// however long it takes, and must be rejected once too many batches are
+// awaiting a flush.
+func Test_BatcherWriteDoesNotWaitForFlush(t *testing.T) {
+	requests := make(chan struct{}, 16)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	w, err := logger.NewOTLPWriter(server.URL, syslogServiceContext, logger.OTLPOptions{
+		BatchSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	defer close(release)
+	w.Write([]byte("first"))
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for request")
+	}
+
+	// The first batch is now blocked in the collector.
+	full := false
+	for i := 0; i < 10 && !full; i++ {
+		start := time.Now()
+		_, err := w.Write([]byte("next"))
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("expected Write to return immediately, took %v", elapsed)
+		}
+		switch err {
+		case nil:
+		case logger.ErrBufferFull:
+			full = true
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !full {
+		t.Error("expected ErrBufferFull once the pending batches were exhausted")
+	}
+}
+
+// A failed flush must be reported with the entries of the failed batch, and
+// never by a later Write, whose entry has been accepted.
+func Test_BatcherReportsFailedBatch(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	failed := make(chan string, 4)
+	w, err := logger.NewOTLPWriter(server.URL, syslogServiceContext, logger.OTLPOptions{
+		Protocol:  logger.OTLPProtocolJSON,
+		BatchSize: 1,
+		ErrorHandler: func(err error, entry []byte) {
+			failed <- string(entry)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("{}"))
+	select {
+	case entry := <-failed:
+		if entry != "{}" {
+			t.Errorf("expected the failed entry, got %q", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the failed batch")
+	}
+
+	if _, err := w.Write([]byte(`{"n":2}`)); err != nil {
+		t.Errorf("expected the entry to be accepted, got %v", err)
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("expected Flush to return the earlier error")
+	}
+	if err := w.Flush(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	select {
+	case entry := <-failed:
+		t.Errorf("unexpected failed entry: %q", entry)
+	default:
+	}
+}
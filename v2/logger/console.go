@@ -0,0 +1,254 @@
+package logger
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// ConsoleColor determines whether the console encoder colours its output.
+type ConsoleColor int
+
+// ConsoleColor constants.
+const (
+	// ConsoleColorAuto colours output only if it is written to a terminal,
+	// and the NO_COLOR environment variable is not set.
+	ConsoleColorAuto ConsoleColor = iota
+	ConsoleColorAlways
+	ConsoleColorNever
+)
+
+// maxConsoleSiteWidth is the widest that the site/operation column grows to
+// in order to keep messages aligned.
+const maxConsoleSiteWidth = 40
+
+const consoleColorReset = "\x1b[0m"
+
+// ConsoleOptions exposes configuration settings for console output.
+type ConsoleOptions struct {
+	// Color determines whether entries are coloured by severity. The default
+	// is ConsoleColorAuto.
+	Color ConsoleColor
+}
+
+// InitializeConsole establishes a logging service that writes human readable
+// entries to os.Stdout, and is intended for local development. See
+// NewConsoleEncoder.
+func InitializeConsole(serviceContext ServiceContext) LogService {
+	options := defaultLogServiceOptions()
+	options.Framing = FramingNewline
+	options.Encoder = NewConsoleEncoder(os.Stdout, ConsoleOptions{})
+	return InitializeWriterWithOptions(os.Stdout, serviceContext, options)
+}
+
+// consoleEncoder encodes entries as human readable lines.
+type consoleEncoder struct {
+	color bool
+
+	// siteWidth is the width of the widest site/operation column written so
+	// far.
+	siteWidth int32
+}
+
+// NewConsoleEncoder returns an Encoder that encodes entries as human readable
+// lines, i.e.
+//
+//	2009-11-10T23:00:00.000Z INFO  site/operation: message details key=value
+//
+// The timestamp and level are padded to a fixed width, and the site/operation
+// column is padded to the width of the widest seen so far (up to 40
+// characters), so that messages are aligned. The ServiceContext is not
+// included.
+//
+// Control characters (including ANSI escape sequences and Unicode line
+// separators) are escaped, so that entries can't forge additional lines or
+// manipulate the terminal.
+//
+// w is the writer that entries will be written to. If options.Color is
+// ConsoleColorAuto, entries are only coloured if w is a terminal.
+//
+// A line based Framing (such as FramingNewline) should be used with this
+// encoder.
+func NewConsoleEncoder(w io.Writer, options ConsoleOptions) Encoder {
+	color := options.Color == ConsoleColorAlways
+	if options.Color == ConsoleColorAuto {
+		_, noColor := os.LookupEnv("NO_COLOR")
+		color = !noColor && isTerminal(w)
+	}
+	return &consoleEncoder{color: color}
+}
+
+// isTerminal reports whether w is a character device, such as a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (e *consoleEncoder) begin(buffer []byte, r record) []byte {
+	buffer = appendTimestamp(buffer, r.timestamp, 3)
+	buffer = append(buffer, ' ')
+	label, color := consoleLevel(r.detail)
+	if e.color {
+		buffer = append(buffer, color...)
+		buffer = append(buffer, label...)
+		buffer = append(buffer, consoleColorReset...)
+	} else {
+		buffer = append(buffer, label...)
+	}
+	buffer = append(buffer, ' ')
+
+	siteStart := len(buffer)
+	buffer = appendConsoleSafe(buffer, r.site, false, true)
+	buffer = append(buffer, '/')
+	buffer = appendConsoleSafe(buffer, r.operation, false, true)
+	buffer = append(buffer, ':')
+	width := int32(utf8.RuneCount(buffer[siteStart:]))
+	siteWidth := atomic.LoadInt32(&e.siteWidth)
+	if width > siteWidth && width <= maxConsoleSiteWidth {
+		atomic.CompareAndSwapInt32(&e.siteWidth, siteWidth, width)
+		siteWidth = width
+	}
+	for ; width < siteWidth; width++ {
+		buffer = append(buffer, ' ')
+	}
+	buffer = append(buffer, ' ')
+
+	buffer = appendConsoleSafe(buffer, r.detail.Message, false, r.detail.escaped)
+	if r.detail.Details != "" {
+		buffer = append(buffer, ' ')
+		buffer = appendConsoleSafe(buffer, r.detail.Details, false, r.detail.escaped)
+	}
+	return buffer
+}
+
+func (e *consoleEncoder) field(buffer []byte, f Field) []byte {
+	buffer = append(buffer, ' ')
+	buffer = appendConsoleSafe(buffer, f.key, false, false)
+	buffer = append(buffer, '=')
+	switch f.kind {
+	case fieldKindString:
+		quote := logfmtRequiresQuotes(f.str)
+		if quote {
+			buffer = append(buffer, quoteToken...)
+		}
+		buffer = appendConsoleSafe(buffer, f.str, quote, false)
+		if quote {
+			buffer = append(buffer, quoteToken...)
+		}
+		return buffer
+	case fieldKindInt64:
+		return strconv.AppendInt(buffer, f.integer, 10)
+	case fieldKindDuration:
+		// Durations are written in their human readable form, unlike the
+		// machine oriented encoders.
+		return append(buffer, time.Duration(f.integer).String()...)
+	case fieldKindFloat64:
+		return strconv.AppendFloat(buffer, f.float, 'g', -1, 64)
+	case fieldKindBool:
+		return strconv.AppendBool(buffer, f.integer != 0)
+	case fieldKindTime:
+		return f.time.AppendFormat(buffer, time.RFC3339Nano)
+	default:
+		return append(buffer, nullToken...)
+	}
+}
+
+func (e *consoleEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, " truncated=true"...)
+	}
+	return buffer
+}
+
+// consoleLevel returns a fixed width label and an ANSI colour for an entry's
+// severity.
+func consoleLevel(ld LogDetail) (string, string) {
+	switch ld.Severity {
+	case LogSeverityTrace:
+		return "TRACE", "\x1b[90m"
+	case LogSeverityDebug:
+		return "DEBUG", "\x1b[36m"
+	case LogSeverityInfo:
+		return "INFO ", "\x1b[32m"
+	case LogSeverityWarn:
+		return "WARN ", "\x1b[33m"
+	case LogSeverityError:
+		return "ERROR", "\x1b[31m"
+	case LogSeverityFatal:
+		return "FATAL", "\x1b[1;31m"
+	}
+	switch levelFromRank(ld.Level.rank()) {
+	case LogLevelTrace:
+		return consoleLevel(LogDetail{Severity: LogSeverityTrace})
+	case LogLevelDebug:
+		return consoleLevel(LogDetail{Severity: LogSeverityDebug})
+	case LogLevelInfo:
+		return consoleLevel(LogDetail{Severity: LogSeverityInfo})
+	case LogLevelWarn:
+		return consoleLevel(LogDetail{Severity: LogSeverityWarn})
+	case LogLevelError:
+		return consoleLevel(LogDetail{Severity: LogSeverityError})
+	default:
+		return consoleLevel(LogDetail{Severity: LogSeverityFatal})
+	}
+}
+
+// appendConsoleSafe appends s, escaping any characters that could break the
+// line or be interpreted by a terminal: C0 and C1 control characters, DEL,
+// the Unicode line and paragraph separators, and invalid UTF-8. If quoted is
+// true, '"' and '\' are escaped as well. If escaped is true, s has been
+// escaped for JSON (see escape), and is unescaped first.
+func appendConsoleSafe(buffer []byte, s string, quoted, escaped bool) []byte {
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			switch {
+			case r == utf8.RuneError && size == 1:
+				buffer = append(buffer, `\x`...)
+				buffer = append(buffer, hexDigits[c>>4], hexDigits[c&0xf])
+			case r >= 0x80 && r <= 0x9f:
+				buffer = append(buffer, `\u00`...)
+				buffer = append(buffer, hexDigits[r>>4], hexDigits[r&0xf])
+			case r == '\u2028' || r == '\u2029':
+				buffer = append(buffer, `\u`...)
+				buffer = strconv.AppendInt(buffer, int64(r), 16)
+			default:
+				buffer = append(buffer, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		next := i + 1
+		if escaped {
+			c, next = unescapeAt(s, i)
+		}
+		switch {
+		case c == '\n':
+			buffer = append(buffer, `\n`...)
+		case c == '\r':
+			buffer = append(buffer, `\r`...)
+		case c == '\t':
+			buffer = append(buffer, `\t`...)
+		case c < 0x20 || c == 0x7f:
+			buffer = append(buffer, `\u00`...)
+			buffer = append(buffer, hexDigits[c>>4], hexDigits[c&0xf])
+		case quoted && (c == '"' || c == '\\'):
+			buffer = append(buffer, '\\', c)
+		default:
+			buffer = append(buffer, c)
+		}
+		i = next
+	}
+	return buffer
+}
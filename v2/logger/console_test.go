@@ -0,0 +1,120 @@
+package logger_test
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// newConsoleService returns a LogService using the console encoder, and a
+// function that returns the lines written so far.
+func newConsoleService(color logger.ConsoleColor) (logger.LogService, func() []string) {
+	var lines []string
+	writer := writerFunc(func(bb []byte) (int, error) {
+		lines = append(lines, strings.TrimSuffix(string(bb), "\n"))
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		Framing: logger.FramingNewline,
+		Encoder: logger.NewConsoleEncoder(writer, logger.ConsoleOptions{Color: color}),
+	})
+	return loggerService, func() []string { return lines }
+}
+
+func Test_ConsoleEncoder(t *testing.T) {
+	loggerService, lines := newConsoleService(logger.ConsoleColorNever)
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoF("message", "details", logger.Int64("user", 42), logger.String("name", "a b"))
+
+	expected := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}(Z|[+-]\d\d:\d\d) INFO  context site/operation: message details user=42 name="a b"$`)
+	if !expected.MatchString(lines()[0]) {
+		t.Errorf("unexpected line: %q", lines()[0])
+	}
+}
+
+func Test_ConsoleEncoderColor(t *testing.T) {
+	loggerService, lines := newConsoleService(logger.ConsoleColorAlways)
+	log := loggerService.NewContext("context site", "operation")
+	log.Error("message")
+	if !strings.Contains(lines()[0], " \x1b[31mERROR\x1b[0m context site/operation: message") {
+		t.Errorf("expected a coloured level: %q", lines()[0])
+	}
+
+	// Output that isn't written to a terminal must not be coloured.
+	loggerService, lines = newConsoleService(logger.ConsoleColorAuto)
+	log = loggerService.NewContext("context site", "operation")
+	log.Error("message")
+	if strings.Contains(lines()[0], "\x1b") {
+		t.Errorf("expected no colour: %q", lines()[0])
+	}
+
+	f, err := ioutil.TempFile("", "nobslogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	loggerService = logger.InitializeWriterWithOptions(f, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewConsoleEncoder(f, logger.ConsoleOptions{}),
+	})
+	log = loggerService.NewContext("context site", "operation")
+	log.Error("message")
+	contents, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "\x1b") {
+		t.Errorf("expected no colour: %q", contents)
+	}
+}
+
+// Messages must not be able to forge additional lines, or to send escape
+// sequences to the terminal.
+func Test_ConsoleEncoderNeutralisesControlCharacters(t *testing.T) {
+	loggerService, lines := newConsoleService(logger.ConsoleColorNever)
+	log := loggerService.NewContext("site\x1b[2J", "operation")
+	log.InfoF("forged\r\n2009-11-10T23:00:00.000Z ERROR\u2028\x9b", "\x1b[31mred", logger.String("key\n", "value\"\n"))
+
+	line := lines()[0]
+	for _, forbidden := range []string{"\n", "\r", "\x1b", "\u2028", "\x9b"} {
+		if strings.Contains(line, forbidden) {
+			t.Errorf("expected %q to be escaped: %q", forbidden, line)
+		}
+	}
+	if !strings.HasSuffix(line, `site\u001b[2J/operation: forged\r\n2009-11-10T23:00:00.000Z ERROR\u2028\x9b \u001b[31mred key\n="value\"\n"`) {
+		t.Errorf("unexpected line: %q", line)
+	}
+}
+
+// Messages and details escaped by the J methods must be printed as supplied,
+// rather than with their JSON escapes.
+func Test_ConsoleEncoderUnescapesJ(t *testing.T) {
+	loggerService, lines := newConsoleService(logger.ConsoleColorNever)
+	log := loggerService.NewContext(`"site"`, "operation")
+	log.InfoJ(`say "hi" \ bye`, "line\nbreak")
+	log.Info(`verbatim \"`)
+
+	if !strings.HasSuffix(lines()[0], `"site"/operation: say "hi" \ bye line\nbreak`) {
+		t.Errorf("unexpected line: %q", lines()[0])
+	}
+	if !strings.HasSuffix(lines()[1], `: verbatim \"`) {
+		t.Errorf("unexpected line: %q", lines()[1])
+	}
+}
+
+func Test_ConsoleEncoderAlignsMessages(t *testing.T) {
+	loggerService, lines := newConsoleService(logger.ConsoleColorNever)
+	long := loggerService.NewContext("a longer site", "operation")
+	short := loggerService.NewContext("site", "op")
+	long.Info("message")
+	short.Warn("message")
+
+	first, second := lines()[0], lines()[1]
+	if strings.Index(first, "message") != strings.Index(second, "message") {
+		t.Errorf("expected messages to be aligned:\n%v\n%v", first, second)
+	}
+}
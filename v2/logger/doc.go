@@ -0,0 +1,23 @@
+// Package logger is a fast, opinionated, lightweight, static-structured and
+// leveled logger. See InitializeWriter and LogService.NewContext.
+//
+// The Loki, Elasticsearch, Splunk, Fluentd, and OTLP writers (the batching
+// writers) accumulate entries, and send them in batches from a goroutine of
+// their own, so that logging never waits on the network. Their options share
+// the following semantics.
+//
+// A batch that fails to send is retried up to MaxRetries times, after which it
+// is discarded. MaxRetries defaults to 3, and a negative value disables
+// retries. Requests are retried if they fail with a network error, a 429, or a
+// 5xx response (the Fluentd writer retries any failure, after reconnecting).
+// The delay before the first retry is MinBackoff, which defaults to 100ms, and
+// each subsequent retry doubles the delay, up to MaxBackoff, which defaults to
+// 30s. Delays are jittered by up to half of their duration. A longer delay
+// that is requested by the Retry-After header of a 429 or 503 response takes
+// precedence. The OTLP writer doesn't retry.
+//
+// Each entry of a discarded batch is passed to the ErrorHandler. The
+// Initialize functions default it to the LogService's ErrorHandler, or failing
+// that, to an ErrorHandler that reports errors to os.Stderr. Otherwise,
+// failures are only reported by Flush and Close.
+package logger
@@ -0,0 +1,133 @@
+package logger
+
+import "strings"
+
+// ecsVersion is the version of the Elastic Common Schema that the ECS encoder
+// conforms to.
+const ecsVersion = "8.11.0"
+
+// defaultECSFieldNamespace is the object in which the details and non-ECS
+// fields of each entry are nested by default.
+const defaultECSFieldNamespace = "nobslogger"
+
+// ECSOptions exposes configuration settings for Elastic Common Schema output.
+type ECSOptions struct {
+	// FieldNamespace is the name of the object in which each entry's details,
+	// and any fields that aren't ECS fields, are nested, so that they can't
+	// conflict with ECS fields. Defaults to "nobslogger".
+	FieldNamespace string
+}
+
+// ecsEncoder encodes entries as Elastic Common Schema JSON documents.
+type ecsEncoder struct {
+	namespace string
+}
+
+// NewECSEncoder returns an Encoder that encodes entries as JSON documents that
+// conform to the Elastic Common Schema, i.e.
+//
+//	{"@timestamp":"2009-11-10T23:00:00Z","log.level":"info","message":"hello",
+//	 "ecs.version":"8.11.0","log.logger":"site",
+//	 "event.action":"operation","event.severity":300,
+//	 "service.name":"name","service.environment":"prod",
+//	 "service.node.name":"instance","labels.system_name":"system",
+//	 "nobslogger.details":"","user.id":"42","nobslogger.attempt":3}
+//
+// The leading fields follow the ordering recommended by the ECS logging
+// specification. The system name is written as a label.
+//
+// Every field is written with a dotted name (which Elasticsearch expands into
+// objects, as the ECS logging specification permits), so that each can be
+// encoded independently of the others, and so that fields that are logged
+// within the same field set as those above (such as event.dataset or
+// service.version) don't produce a second representation of that set.
+//
+// Fields whose keys are ECS field names (that is, dotted keys within an ECS
+// field set, such as user.id or http.request.method) are written at the top
+// level. Since ECS has no equivalent for the details of an entry, or for
+// other fields, these are nested within the namespace named by
+// options.FieldNamespace.
+func NewECSEncoder(options ECSOptions) Encoder {
+	if options.FieldNamespace == "" {
+		options.FieldNamespace = defaultECSFieldNamespace
+	}
+	return &ecsEncoder{
+		namespace: string(serializeEscaped(nil, options.FieldNamespace)),
+	}
+}
+
+func (e *ecsEncoder) begin(buffer []byte, r record) []byte {
+	buffer = append(buffer, `{"@timestamp":"`...)
+	buffer = append(buffer, r.timestamp...)
+	buffer = append(buffer, `","log.level":"`...)
+	buffer = append(buffer, r.detail.Severity...)
+	buffer = append(buffer, `","message":"`...)
+	buffer = append(buffer, r.detail.Message...)
+	buffer = append(buffer, `","ecs.version":"`...)
+	buffer = append(buffer, ecsVersion...)
+	buffer = append(buffer, `","log.logger":"`...)
+	buffer = append(buffer, r.site...)
+	buffer = append(buffer, `","event.action":"`...)
+	buffer = append(buffer, r.operation...)
+	buffer = append(buffer, `","event.severity":`...)
+	if r.detail.Level.rank() == 0 {
+		buffer = append(buffer, '0')
+	} else {
+		buffer = append(buffer, r.detail.Level...)
+	}
+	buffer = append(buffer, `,"service.name":"`...)
+	buffer = append(buffer, r.sc.ServiceName...)
+	buffer = append(buffer, `","service.environment":"`...)
+	buffer = append(buffer, r.sc.Environment...)
+	buffer = append(buffer, `","service.node.name":"`...)
+	buffer = append(buffer, r.sc.ServiceInstanceID...)
+	buffer = append(buffer, `","labels.system_name":"`...)
+	buffer = append(buffer, r.sc.SystemName...)
+	buffer = append(buffer, `","`...)
+	buffer = append(buffer, e.namespace...)
+	buffer = append(buffer, `.details":"`...)
+	buffer = append(buffer, r.detail.Details...)
+	buffer = append(buffer, '"')
+	return buffer
+}
+
+func (e *ecsEncoder) field(buffer []byte, f Field) []byte {
+	if isECSField(f.key) {
+		return serializeField(buffer, &f)
+	}
+	buffer = append(buffer, `,"`...)
+	buffer = append(buffer, e.namespace...)
+	buffer = append(buffer, '.')
+	buffer = serializeEscaped(buffer, f.key)
+	buffer = append(buffer, fieldKeyCloseToken...)
+	return serializeFieldValue(buffer, &f)
+}
+
+func (e *ecsEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, `,"`...)
+		buffer = append(buffer, e.namespace...)
+		buffer = append(buffer, `.truncated":true`...)
+	}
+	return append(buffer, braceCloseToken...)
+}
+
+// isECSField reports whether key is the dotted name of a field within one of
+// the ECS field sets that may appear at the top level of a document.
+func isECSField(key string) bool {
+	i := strings.IndexByte(key, '.')
+	if i <= 0 || i == len(key)-1 {
+		return false
+	}
+	switch key[:i] {
+	case "agent", "as", "client", "cloud", "container", "data_stream",
+		"destination", "device", "dll", "dns", "ecs", "email", "error",
+		"event", "faas", "file", "group", "host", "http", "labels", "log",
+		"network", "observer", "orchestrator", "organization", "package",
+		"process", "registry", "related", "rule", "server", "service",
+		"source", "span", "threat", "tls", "trace", "transaction", "url",
+		"user", "user_agent", "vulnerability":
+		return true
+	}
+	return false
+}
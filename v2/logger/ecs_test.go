@@ -0,0 +1,172 @@
+package logger_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func Test_ECSEncoder(t *testing.T) {
+	var entry map[string]interface{}
+	var raw string
+	writer := writerFunc(func(bb []byte) (int, error) {
+		raw = string(bb)
+		entry = map[string]interface{}{}
+		if err := json.Unmarshal(bb, &entry); err != nil {
+			t.Errorf("Error: %v\nJSON: %s", err, bb)
+		}
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewECSEncoder(logger.ECSOptions{}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log = log.With(logger.String("request_id", "abc"), logger.String("trace.id", "4bf92f35"))
+	log.WarnF("message", "details", logger.Int64("user", 42), logger.String("http.request.method", "GET"))
+
+	expected := map[string]interface{}{
+		"log.level":             "warn",
+		"message":               "message",
+		"ecs.version":           "8.11.0",
+		"log.logger":            "context site",
+		"event.action":          "operation",
+		"event.severity":        float64(400),
+		"service.name":          "billing",
+		"service.environment":   "test",
+		"service.node.name":     "instance-1",
+		"labels.system_name":    "system",
+		"nobslogger.details":    "details",
+		"nobslogger.request_id": "abc",
+		"nobslogger.user":       float64(42),
+		"trace.id":              "4bf92f35",
+		"http.request.method":   "GET",
+	}
+	for key, value := range expected {
+		if !reflect.DeepEqual(entry[key], value) {
+			t.Errorf("expected %v to be %v, got %v", key, value, entry[key])
+		}
+	}
+	if _, ok := entry["@timestamp"]; !ok {
+		t.Error("expected @timestamp")
+	}
+	// The ECS logging specification requires these fields to come first.
+	if !strings.HasPrefix(raw, `{"@timestamp":`) || strings.Index(raw, `"log.level"`) > strings.Index(raw, `"message"`) {
+		t.Errorf("unexpected field order: %v", raw)
+	}
+}
+
+func Test_ECSEncoderFieldNamespace(t *testing.T) {
+	var entry map[string]interface{}
+	writer := writerFunc(func(bb []byte) (int, error) {
+		entry = map[string]interface{}{}
+		if err := json.Unmarshal(bb, &entry); err != nil {
+			t.Errorf("Error: %v\nJSON: %s", err, bb)
+		}
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		MaxEntrySize: 500,
+		Encoder:      logger.NewECSEncoder(logger.ECSOptions{FieldNamespace: "custom"}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoD("message", strings.Repeat("d", 1000))
+
+	if _, ok := entry["custom.details"]; !ok {
+		t.Errorf("expected details to be nested in custom: %v", entry)
+	}
+	if entry["custom.truncated"] != true {
+		t.Errorf("expected entry to be marked as truncated: %v", entry)
+	}
+}
+
+// Only dotted keys within an ECS field set are ECS fields; all other keys
+// must be nested in the namespace.
+func Test_ECSEncoderFieldKeys(t *testing.T) {
+	var entry map[string]interface{}
+	writer := writerFunc(func(bb []byte) (int, error) {
+		entry = map[string]interface{}{}
+		if err := json.Unmarshal(bb, &entry); err != nil {
+			t.Errorf("Error: %v\nJSON: %s", err, bb)
+		}
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewECSEncoder(logger.ECSOptions{}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+
+	testCases := []struct {
+		key      string
+		expected string
+	}{
+		{"user.id", "user.id"},
+		{"user_agent.original", "user_agent.original"},
+		{"labels.team", "labels.team"},
+		{"user", "nobslogger.user"},
+		{"user.", "nobslogger.user."},
+		{".id", "nobslogger..id"},
+		{"users.id", "nobslogger.users.id"},
+		{"request_id", "nobslogger.request_id"},
+	}
+	for _, testCase := range testCases {
+		log.InfoF("message", "", logger.String(testCase.key, "value"))
+		if entry[testCase.expected] != "value" {
+			t.Errorf("expected %q to be written as %q: %v", testCase.key, testCase.expected, entry)
+		}
+	}
+}
+
+// Fields within the event and service field sets must be written in the same
+// (dotted) representation as the fields that the encoder writes to those sets.
+func Test_ECSEncoderFieldSets(t *testing.T) {
+	var entry map[string]interface{}
+	writer := writerFunc(func(bb []byte) (int, error) {
+		entry = map[string]interface{}{}
+		if err := json.Unmarshal(bb, &entry); err != nil {
+			t.Errorf("Error: %v\nJSON: %s", err, bb)
+		}
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewECSEncoder(logger.ECSOptions{}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoF("message", "", logger.String("event.dataset", "billing.log"), logger.String("service.version", "1.2.3"))
+
+	expected := map[string]interface{}{
+		"event.action":    "operation",
+		"event.dataset":   "billing.log",
+		"service.name":    "billing",
+		"service.version": "1.2.3",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("expected %v to be %v, got %v", key, value, entry[key])
+		}
+	}
+	for _, key := range []string{"event", "service", "labels"} {
+		if _, ok := entry[key]; ok {
+			t.Errorf("expected no %v object: %v", key, entry)
+		}
+	}
+}
+
+func Test_ECSEncoderZeroAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewECSEncoder(logger.ECSOptions{}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	allocs := testing.AllocsPerRun(100, func() {
+		log.InfoF("message", "details", logger.Int64("user", 42))
+	})
+	if allocs != 0 {
+		t.Errorf("expected 0 allocations, got %v", allocs)
+	}
+}
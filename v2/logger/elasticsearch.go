@@ -0,0 +1,469 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// elasticsearchBulkPath is the path of the bulk API.
+	elasticsearchBulkPath = "/_bulk"
+
+	// defaultElasticsearchIndex is the index pattern that is used if no other
+	// pattern is specified.
+	defaultElasticsearchIndex = "logs-{service_name}-{date}"
+
+	// defaultElasticsearchDateLayout is the layout of the {date} placeholder.
+	defaultElasticsearchDateLayout = "2006.01.02"
+)
+
+// ElasticsearchOptions exposes configuration settings for Elasticsearch
+// output.
+type ElasticsearchOptions struct {
+	// Index is the pattern from which the index of each document is derived.
+	// The placeholders {environment}, {system_name}, {service_name}, and
+	// {service_instance_id} are replaced with the corresponding (lower case)
+	// ServiceContext fields, in which any characters that aren't permitted in
+	// index names (such as spaces) are replaced with underscores. The
+	// placeholder {date} is replaced with the UTC date of the entry, as
+	// yyyy.mm.dd, and {date:layout} is replaced with the date formatted with
+	// a custom layout (see time.Time.Format). The resulting index name is
+	// lower cased, and must not start with '-', '_', or '+'. A custom layout
+	// must not produce characters that aren't permitted in index names (such
+	// as '/' or ':'). Defaults to "logs-{service_name}-{date}".
+	Index string
+
+	// Encoder determines the format of each document. The default is
+	// NewECSEncoder, whose @timestamp field is required by data streams.
+	Encoder Encoder
+
+	// Headers are added to every bulk request (i.e. for authentication).
+	Headers map[string]string
+
+	// BatchSize is the most documents that are indexed in a single request.
+	// Defaults to 512.
+	BatchSize int
+
+	// FlushInterval is the longest that an entry is held before it is
+	// indexed. Defaults to 1s.
+	FlushInterval time.Duration
+
+	// MaxRetries limits the retries of each batch (see the package doc).
+	MaxRetries int
+
+	// MinBackoff is the delay before the first retry (see the package doc).
+	MinBackoff time.Duration
+
+	// MaxBackoff is the longest delay between retries (see the package doc).
+	MaxBackoff time.Duration
+
+	// Client is used to send bulk requests. Defaults to an http.Client with
+	// a 10s timeout.
+	Client *http.Client
+
+	// ErrorHandler is passed each entry that can't be indexed (see the package doc).
+	ErrorHandler ErrorHandler
+}
+
+// InitializeElasticsearch establishes a logging service that indexes entries
+// into Elasticsearch via the bulk API, and returns a LogService instance
+// through which more detailed logging contexts can be spawned (see
+// NewContext).
+//
+// Each entry is indexed as a document, in the index derived from
+// ElasticsearchOptions.Index (by default, logs-{service_name}-{date}).
+// Documents are created with the create action, so the index may be a data
+// stream.
+//
+// Entries are indexed in batches. See ElasticsearchWriter.
+//
+// An error is returned if endpoint is malformed, or if the index name would
+// be invalid.
+//
+// endpoint: Must be the URL of the Elasticsearch cluster, i.e.
+// http://localhost:9200. If the URL has no path, the bulk API path (/_bulk) is
+// appended.
+func InitializeElasticsearch(endpoint string, serviceContext ServiceContext) (LogService, error) {
+	return InitializeElasticsearchWithOptions(endpoint, serviceContext, defaultLogServiceOptions(), ElasticsearchOptions{})
+}
+
+// InitializeElasticsearchWithOptions is the same as InitializeElasticsearch,
+// but with custom LogServiceOptions and ElasticsearchOptions supplied. The
+// Framing and Encoder options are ignored; the format of documents is
+// determined by ElasticsearchOptions.Encoder. See InitializeElasticsearch.
+func InitializeElasticsearchWithOptions(endpoint string, serviceContext ServiceContext, options LogServiceOptions, elasticsearchOptions ElasticsearchOptions) (LogService, error) {
+	if elasticsearchOptions.ErrorHandler == nil {
+		elasticsearchOptions.ErrorHandler = batchErrorHandler(options)
+	}
+	w, err := NewElasticsearchWriter(endpoint, serviceContext, elasticsearchOptions)
+	if err != nil {
+		return LogService{}, err
+	}
+	options.Framing = FramingNone
+	options.Encoder = NewElasticsearchEncoder(elasticsearchOptions)
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// elasticsearchEncoder prefixes each document, as encoded by another
+// encoder, with the entry's timestamp, from which the ElasticsearchWriter
+// derives the document's index.
+type elasticsearchEncoder struct {
+	document Encoder
+}
+
+// NewElasticsearchEncoder returns an Encoder that encodes entries for an
+// ElasticsearchWriter (see InitializeElasticsearch). Only the Encoder option
+// is used.
+//
+// Each entry is encoded as its timestamp, followed by the document, so
+// entries that are written by this encoder are only of use to an
+// ElasticsearchWriter.
+func NewElasticsearchEncoder(options ElasticsearchOptions) Encoder {
+	if options.Encoder == nil {
+		options.Encoder = NewECSEncoder(ECSOptions{})
+	}
+	return &elasticsearchEncoder{
+		document: options.Encoder,
+	}
+}
+
+func (e *elasticsearchEncoder) begin(buffer []byte, r record) []byte {
+	buffer = strconv.AppendInt(buffer, r.unixNano(), 10)
+	buffer = append(buffer, 0)
+	return e.document.begin(buffer, r)
+}
+
+func (e *elasticsearchEncoder) field(buffer []byte, f Field) []byte {
+	return e.document.field(buffer, f)
+}
+
+func (e *elasticsearchEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	return e.document.end(buffer, r, truncated)
+}
+
+// elasticsearchDocument is a document awaiting indexing.
+type elasticsearchDocument struct {
+	entry     []byte
+	timestamp time.Time
+	source    []byte
+}
+
+// splitElasticsearchEntry splits an entry written by the Elasticsearch
+// encoder.
+func splitElasticsearchEntry(entry []byte) elasticsearchDocument {
+	i := bytes.IndexByte(entry, 0)
+	if i < 0 {
+		return elasticsearchDocument{entry: entry, timestamp: time.Now(), source: entry}
+	}
+	nanoseconds, err := strconv.ParseInt(string(entry[:i]), 10, 64)
+	if err != nil {
+		return elasticsearchDocument{entry: entry, timestamp: time.Now(), source: entry[i+1:]}
+	}
+	return elasticsearchDocument{entry: entry, timestamp: time.Unix(0, nanoseconds), source: entry[i+1:]}
+}
+
+// elasticsearchIndexSegment is a part of an index pattern; either a literal,
+// or (if layout is set) a date.
+type elasticsearchIndexSegment struct {
+	literal string
+	layout  string
+}
+
+// elasticsearchIndexReplacer replaces the characters that Elasticsearch
+// doesn't permit in index names.
+var elasticsearchIndexReplacer = strings.NewReplacer(
+	" ", "_", "\\", "_", "/", "_", "*", "_", "?", "_", "\"", "_",
+	"<", "_", ">", "_", "|", "_", ",", "_", "#", "_", ":", "_",
+)
+
+// elasticsearchIndexInvalid holds the characters that Elasticsearch doesn't
+// permit in index names.
+const elasticsearchIndexInvalid = " \\/*?\"<>|,#:"
+
+// elasticsearchIndexValue returns s, lower cased, with any characters that
+// aren't permitted in an index name replaced.
+func elasticsearchIndexValue(s string) string {
+	return elasticsearchIndexReplacer.Replace(strings.ToLower(s))
+}
+
+// parseElasticsearchIndex splits an index pattern into segments, replacing
+// any ServiceContext placeholders along the way, and lower casing the
+// literals. An error is returned if the resulting index name would start with
+// a character that Elasticsearch doesn't permit, or if a date layout would
+// produce one.
+func parseElasticsearchIndex(pattern string, serviceContext ServiceContext) ([]elasticsearchIndexSegment, error) {
+	replacer := strings.NewReplacer(
+		"{environment}", elasticsearchIndexValue(serviceContext.Environment),
+		"{system_name}", elasticsearchIndexValue(serviceContext.SystemName),
+		"{service_name}", elasticsearchIndexValue(serviceContext.ServiceName),
+		"{service_instance_id}", elasticsearchIndexValue(serviceContext.ServiceInstanceID),
+	)
+	pattern = replacer.Replace(pattern)
+	if pattern == "" || strings.IndexByte("-_+", pattern[0]) >= 0 {
+		return nil, fmt.Errorf("nobslogger: index name must not be empty or start with '-', '_', or '+': %q", pattern)
+	}
+
+	segments := []elasticsearchIndexSegment{}
+	for {
+		start := strings.Index(pattern, "{date")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(pattern[start:], '}') + start
+		if end < start {
+			break
+		}
+		placeholder := pattern[start+1 : end]
+		layout := defaultElasticsearchDateLayout
+		if strings.HasPrefix(placeholder, "date:") {
+			layout = placeholder[len("date:"):]
+			sample := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(layout)
+			if layout == "" || strings.ContainsAny(sample, elasticsearchIndexInvalid) {
+				return nil, fmt.Errorf("nobslogger: date layout must produce a valid index name: %q", layout)
+			}
+		} else if placeholder != "date" {
+			segments = append(segments, elasticsearchIndexSegment{literal: strings.ToLower(pattern[:end+1])})
+			pattern = pattern[end+1:]
+			continue
+		}
+		segments = append(segments,
+			elasticsearchIndexSegment{literal: strings.ToLower(pattern[:start])},
+			elasticsearchIndexSegment{layout: layout},
+		)
+		pattern = pattern[end+1:]
+	}
+	return append(segments, elasticsearchIndexSegment{literal: strings.ToLower(pattern)}), nil
+}
+
+// ElasticsearchWriter is an io.WriteCloser that indexes entries into
+// Elasticsearch via the bulk API. Entries must be encoded by the encoder
+// returned by NewElasticsearchEncoder.
+//
+// Entries are accumulated, and indexed in batches of up to BatchSize
+// documents, at least every FlushInterval. Bulk requests (and their retries)
+// run in the background, so Write never waits for Elasticsearch; if
+// Elasticsearch falls behind, and several full batches are already awaiting
+// indexing, Write returns ErrBufferFull. Documents that can't be indexed are
+// passed to the ErrorHandler, and the error is returned by the next call to
+// Flush or Close.
+//
+// The response to each bulk request is inspected for documents that failed
+// individually. Documents that failed with a 429 or 5xx status (i.e. because
+// the cluster was overloaded) are resent, with backoff, up to MaxRetries
+// times; other failures (i.e. mapping conflicts) are not retried. Requests
+// that fail as a whole with a network error, a 429, or a 5xx response are
+// retried likewise, after the delay that is requested by a Retry-After header
+// if it is longer than the backoff. Retries are abandoned if the context
+// passed to CloseContext is done. An error is returned describing any
+// documents that were not indexed.
+type ElasticsearchWriter struct {
+	endpoint   string
+	header     http.Header
+	client     *http.Client
+	maxRetries int
+	index      []elasticsearchIndexSegment
+	batch      *batcher
+
+	// The following are only accessed while flushing, which the batcher
+	// serializes.
+	backoff   *backoff
+	documents []elasticsearchDocument
+	failed    [][]byte
+	body      []byte
+	response  bytes.Buffer
+}
+
+// NewElasticsearchWriter returns an ElasticsearchWriter that indexes entries
+// via endpoint (see InitializeElasticsearch). The ServiceContext is used to
+// resolve the index pattern.
+//
+// An error is returned if endpoint is malformed, or if the index name would
+// be invalid.
+func NewElasticsearchWriter(endpoint string, serviceContext ServiceContext, options ElasticsearchOptions) (*ElasticsearchWriter, error) {
+	if err := validateHTTPEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	if u, _ := url.Parse(endpoint); u.Path == "" || u.Path == "/" {
+		u.Path = elasticsearchBulkPath
+		endpoint = u.String()
+	}
+	if options.Index == "" {
+		options.Index = defaultElasticsearchIndex
+	}
+	index, err := parseElasticsearchIndex(options.Index, serviceContext)
+	if err != nil {
+		return nil, err
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	options.MaxRetries = retryLimit(options.MaxRetries)
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	w := &ElasticsearchWriter{
+		endpoint:   endpoint,
+		header:     newHTTPHeader("application/x-ndjson", options.Headers),
+		client:     options.Client,
+		maxRetries: options.MaxRetries,
+		index:      index,
+		backoff:    newBackoff(options.MinBackoff, options.MaxBackoff),
+	}
+	w.batch = newBatcher(options.BatchSize, options.FlushInterval, w.bulk, options.ErrorHandler)
+	return w, nil
+}
+
+// Write adds an entry to the current batch, indexing the batch if it is
+// full.
+func (w *ElasticsearchWriter) Write(p []byte) (int, error) {
+	return w.batch.Write(p)
+}
+
+// Flush indexes the current batch, if any.
+func (w *ElasticsearchWriter) Flush() error {
+	return w.batch.Flush()
+}
+
+// Close indexes the current batch, if any, and stops the periodic requests.
+// Writes after Close return ErrWriterClosed.
+func (w *ElasticsearchWriter) Close() error {
+	return w.batch.Close()
+}
+
+// CloseContext is the same as Close, but if ctx is done before the remaining
+// batches have been indexed, the bulk request in progress is abandoned, and
+// the remaining batches are discarded.
+func (w *ElasticsearchWriter) CloseContext(ctx context.Context) error {
+	return w.batch.CloseContext(ctx)
+}
+
+// elasticsearchBulkResponse is the part of a bulk response that reports the
+// outcome of each action.
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int                     `json:"status"`
+		Error  *elasticsearchItemError `json:"error"`
+	} `json:"items"`
+}
+
+// elasticsearchItemError is the error reported for an action that failed.
+type elasticsearchItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// itemError describes the failure of an action.
+func itemError(status int, err *elasticsearchItemError) error {
+	if err == nil {
+		return fmt.Errorf("status %d", status)
+	}
+	return fmt.Errorf("status %d: %s: %s", status, err.Type, err.Reason)
+}
+
+// bulk indexes a batch of entries, resending any documents that fail with a
+// retryable status.
+func (w *ElasticsearchWriter) bulk(ctx context.Context, entries [][]byte) error {
+	w.documents = w.documents[:0]
+	for _, entry := range entries {
+		w.documents = append(w.documents, splitElasticsearchEntry(entry))
+	}
+
+	w.backoff.reset()
+	w.failed = w.failed[:0]
+	total := len(w.documents)
+	var lastErr error
+	for attempt := 0; len(w.documents) > 0; attempt++ {
+		if attempt > 0 && (attempt > w.maxRetries || sleep(ctx, retryDelay(lastErr, w.backoff)) != nil) {
+			break
+		}
+
+		w.body = w.body[:0]
+		for _, document := range w.documents {
+			w.body = append(w.body, `{"create":{"_index":"`...)
+			w.body = w.appendIndex(w.body, document.timestamp)
+			w.body = append(w.body, "\"}}\n"...)
+			w.body = append(w.body, document.source...)
+			w.body = append(w.body, '\n')
+		}
+		if err := postHTTP(ctx, w.client, w.endpoint, w.header, w.body, &w.response); err != nil {
+			lastErr = err
+			if !retryableHTTPError(err) {
+				break
+			}
+			continue
+		}
+
+		var response elasticsearchBulkResponse
+		if err := json.Unmarshal(w.response.Bytes(), &response); err != nil {
+			return fmt.Errorf("nobslogger: malformed bulk response: %v", err)
+		}
+		if !response.Errors {
+			w.documents = w.documents[:0]
+			break
+		}
+		if len(response.Items) != len(w.documents) {
+			return fmt.Errorf("nobslogger: bulk response has %d items for %d documents", len(response.Items), len(w.documents))
+		}
+
+		// Documents that should be retried are moved to the front, in order.
+		retries := 0
+		for i, item := range response.Items {
+			for _, result := range item {
+				switch {
+				case result.Status >= 200 && result.Status <= 299:
+				case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+					w.documents[retries] = w.documents[i]
+					retries++
+					lastErr = itemError(result.Status, result.Error)
+				default:
+					w.failed = append(w.failed, w.documents[i].entry)
+					lastErr = itemError(result.Status, result.Error)
+				}
+			}
+		}
+		w.documents = w.documents[:retries]
+	}
+
+	for _, document := range w.documents {
+		w.failed = append(w.failed, document.entry)
+	}
+	if len(w.failed) == 0 {
+		return nil
+	}
+	return &batchError{
+		err:    fmt.Errorf("nobslogger: %d of %d documents were not indexed: %v", len(w.failed), total, lastErr),
+		failed: w.failed,
+	}
+}
+
+// appendIndex appends the index of a document with the specified timestamp.
+func (w *ElasticsearchWriter) appendIndex(buffer []byte, timestamp time.Time) []byte {
+	for _, segment := range w.index {
+		if segment.layout == "" {
+			buffer = serializeEscaped(buffer, segment.literal)
+			continue
+		}
+		start := len(buffer)
+		buffer = timestamp.UTC().AppendFormat(buffer, segment.layout)
+		for i := start; i < len(buffer); i++ {
+			if 'A' <= buffer[i] && buffer[i] <= 'Z' {
+				buffer[i] += 'a' - 'A'
+			}
+		}
+	}
+	return buffer
+}
@@ -0,0 +1,390 @@
+package logger_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// startBulkServer starts an httptest server that responds to successive bulk
+// requests with responses, and returns it along with a channel of the
+// requests received. Once responses are exhausted, every document is
+// reported as created.
+func startBulkServer(t *testing.T, responses ...string) (*httptest.Server, chan collectorRequest) {
+	requests := make(chan collectorRequest, 16)
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- collectorRequest{path: r.URL.Path, header: r.Header, body: body}
+		w.Header().Set("Content-Type", "application/json")
+		if i := int(atomic.AddInt32(&received, 1)) - 1; i < len(responses) {
+			w.Write([]byte(responses[i]))
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	return server, requests
+}
+
+// bulkActions splits a bulk request into its action and document lines.
+func bulkActions(t *testing.T, body []byte) ([]map[string]map[string]string, []map[string]interface{}) {
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		t.Errorf("expected the body to end with a newline: %s", body)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(body, []byte("\n")), []byte("\n"))
+	if len(lines)%2 != 0 {
+		t.Fatalf("expected action and document pairs, got %s", body)
+	}
+	actions := []map[string]map[string]string{}
+	documents := []map[string]interface{}{}
+	for i := 0; i < len(lines); i += 2 {
+		var action map[string]map[string]string
+		if err := json.Unmarshal(lines[i], &action); err != nil {
+			t.Fatalf("Error: %v\nJSON: %s", err, lines[i])
+		}
+		var document map[string]interface{}
+		if err := json.Unmarshal(lines[i+1], &document); err != nil {
+			t.Fatalf("Error: %v\nJSON: %s", err, lines[i+1])
+		}
+		actions = append(actions, action)
+		documents = append(documents, document)
+	}
+	return actions, documents
+}
+
+func Test_ElasticsearchBulk(t *testing.T) {
+	server, requests := startBulkServer(t)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeElasticsearchWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{}, logger.ElasticsearchOptions{
+		Headers:   map[string]string{"Authorization": "ApiKey key"},
+		BatchSize: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	log.Info("first")
+	log.ErrorF("second", "details", logger.Int64("user", 42))
+
+	request := receiveRequest(t, requests)
+	if request.path != "/_bulk" {
+		t.Errorf("expected the bulk path, got %v", request.path)
+	}
+	if contentType := request.header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("expected application/x-ndjson, got %v", contentType)
+	}
+	if authorization := request.header.Get("Authorization"); authorization != "ApiKey key" {
+		t.Errorf("expected authorization header, got %v", authorization)
+	}
+	actions, documents := bulkActions(t, request.body)
+	if len(actions) != 2 {
+		t.Fatalf("expected 2 documents, got %s", request.body)
+	}
+	expectedIndex := "logs-billing-" + time.Now().UTC().Format("2006.01.02")
+	for i, expected := range []string{"first", "second"} {
+		if index := actions[i]["create"]["_index"]; index != expectedIndex {
+			t.Errorf("expected index %v, got %v", expectedIndex, index)
+		}
+		if message := documents[i]["message"]; message != expected {
+			t.Errorf("expected message %v, got %v", expected, message)
+		}
+		if _, ok := documents[i]["@timestamp"]; !ok {
+			t.Errorf("expected an @timestamp, got %v", documents[i])
+		}
+	}
+	if documents[1]["nobslogger.user"] != float64(42) {
+		t.Errorf("expected fields in the document, got %v", documents[1])
+	}
+}
+
+func Test_ElasticsearchIndexPattern(t *testing.T) {
+	server, requests := startBulkServer(t)
+	defer server.Close()
+
+	w, err := logger.NewElasticsearchWriter(server.URL+"/custom/_bulk", logger.ServiceContext{
+		Environment: "Test",
+		SystemName:  "System",
+	}, logger.ElasticsearchOptions{
+		Index: "{environment}-{system_name}-{date:2006-01}-{other}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte("0\x00{}"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := receiveRequest(t, requests)
+	if request.path != "/custom/_bulk" {
+		t.Errorf("expected the custom path, got %v", request.path)
+	}
+	actions, _ := bulkActions(t, request.body)
+	if index := actions[0]["create"]["_index"]; index != "test-system-1970-01-{other}" {
+		t.Errorf("unexpected index: %v", index)
+	}
+}
+
+func Test_ElasticsearchIndexNameSanitized(t *testing.T) {
+	server, requests := startBulkServer(t)
+	defer server.Close()
+
+	w, err := logger.NewElasticsearchWriter(server.URL, logger.ServiceContext{
+		ServiceName: "Example Runner/v2:\"a,b\"#1",
+	}, logger.ElasticsearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte("0\x00{}"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions, _ := bulkActions(t, receiveRequest(t, requests).body)
+	if index := actions[0]["create"]["_index"]; index != "logs-example_runner_v2__a_b__1-1970.01.01" {
+		t.Errorf("unexpected index: %v", index)
+	}
+}
+
+// Elasticsearch only permits lower case index names, whatever the case of the
+// pattern or of the dates formatted by its layouts.
+func Test_ElasticsearchIndexNameLowerCased(t *testing.T) {
+	server, requests := startBulkServer(t)
+	defer server.Close()
+
+	w, err := logger.NewElasticsearchWriter(server.URL, syslogServiceContext, logger.ElasticsearchOptions{
+		Index: "Logs-{date:Jan-Mon}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte("0\x00{}"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions, _ := bulkActions(t, receiveRequest(t, requests).body)
+	if index := actions[0]["create"]["_index"]; index != "logs-jan-thu" {
+		t.Errorf("unexpected index: %v", index)
+	}
+}
+
+func Test_ElasticsearchInvalidIndex(t *testing.T) {
+	for _, index := range []string{"_logs", "-{service_name}", "{environment}-logs", "logs-{date:2006/01/02}", "logs-{date:15:04}", "logs-{date:}"} {
+		_, err := logger.NewElasticsearchWriter("http://localhost:9200", logger.ServiceContext{
+			Environment: "+prod",
+		}, logger.ElasticsearchOptions{Index: index})
+		if err == nil {
+			t.Errorf("expected an error for %q", index)
+		}
+	}
+}
+
+func Test_ElasticsearchRetryFailedDocuments(t *testing.T) {
+	server, requests := startBulkServer(t, `{"errors":true,"items":[
+		{"create":{"status":201}},
+		{"create":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}},
+		{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}
+	]}`)
+	defer server.Close()
+
+	failed := []string{}
+	w, err := logger.NewElasticsearchWriter(server.URL, syslogServiceContext, logger.ElasticsearchOptions{
+		MinBackoff: time.Millisecond,
+		ErrorHandler: func(err error, entry []byte) {
+			failed = append(failed, string(entry))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte(`0` + "\x00" + `{"n":1}`))
+	w.Write([]byte(`0` + "\x00" + `{"n":2}`))
+	w.Write([]byte(`0` + "\x00" + `{"n":3}`))
+	err = w.Flush()
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Errorf("expected an error for the rejected document, got %v", err)
+	}
+	if len(failed) != 1 || failed[0] != "0\x00{\"n\":3}" {
+		t.Errorf("expected only the rejected document to be reported, got %q", failed)
+	}
+
+	receiveRequest(t, requests)
+	_, documents := bulkActions(t, receiveRequest(t, requests).body)
+	if len(documents) != 1 || documents[0]["n"] != float64(2) {
+		t.Errorf("expected only the throttled document to be retried, got %v", documents)
+	}
+	select {
+	case request := <-requests:
+		t.Errorf("unexpected request: %s", request.body)
+	default:
+	}
+}
+
+func Test_ElasticsearchRetryRequest(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+
+	w, err := logger.NewElasticsearchWriter(server.URL, syslogServiceContext, logger.ElasticsearchOptions{
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte("0\x00{}"))
+	if err := w.Flush(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if actual := atomic.LoadInt32(&attempts); actual != 3 {
+		t.Errorf("expected 3 attempts, got %v", actual)
+	}
+}
+
+// Bulk requests and their retries must run in the background, rather than
+// blocking the entry that filled the batch.
+func Test_ElasticsearchRetryDoesNotBlockLogging(t *testing.T) {
+	server, requests := startBulkServer(t, `{"errors":true,"items":[
+		{"create":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}
+	]}`)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeElasticsearchWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{}, logger.ElasticsearchOptions{
+		BatchSize:  1,
+		MinBackoff: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	start := time.Now()
+	log.Info("first")
+	receiveRequest(t, requests)
+	log.Info("second")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected logging to continue during retries, took %v", elapsed)
+	}
+}
+
+// MaxRetries must be passed through to the retry helper (see Test_Retry).
+func Test_ElasticsearchMaxRetries(t *testing.T) {
+	rejected := `{"errors":true,"items":[
+		{"create":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}
+	]}`
+	server, requests := startBulkServer(t, rejected, rejected)
+	defer server.Close()
+
+	w, err := logger.NewElasticsearchWriter(server.URL, syslogServiceContext, logger.ElasticsearchOptions{
+		MaxRetries: 1,
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte("0\x00{}"))
+	if err := w.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+	receiveRequest(t, requests)
+	receiveRequest(t, requests)
+	select {
+	case request := <-requests:
+		t.Errorf("unexpected request: %s", request.body)
+	default:
+	}
+}
+
+// A bulk request that is rate limited must not be retried before the delay
+// requested by the Retry-After header.
+func Test_ElasticsearchRetryAfter(t *testing.T) {
+	attempts := make(chan time.Time, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- time.Now()
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer server.Close()
+
+	w, err := logger.NewElasticsearchWriter(server.URL, syslogServiceContext, logger.ElasticsearchOptions{
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte("0\x00{}"))
+	if err := w.Flush(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	first, second := <-attempts, <-attempts
+	if delay := second.Sub(first); delay < 900*time.Millisecond {
+		t.Errorf("expected the retry to wait for Retry-After, waited %v", delay)
+	}
+}
+
+// CloseContext must abandon a retry that is waiting out its backoff once its
+// context is done.
+func Test_ElasticsearchCloseContextStopsRetries(t *testing.T) {
+	server, requests := startBulkServer(t, `{"errors":true,"items":[
+		{"create":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}
+	]}`)
+	defer server.Close()
+
+	w, err := logger.NewElasticsearchWriter(server.URL, syslogServiceContext, logger.ElasticsearchOptions{
+		BatchSize:  1,
+		MinBackoff: time.Minute,
+		MaxBackoff: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("0\x00{}"))
+	receiveRequest(t, requests)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := w.CloseContext(ctx); err == nil {
+		t.Error("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected CloseContext to return promptly, took %v", elapsed)
+	}
+}
+
+func Test_ElasticsearchMalformedEndpoint(t *testing.T) {
+	if _, err := logger.InitializeElasticsearch("localhost:9200", syslogServiceContext); err == nil {
+		t.Error("expected an error")
+	}
+}
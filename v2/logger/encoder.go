@@ -0,0 +1,131 @@
+package logger
+
+import "time"
+
+// Encoder encodes log entries into a particular format. An Encoder is
+// selected via LogServiceOptions.Encoder.
+//
+// Encoders are constructed via the New*Encoder functions in this package (such
+// as NewJSONEncoder, NewLogfmtEncoder, and NewConsoleEncoder). Encoder's
+// methods are unexported, as encoders are tightly bound to the serialization
+// internals of this package.
+//
+// An entry is encoded in three parts: begin, which appends everything that
+// precedes the entry's fields; field, which appends a single field (including
+// any leading separator); and end, which appends everything that follows the
+// fields. This split allows the fields attached to a LogContext (see With) to
+// be encoded once, and then reused verbatim by every entry.
+//
+// Records and fields are passed by value, so that they don't escape to the
+// heap when encoders are called through this interface.
+type Encoder interface {
+	begin(buffer []byte, r record) []byte
+	field(buffer []byte, f Field) []byte
+	end(buffer []byte, r record, truncated bool) []byte
+}
+
+// record holds the values from which a log entry is encoded. String values
+// have already been escaped for JSON (see escape), with the exception of the
+// message and details written via the non-J LogContext methods, which are
+// distinguished by LogDetail.escaped.
+type record struct {
+	timestamp []byte
+	sc        *ServiceContext
+	site      string
+	operation string
+	detail    LogDetail
+
+	// fieldCount is the number of fields that are encoded between begin and
+	// end, for the benefit of formats (such as msgpack) in which the size of
+	// a map precedes its content.
+	fieldCount int
+
+	// source is the location from which the entry was logged. It is only
+	// determined for encoders that implement sourceLocator.
+	source sourceLocation
+}
+
+// sourceLocator is implemented by encoders that record the location from
+// which each entry was logged. The location is determined once per entry,
+// however many times the entry is encoded to fit within MaxEntrySize.
+type sourceLocator interface {
+	locatesSource() bool
+}
+
+// encodeEntry appends a complete entry to buffer. contextFields is the
+// pre-encoded fragment of the LogContext's fields.
+func encodeEntry(buffer []byte, enc Encoder, r record, contextFields string, fields []Field, truncated bool) []byte {
+	buffer = enc.begin(buffer, r)
+	buffer = append(buffer, contextFields...)
+	for i := range fields {
+		buffer = enc.field(buffer, fields[i])
+	}
+	return enc.end(buffer, r, truncated)
+}
+
+// unixNano returns the record's timestamp as a number of nanoseconds since the
+// Unix epoch. The timestamp is parsed by hand (rather than via time.Parse) to
+// avoid allocating a time.Location for its offset. If the timestamp can't be
+// parsed, the current time is returned instead.
+func (r *record) unixNano() int64 {
+	t := r.timestamp
+	if len(t) < len("2006-01-02T15:04:05Z") || t[4] != '-' || t[7] != '-' || t[10] != 'T' || t[13] != ':' || t[16] != ':' {
+		return time.Now().UnixNano()
+	}
+	digits := func(b []byte) int {
+		n := 0
+		for _, c := range b {
+			n = n*10 + int(c-'0')
+		}
+		return n
+	}
+	nanoseconds := 0
+	i := 19
+	if t[i] == '.' {
+		scale := 100000000
+		for i++; i < len(t) && t[i] >= '0' && t[i] <= '9'; i++ {
+			nanoseconds += int(t[i]-'0') * scale
+			scale /= 10
+		}
+	}
+	offset := 0
+	if i < len(t) && (t[i] == '+' || t[i] == '-') && len(t) >= i+6 {
+		offset = digits(t[i+1:i+3])*3600 + digits(t[i+4:i+6])*60
+		if t[i] == '-' {
+			offset = -offset
+		}
+	}
+	utc := time.Date(digits(t[0:4]), time.Month(digits(t[5:7])), digits(t[8:10]),
+		digits(t[11:13]), digits(t[14:16]), digits(t[17:19]), nanoseconds, time.UTC)
+	return utc.UnixNano() - int64(offset)*int64(time.Second)
+}
+
+// appendTimestamp appends an RFC 3339 timestamp with exactly the specified
+// number of digits of fractional seconds, truncating or zero padding the
+// fraction as necessary.
+func appendTimestamp(buffer []byte, timestamp []byte, digits int) []byte {
+	const secondsEnd = len("2006-01-02T15:04:05")
+	if len(timestamp) < secondsEnd {
+		return append(buffer, timestamp...)
+	}
+	buffer = append(buffer, timestamp[:secondsEnd]...)
+	i := secondsEnd
+	if i < len(timestamp) && timestamp[i] == '.' {
+		i++
+	}
+	if digits > 0 {
+		buffer = append(buffer, '.')
+	}
+	for n := 0; n < digits; n++ {
+		if i < len(timestamp) && timestamp[i] >= '0' && timestamp[i] <= '9' {
+			buffer = append(buffer, timestamp[i])
+			i++
+		} else {
+			buffer = append(buffer, '0')
+		}
+	}
+	for i < len(timestamp) && timestamp[i] >= '0' && timestamp[i] <= '9' {
+		i++
+	}
+	return append(buffer, timestamp[i:]...)
+}
@@ -0,0 +1,168 @@
+package logger
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy determines how an asynchronous LogService behaves when its
+// queue is full (see LogServiceOptions.AsyncQueueSize).
+type OverflowPolicy int
+
+// OverflowPolicy constants.
+const (
+	// OverflowBlock blocks the logging goroutine until space is available in
+	// the queue. No entries are lost, but a slow writer will eventually apply
+	// backpressure to all LogContexts.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest discards the entry being logged.
+	OverflowDropNewest
+
+	// OverflowDropOldest discards the oldest entry in the queue to make room
+	// for the entry being logged.
+	OverflowDropOldest
+
+	// OverflowDropBelowLevel discards the entry being logged if it is below
+	// LogServiceOptions.OverflowMinLevel. Otherwise, the logging goroutine
+	// blocks until space is available in the queue.
+	OverflowDropBelowLevel
+)
+
+type queueSlot struct {
+	entry []byte
+	level int32
+}
+
+// entryQueue is a bounded ring buffer of serialized log entries, which are
+// consumed by a dedicated writer goroutine (see run).
+//
+// Each slot retains its buffer between uses, and the writer goroutine swaps
+// its own buffer with that of the slot it consumes, so once the queue has
+// warmed up, entries are queued without allocating.
+type entryQueue struct {
+	// dropped is accessed atomically, and is the first field in the struct
+	// to guarantee 64-bit alignment.
+	dropped  uint64
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	slots    []queueSlot
+	head     int
+	count    int
+	closed   bool
+	done     chan struct{}
+	policy   OverflowPolicy
+	minLevel int32
+}
+
+func newEntryQueue(size int, policy OverflowPolicy, minLevel LogLevel) *entryQueue {
+	q := &entryQueue{
+		slots:    make([]queueSlot, size),
+		policy:   policy,
+		minLevel: minLevel.rank(),
+		done:     make(chan struct{}),
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// push copies the entry into the queue, subject to the queue's
+// OverflowPolicy. Entries pushed after the queue is closed are dropped.
+//
+// If the queue is full, and the policy requires the entry to wait for room,
+// push returns false without queuing the entry. The caller must then queue a
+// copy of it via pushWait, once it has released the LogService's lock, so
+// that only the goroutine that overflowed the queue is blocked.
+func (q *entryQueue) push(entry []byte, level int32) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count == len(q.slots) && !q.closed {
+		switch {
+		case q.policy == OverflowDropNewest,
+			q.policy == OverflowDropBelowLevel && level < q.minLevel:
+			atomic.AddUint64(&q.dropped, 1)
+			return true
+		case q.policy == OverflowDropOldest:
+			q.head = (q.head + 1) % len(q.slots)
+			q.count--
+			atomic.AddUint64(&q.dropped, 1)
+		default:
+			return false
+		}
+	}
+	q.enqueue(entry, level)
+	return true
+}
+
+// pushWait copies the entry into the queue, waiting for room if the queue is
+// full (see push).
+func (q *entryQueue) pushWait(entry []byte, level int32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.count == len(q.slots) && !q.closed {
+		q.notFull.Wait()
+	}
+	q.enqueue(entry, level)
+}
+
+// enqueue copies the entry into the next free slot. enqueue must be called
+// with q.mu held, and only when the queue is closed or has room.
+func (q *entryQueue) enqueue(entry []byte, level int32) {
+	if q.closed {
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+	slot := &q.slots[(q.head+q.count)%len(q.slots)]
+	slot.entry = append(slot.entry[:0], entry...)
+	slot.level = level
+	q.count++
+	q.notEmpty.Signal()
+}
+
+// run consumes entries from the queue, passing each to the write function,
+// until the queue is closed and empty.
+func (q *entryQueue) run(write func([]byte)) {
+	var entry []byte
+	for {
+		q.mu.Lock()
+		for q.count == 0 && !q.closed {
+			q.notEmpty.Wait()
+		}
+		if q.count == 0 {
+			q.mu.Unlock()
+			close(q.done)
+			return
+		}
+		slot := &q.slots[q.head]
+		entry, slot.entry = slot.entry, entry[:0]
+		q.head = (q.head + 1) % len(q.slots)
+		q.count--
+		q.notFull.Signal()
+		q.mu.Unlock()
+
+		write(entry)
+	}
+}
+
+// close stops the queue from accepting new entries. The writer goroutine
+// exits once all remaining entries have been written, at which point the
+// done channel is closed.
+func (q *entryQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// abandon discards any entries that have not yet been consumed by the writer
+// goroutine.
+func (q *entryQueue) abandon() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	atomic.AddUint64(&q.dropped, uint64(q.count))
+	q.count = 0
+	q.notFull.Broadcast()
+}
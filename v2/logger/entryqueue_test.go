@@ -0,0 +1,204 @@
+package logger_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// blockingWriter records the message of each entry it receives, and blocks
+// all writes until it is released.
+type blockingWriter struct {
+	started  chan struct{}
+	release  chan struct{}
+	mu       sync.Mutex
+	messages []string
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (w *blockingWriter) Write(bb []byte) (int, error) {
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(bb, &entry); err != nil {
+		panic(err)
+	}
+	w.mu.Lock()
+	w.messages = append(w.messages, entry["msg"].(string))
+	w.mu.Unlock()
+	w.started <- struct{}{}
+	<-w.release
+	return len(bb), nil
+}
+
+func (w *blockingWriter) Messages() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.messages...)
+}
+
+func Test_AsyncOverflowPolicies(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy logger.OverflowPolicy
+		// blocks lists the overflowing entries that wait for room in the
+		// queue, rather than being dropped (or dropping another entry).
+		blocks   map[string]bool
+		expected []string
+	}{
+		{
+			name:     "block",
+			policy:   logger.OverflowBlock,
+			blocks:   map[string]bool{"3": true, "4": true},
+			expected: []string{"1", "2", "3", "4"},
+		},
+		{
+			name:     "drop newest",
+			policy:   logger.OverflowDropNewest,
+			expected: []string{"1", "2"},
+		},
+		{
+			name:     "drop oldest",
+			policy:   logger.OverflowDropOldest,
+			expected: []string{"1", "4"},
+		},
+		{
+			name:     "drop below level",
+			policy:   logger.OverflowDropBelowLevel,
+			blocks:   map[string]bool{"4": true},
+			expected: []string{"1", "2", "4"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writer := newBlockingWriter()
+			loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+				AsyncQueueSize:   1,
+				OverflowPolicy:   tc.policy,
+				OverflowMinLevel: logger.LogLevelWarn,
+			})
+			log := loggerService.NewContext("context site", "operation")
+			entries := []struct {
+				message string
+				log     func(message string)
+			}{
+				{"3", func(message string) { log.Info(message) }},
+				{"4", func(message string) { log.Error(message) }},
+			}
+
+			// Entry 1 is taken by the writer goroutine, which then blocks
+			// until it is released. Entry 2 fills the queue to capacity, so
+			// entries 3 and 4 overflow.
+			log.Info("1")
+			<-writer.started
+			log.Info("2")
+
+			// Entries that don't block are logged before the writer is
+			// released, so they always find the queue full. Entries that
+			// block are logged, in order, by another goroutine.
+			for _, entry := range entries {
+				if !tc.blocks[entry.message] {
+					entry.log(entry.message)
+				}
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for _, entry := range entries {
+					if tc.blocks[entry.message] {
+						entry.log(entry.message)
+					}
+				}
+			}()
+
+			close(writer.release)
+			<-done
+			loggerService.Close(context.Background())
+
+			if actual := writer.Messages(); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+// In asynchronous mode, logging goroutines must not wait on the writer.
+func Test_AsyncDoesNotBlockOnWriter(t *testing.T) {
+	writer := newBlockingWriter()
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		CancellationDeadline: 10 * time.Millisecond,
+		AsyncQueueSize:       10,
+	})
+	log := loggerService.NewContext("context site", "operation")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			log.Info("message")
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging blocked on the writer")
+	}
+	close(writer.release)
+	loggerService.Finish()
+
+	if actual := len(writer.Messages()); actual != 10 {
+		t.Errorf("expected 10 entries to be written, got %v", actual)
+	}
+}
+
+// An entry that waits for room in a full queue must not hold up other
+// logging goroutines; here, entries that are dropped by the policy.
+func Test_AsyncBlockedEntryDoesNotBlockOthers(t *testing.T) {
+	writer := newBlockingWriter()
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		CancellationDeadline: 10 * time.Millisecond,
+		AsyncQueueSize:       1,
+		OverflowPolicy:       logger.OverflowDropBelowLevel,
+		OverflowMinLevel:     logger.LogLevelWarn,
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("1")
+	<-writer.started
+	log.Info("2")
+
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		log.Error("3")
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		log.Info("4")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging blocked on an entry waiting for room in the queue")
+	}
+	close(writer.release)
+	<-blocked
+	loggerService.Finish()
+
+	if actual, expected := writer.Messages(), []string{"1", "2", "3"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,84 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// An ErrorHandler is called whenever a LogService's writer returns an error
+// (see LogServiceOptions.ErrorHandler). err is the error returned by the
+// writer, and entry is the serialized entry that could not be written.
+//
+// entry is only valid for the duration of the call, and must be copied if it
+// is to be retained. ErrorHandlers are called while the LogService is locked
+// (or from the writer goroutine in asynchronous mode), so they should return
+// promptly.
+type ErrorHandler func(err error, entry []byte)
+
+// DiscardErrorHandler is an ErrorHandler that silently ignores writer errors.
+func DiscardErrorHandler(err error, entry []byte) {}
+
+// StderrErrorHandler returns an ErrorHandler that reports writer errors to
+// os.Stderr, at most once per interval. The failed entries themselves are not
+// reported. Errors that are suppressed within an interval are counted, and
+// the count is included with the next report.
+func StderrErrorHandler(interval time.Duration) ErrorHandler {
+	limiter := &rateLimiter{interval: interval}
+	return func(err error, entry []byte) {
+		reportError(limiter, err)
+	}
+}
+
+// SecondaryWriterErrorHandler returns an ErrorHandler that writes each entry
+// that could not be written by the LogService's writer to w instead (for
+// example, a local file as a fallback for a remote log collector). If w also
+// returns an error, the error is reported to os.Stderr, at most once per
+// interval (see StderrErrorHandler).
+func SecondaryWriterErrorHandler(w io.Writer, interval time.Duration) ErrorHandler {
+	limiter := &rateLimiter{interval: interval}
+	return func(err error, entry []byte) {
+		if _, secondaryErr := w.Write(entry); secondaryErr != nil {
+			reportError(limiter, secondaryErr)
+		}
+	}
+}
+
+func reportError(limiter *rateLimiter, err error) {
+	ok, suppressed := limiter.allow()
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		fmt.Fprintf(os.Stderr, "nobslogger: error occurred while shipping log data: %v (%d similar errors suppressed)\n", err, suppressed)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "nobslogger: error occurred while shipping log data: %v\n", err)
+}
+
+// rateLimiter permits one event per interval, and counts the events that are
+// suppressed in between.
+type rateLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	next       time.Time
+	suppressed uint64
+}
+
+// allow reports whether an event is permitted and, if so, how many events
+// were suppressed since the last permitted event.
+func (r *rateLimiter) allow() (bool, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Before(r.next) {
+		r.suppressed++
+		return false, 0
+	}
+	suppressed := r.suppressed
+	r.suppressed = 0
+	r.next = now.Add(r.interval)
+	return true, suppressed
+}
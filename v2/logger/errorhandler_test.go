@@ -0,0 +1,105 @@
+package logger_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+	"github.com/eltorocorp/nobslogger/v2/mocks/mock_io"
+	"github.com/golang/mock/gomock"
+)
+
+// When an ErrorHandler is supplied, it must receive the failed entry, and the
+// LogService must not retry via the failed writer.
+func Test_ErrorHandlerReceivesFailedEntry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().
+		Write(gomock.Any()).
+		Return(0, fmt.Errorf("test error")).
+		Times(1)
+
+	var handledErr error
+	var handledEntry string
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		ErrorHandler: func(err error, entry []byte) {
+			handledErr = err
+			handledEntry = string(entry)
+		},
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("message")
+
+	if handledErr == nil || handledErr.Error() != "test error" {
+		t.Errorf("expected test error, got %v", handledErr)
+	}
+	if !strings.Contains(handledEntry, `"msg":"message"`) {
+		t.Errorf("expected failed entry, got %v", handledEntry)
+	}
+}
+
+func Test_SecondaryWriterErrorHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().
+		Write(gomock.Any()).
+		Return(0, fmt.Errorf("test error")).
+		Times(2)
+
+	secondary := new(bytes.Buffer)
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		ErrorHandler: logger.SecondaryWriterErrorHandler(secondary, time.Second),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("first")
+	log.Info("second")
+
+	actual := secondary.String()
+	if !strings.Contains(actual, `"msg":"first"`) || !strings.Contains(actual, `"msg":"second"`) {
+		t.Errorf("expected both entries to be written to the secondary writer, got %v", actual)
+	}
+}
+
+// The StderrErrorHandler must not report more than once per interval, and
+// must report how many errors it suppressed.
+func Test_StderrErrorHandlerIsRateLimited(t *testing.T) {
+	stderr, err := ioutil.TempFile("", "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	originalStderr := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = originalStderr }()
+
+	const interval = 50 * time.Millisecond
+	handler := logger.StderrErrorHandler(interval)
+	for i := 0; i < 3; i++ {
+		handler(fmt.Errorf("test error"), []byte("entry"))
+	}
+	time.Sleep(interval)
+	handler(fmt.Errorf("test error"), []byte("entry"))
+
+	output, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 reports, got %v: %q", len(lines), lines)
+	}
+	if !strings.Contains(lines[1], "2 similar errors suppressed") {
+		t.Errorf("expected suppressed error count, got %q", lines[1])
+	}
+}
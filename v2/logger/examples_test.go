@@ -12,9 +12,10 @@ import (
 type fakeWriter struct{}
 
 // Write just replaces the timestamp internally assigned by the LogService
-// with a constant value so the tests remain deterministic.
+// with a constant value so the tests remain deterministic, whatever the local
+// time zone.
 func (fakeWriter) Write(message []byte) (int, error) {
-	re := regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.(\d{5}|\d{6})-\d{2}:\d{2}`)
+	re := regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
 	msg := re.ReplaceAllString(string(message), "2009-01-20T12:05:00.000000-04:00")
 	fmt.Println(msg)
 	return len(msg), nil
@@ -188,3 +189,63 @@ func ExampleLogContext_Write() {
 
 	// Output: {"timestamp":"2009-01-20T12:05:00.000000-04:00","environment":"test","system_name":"examples","service_name":"example runner","service_instance_id":"1","site":"ExampleLogContext","operation":"Write","level":"100","severity":"trace","msg":"Hello from the standard library logger!\n","details":""}
 }
+
+// Typed fields can be appended to any entry via the F log methods. Fields are
+// serialized after the details of the entry as native JSON values.
+func ExampleLogContext_InfoF() {
+	serviceContext := logger.ServiceContext{
+		Environment:       "test",
+		SystemName:        "examples",
+		ServiceName:       "example runner",
+		ServiceInstanceID: "1",
+	}
+
+	serviceOptions := logger.LogServiceOptions{
+		CancellationDeadline: 10 * time.Millisecond,
+	}
+
+	loggerSvc := logger.InitializeWriterWithOptions(new(fakeWriter), serviceContext, serviceOptions)
+
+	log := loggerSvc.NewContext("ExampleLogContext", "InfoF")
+
+	log.InfoF("Order placed.", "",
+		logger.Int64("user", 42),
+		logger.String("order", "abc"),
+		logger.Float64("total", 19.99),
+		logger.Bool("gift", false),
+		logger.Duration("elapsed", 1500*time.Millisecond),
+	)
+
+	loggerSvc.Finish()
+
+	// Output: {"timestamp":"2009-01-20T12:05:00.000000-04:00","environment":"test","system_name":"examples","service_name":"example runner","service_instance_id":"1","site":"ExampleLogContext","operation":"InfoF","level":"300","severity":"info","msg":"Order placed.","details":"","user":42,"order":"abc","total":19.99,"gift":false,"elapsed":1500000000}
+}
+
+// Child contexts created via With carry their fields on every entry they
+// write, which makes it simple to correlate all of the entries for a request.
+func ExampleLogContext_With() {
+	serviceContext := logger.ServiceContext{
+		Environment:       "test",
+		SystemName:        "examples",
+		ServiceName:       "example runner",
+		ServiceInstanceID: "1",
+	}
+
+	serviceOptions := logger.LogServiceOptions{
+		CancellationDeadline: 10 * time.Millisecond,
+	}
+
+	loggerSvc := logger.InitializeWriterWithOptions(new(fakeWriter), serviceContext, serviceOptions)
+
+	log := loggerSvc.NewContext("ExampleLogContext", "With")
+
+	requestLog := log.With(logger.String("request_id", "r-1"), logger.String("tenant_id", "t-1"))
+	requestLog.Info("Request received.")
+	requestLog.InfoF("Request handled.", "", logger.Int64("status", 200))
+
+	loggerSvc.Finish()
+
+	// Output:
+	// {"timestamp":"2009-01-20T12:05:00.000000-04:00","environment":"test","system_name":"examples","service_name":"example runner","service_instance_id":"1","site":"ExampleLogContext","operation":"With","level":"300","severity":"info","msg":"Request received.","details":"","request_id":"r-1","tenant_id":"t-1"}
+	// {"timestamp":"2009-01-20T12:05:00.000000-04:00","environment":"test","system_name":"examples","service_name":"example runner","service_instance_id":"1","site":"ExampleLogContext","operation":"With","level":"300","severity":"info","msg":"Request handled.","details":"","request_id":"r-1","tenant_id":"t-1","status":200}
+}
@@ -0,0 +1,12 @@
+package logger
+
+import (
+	"context"
+	"time"
+)
+
+// Retry exposes retry, through which the batching writers retry failed
+// batches, to the tests. maxRetries is interpreted as a MaxRetries option.
+func Retry(ctx context.Context, maxRetries int, retryable func(error) bool, attempt func() error) error {
+	return retry(ctx, retryLimit(maxRetries), newBackoff(time.Millisecond, time.Millisecond), retryable, attempt)
+}
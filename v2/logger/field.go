@@ -0,0 +1,72 @@
+package logger
+
+import (
+	"time"
+)
+
+type fieldKind uint8
+
+const (
+	fieldKindString fieldKind = iota + 1
+	fieldKindInt64
+	fieldKindFloat64
+	fieldKindBool
+	fieldKindDuration
+	fieldKindTime
+)
+
+// A Field is a typed key/value pair that is appended to a log entry (see the
+// F log methods, such as LogContext.InfoF).
+//
+// Fields are serialized after the details of an entry, in the order in which
+// they are supplied. Field keys and string values are always escaped, so
+// it is safe to supply values that contain reserved JSON characters.
+//
+// Fields are constructed via String, Int64, Float64, Bool, Duration, and Time,
+// none of which allocate.
+type Field struct {
+	key     string
+	kind    fieldKind
+	integer int64
+	float   float64
+	str     string
+	time    time.Time
+}
+
+// String constructs a Field with a string value.
+func String(key, value string) Field {
+	return Field{key: key, kind: fieldKindString, str: value}
+}
+
+// Int64 constructs a Field with an integer value.
+func Int64(key string, value int64) Field {
+	return Field{key: key, kind: fieldKindInt64, integer: value}
+}
+
+// Float64 constructs a Field with a floating point value. NaN and infinite
+// values are serialized as strings, since JSON has no representation for
+// them.
+func Float64(key string, value float64) Field {
+	return Field{key: key, kind: fieldKindFloat64, float: value}
+}
+
+// Bool constructs a Field with a boolean value.
+func Bool(key string, value bool) Field {
+	var integer int64
+	if value {
+		integer = 1
+	}
+	return Field{key: key, kind: fieldKindBool, integer: integer}
+}
+
+// Duration constructs a Field with a time.Duration value. Durations are
+// serialized as an integer number of nanoseconds.
+func Duration(key string, value time.Duration) Field {
+	return Field{key: key, kind: fieldKindDuration, integer: int64(value)}
+}
+
+// Time constructs a Field with a time.Time value. Times are serialized as
+// RFC3339Nano strings.
+func Time(key string, value time.Time) Field {
+	return Field{key: key, kind: fieldKindTime, time: value}
+}
@@ -0,0 +1,593 @@
+package logger
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// defaultFluentdTag is the tag with which entries are forwarded if no other
+// tag is specified.
+const defaultFluentdTag = "nobslogger"
+
+// fluentdRecordKeys is the number of keys that the Fluentd encoder writes to
+// every record, in addition to any fields.
+const fluentdRecordKeys = 11
+
+// errMalformedAck is returned when a Fluentd server's response can't be
+// decoded.
+var errMalformedAck = errors.New("nobslogger: malformed ack")
+
+// FluentdOptions exposes configuration settings for Fluentd Forward output.
+type FluentdOptions struct {
+	// Tag is the tag with which entries are forwarded. InitializeFluentd
+	// defaults the tag to the ServiceName; otherwise, it defaults to
+	// "nobslogger".
+	Tag string
+
+	// RequireAck requests an acknowledgement (via the chunk option) for each
+	// batch, and resends the batch if it is not acknowledged within
+	// AckTimeout. This provides at-least-once delivery.
+	RequireAck bool
+
+	// AckTimeout is the longest that an acknowledgement is awaited. Defaults
+	// to 10s.
+	AckTimeout time.Duration
+
+	// BatchSize is the most entries that are forwarded in a single message.
+	// Defaults to 512.
+	BatchSize int
+
+	// FlushInterval is the longest that an entry is held before it is
+	// forwarded. Defaults to 1s.
+	FlushInterval time.Duration
+
+	// MaxRetries limits the retries of each batch (see the package doc).
+	MaxRetries int
+
+	// MinBackoff is the delay before the first retry (see the package doc).
+	MinBackoff time.Duration
+
+	// MaxBackoff is the longest delay between retries (see the package doc).
+	MaxBackoff time.Duration
+
+	// DialTimeout bounds each connection attempt. Defaults to 10s.
+	DialTimeout time.Duration
+
+	// WriteTimeout bounds each write. Defaults to 10s.
+	WriteTimeout time.Duration
+
+	// Dial is used to establish connections. Defaults to a net.Dialer with
+	// the DialTimeout.
+	Dial func(network, address string) (net.Conn, error)
+
+	// ErrorHandler is passed each entry that can't be forwarded (see the package doc).
+	ErrorHandler ErrorHandler
+}
+
+// InitializeFluentd establishes a connection to a Fluentd (or Fluent Bit)
+// Forward input, and returns a LogService instance through which more
+// detailed logging contexts can be spawned (see NewContext).
+//
+// Each entry is forwarded as an event whose record holds the ServiceContext,
+// site, operation, level, severity, message, details, and any fields. Events
+// are tagged with the ServiceName, unless another tag is supplied (see
+// InitializeFluentdWithOptions).
+//
+// Entries are forwarded in batches. See FluentdWriter.
+//
+// An error is returned if hostURI is malformed.
+//
+// hostURI: Must be a fully qualified URI including port.
+func InitializeFluentd(hostURI string, serviceContext ServiceContext) (LogService, error) {
+	return InitializeFluentdWithOptions(hostURI, serviceContext, defaultLogServiceOptions(), FluentdOptions{})
+}
+
+// InitializeFluentdWithOptions is the same as InitializeFluentd, but with
+// custom LogServiceOptions and FluentdOptions supplied. The Framing and
+// Encoder options are ignored. See InitializeFluentd.
+func InitializeFluentdWithOptions(hostURI string, serviceContext ServiceContext, options LogServiceOptions, fluentdOptions FluentdOptions) (LogService, error) {
+	if fluentdOptions.Tag == "" {
+		fluentdOptions.Tag = serviceContext.ServiceName
+	}
+	if fluentdOptions.ErrorHandler == nil {
+		fluentdOptions.ErrorHandler = batchErrorHandler(options)
+	}
+	w, err := NewFluentdWriter(hostURI, fluentdOptions)
+	if err != nil {
+		return LogService{}, err
+	}
+	options.Framing = FramingNone
+	options.Encoder = NewFluentdEncoder()
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// fluentdEncoder encodes entries as Forward protocol events.
+type fluentdEncoder struct{}
+
+// NewFluentdEncoder returns an Encoder that encodes entries as Forward
+// protocol events; that is, msgpack encoded [time, record] arrays, as they
+// appear within a PackedForward message. The time is written as an EventTime,
+// so has nanosecond precision.
+//
+// Entries that are written by this encoder are only of use to a
+// FluentdWriter, which adds the tag and wraps them into messages.
+func NewFluentdEncoder() Encoder {
+	return fluentdEncoder{}
+}
+
+func (fluentdEncoder) begin(buffer []byte, r record) []byte {
+	buffer = appendMsgpackArrayHeader(buffer, 2)
+	buffer = appendMsgpackEventTime(buffer, r.unixNano())
+	buffer = appendMsgpackMapHeader(buffer, fluentdRecordKeys+r.fieldCount)
+	buffer = appendMsgpackString(buffer, "environment")
+	buffer = appendMsgpackEscapedString(buffer, r.sc.Environment)
+	buffer = appendMsgpackString(buffer, "system_name")
+	buffer = appendMsgpackEscapedString(buffer, r.sc.SystemName)
+	buffer = appendMsgpackString(buffer, "service_name")
+	buffer = appendMsgpackEscapedString(buffer, r.sc.ServiceName)
+	buffer = appendMsgpackString(buffer, "service_instance_id")
+	buffer = appendMsgpackEscapedString(buffer, r.sc.ServiceInstanceID)
+	buffer = appendMsgpackString(buffer, "site")
+	buffer = appendMsgpackEscapedString(buffer, r.site)
+	buffer = appendMsgpackString(buffer, "operation")
+	buffer = appendMsgpackEscapedString(buffer, r.operation)
+	buffer = appendMsgpackString(buffer, "level")
+	buffer = appendMsgpackString(buffer, string(r.detail.Level))
+	buffer = appendMsgpackString(buffer, "severity")
+	buffer = appendMsgpackString(buffer, string(r.detail.Severity))
+	if r.detail.escaped {
+		buffer = appendMsgpackString(buffer, "msg")
+		buffer = appendMsgpackEscapedString(buffer, r.detail.Message)
+		buffer = appendMsgpackString(buffer, "details")
+		return appendMsgpackEscapedString(buffer, r.detail.Details)
+	}
+	buffer = appendMsgpackString(buffer, "msg")
+	buffer = appendMsgpackString(buffer, r.detail.Message)
+	buffer = appendMsgpackString(buffer, "details")
+	return appendMsgpackString(buffer, r.detail.Details)
+}
+
+func (fluentdEncoder) field(buffer []byte, f Field) []byte {
+	buffer = appendMsgpackString(buffer, f.key)
+	switch f.kind {
+	case fieldKindString:
+		return appendMsgpackString(buffer, f.str)
+	case fieldKindInt64, fieldKindDuration:
+		return appendMsgpackInt(buffer, f.integer)
+	case fieldKindFloat64:
+		buffer = append(buffer, 0xcb)
+		return appendUint64(buffer, math.Float64bits(f.float))
+	case fieldKindBool:
+		return appendMsgpackBool(buffer, f.integer != 0)
+	case fieldKindTime:
+		var scratch [64]byte
+		timestamp := f.time.AppendFormat(scratch[:0], time.RFC3339Nano)
+		buffer = appendMsgpackStringHeader(buffer, len(timestamp))
+		return append(buffer, timestamp...)
+	default:
+		return append(buffer, 0xc0)
+	}
+}
+
+// end always writes the truncated key, so that the size of the record is
+// known in advance.
+func (fluentdEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	buffer = appendMsgpackString(buffer, "truncated")
+	return appendMsgpackBool(buffer, truncated)
+}
+
+// FluentdWriter is an io.WriteCloser that forwards entries to a Fluentd (or
+// Fluent Bit) Forward input over TCP. Entries must be encoded by the encoder
+// returned by NewFluentdEncoder.
+//
+// Entries are accumulated, and forwarded in batches of up to BatchSize
+// entries, at least every FlushInterval. A batch of one entry is sent in
+// Message mode ([tag, time, record]); larger batches are sent in
+// PackedForward mode. Batches are forwarded in the background, so Write
+// never waits for the connection (or for an acknowledgement); if the server
+// falls behind, and several full batches are already awaiting forwarding,
+// Write returns ErrBufferFull. The entries of batches that can't be forwarded
+// are passed to the ErrorHandler, and the error is returned by the next call
+// to Flush or Close.
+//
+// FluentdWriter connects when the first batch is sent. If a batch can't be
+// sent (or, if RequireAck is set, is not acknowledged), the connection is
+// re-established in the background, and the batch is resent, up to
+// MaxRetries times, after which it is discarded. A connection that is closed
+// by the server is detected, and replaced, before the next batch is sent.
+// Connecting, sending, awaiting acknowledgement, and backing off are all
+// abandoned if the context passed to CloseContext is done.
+type FluentdWriter struct {
+	hostURI string
+	options FluentdOptions
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+	batch   *batcher
+
+	// The following are only accessed while flushing, which the batcher
+	// serializes.
+	conn    net.Conn
+	closed  chan struct{}
+	reader  *bufio.Reader
+	message []byte
+}
+
+// NewFluentdWriter returns a FluentdWriter that forwards entries to the
+// specified host.
+//
+// hostURI: Must be a fully qualified URI including port.
+func NewFluentdWriter(hostURI string, options FluentdOptions) (*FluentdWriter, error) {
+	if _, _, err := net.SplitHostPort(hostURI); err != nil {
+		return nil, fmt.Errorf("nobslogger: invalid host %q: %v", hostURI, err)
+	}
+	if options.Tag == "" {
+		options.Tag = defaultFluentdTag
+	}
+	if options.AckTimeout <= 0 {
+		options.AckTimeout = 10 * time.Second
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	options.MaxRetries = retryLimit(options.MaxRetries)
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = 10 * time.Second
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = 10 * time.Second
+	}
+	w := &FluentdWriter{
+		hostURI: hostURI,
+		options: options,
+	}
+	if options.Dial == nil {
+		dialer := &net.Dialer{Timeout: options.DialTimeout}
+		w.dial = dialer.DialContext
+	} else {
+		w.dial = func(_ context.Context, network, address string) (net.Conn, error) {
+			return options.Dial(network, address)
+		}
+	}
+	w.batch = newBatcher(options.BatchSize, options.FlushInterval, w.forward, options.ErrorHandler)
+	return w, nil
+}
+
+// Write adds an entry to the current batch, forwarding the batch if it is
+// full.
+func (w *FluentdWriter) Write(p []byte) (int, error) {
+	return w.batch.Write(p)
+}
+
+// Flush forwards the current batch, if any.
+func (w *FluentdWriter) Flush() error {
+	return w.batch.Flush()
+}
+
+// Close forwards the current batch, if any, and closes the connection.
+// Writes after Close return ErrWriterClosed.
+func (w *FluentdWriter) Close() error {
+	return w.CloseContext(context.Background())
+}
+
+// CloseContext is the same as Close, but if ctx is done before the remaining
+// batches have been forwarded, they are discarded.
+func (w *FluentdWriter) CloseContext(ctx context.Context) error {
+	err := w.batch.CloseContext(ctx)
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// forward wraps a batch of entries into a single message, and sends it.
+func (w *FluentdWriter) forward(ctx context.Context, entries [][]byte) error {
+	var chunk string
+	if w.options.RequireAck {
+		var id [16]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id[:])
+	}
+
+	w.message = w.message[:0]
+	if len(entries) == 1 {
+		// Message mode; the [time, record] array is unwrapped, as its
+		// elements are part of the message itself.
+		if chunk == "" {
+			w.message = appendMsgpackArrayHeader(w.message, 3)
+		} else {
+			w.message = appendMsgpackArrayHeader(w.message, 4)
+		}
+		w.message = appendMsgpackString(w.message, w.options.Tag)
+		w.message = append(w.message, entries[0][1:]...)
+		if chunk != "" {
+			w.message = appendMsgpackMapHeader(w.message, 1)
+			w.message = appendMsgpackString(w.message, "chunk")
+			w.message = appendMsgpackString(w.message, chunk)
+		}
+	} else {
+		size := 0
+		for _, entry := range entries {
+			size += len(entry)
+		}
+		w.message = appendMsgpackArrayHeader(w.message, 3)
+		w.message = appendMsgpackString(w.message, w.options.Tag)
+		w.message = appendMsgpackBinHeader(w.message, size)
+		for _, entry := range entries {
+			w.message = append(w.message, entry...)
+		}
+		if chunk == "" {
+			w.message = appendMsgpackMapHeader(w.message, 1)
+		} else {
+			w.message = appendMsgpackMapHeader(w.message, 2)
+			w.message = appendMsgpackString(w.message, "chunk")
+			w.message = appendMsgpackString(w.message, chunk)
+		}
+		w.message = appendMsgpackString(w.message, "size")
+		w.message = appendMsgpackInt(w.message, int64(len(entries)))
+	}
+
+	backoff := newBackoff(w.options.MinBackoff, w.options.MaxBackoff)
+	return retry(ctx, w.options.MaxRetries, backoff, nil, func() error {
+		err := w.send(ctx, chunk)
+		if err != nil && w.conn != nil {
+			w.conn.Close()
+			w.conn = nil
+		}
+		return err
+	})
+}
+
+// send transmits the message, connecting first if necessary, and awaits the
+// acknowledgement of chunk (if any). If ctx is done, the attempt is
+// abandoned.
+func (w *FluentdWriter) send(ctx context.Context, chunk string) error {
+	if w.conn != nil {
+		select {
+		case <-w.closed:
+			w.conn.Close()
+			w.conn = nil
+		default:
+		}
+	}
+	if w.conn == nil {
+		conn, err := w.dial(ctx, "tcp", w.hostURI)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+		if w.options.RequireAck {
+			w.reader = bufio.NewReader(conn)
+		} else {
+			// Fluentd only responds to acknowledge chunks, so without
+			// them, the connection can be watched for closure.
+			w.closed = make(chan struct{})
+			go watchClosure(conn, w.closed)
+		}
+	}
+
+	// Expiring the deadlines interrupts a write or read that is in progress
+	// when ctx is done. ctx is checked after each deadline is set, in case
+	// the deadline replaced the expired one.
+	done := make(chan struct{})
+	defer close(done)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}(w.conn)
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.options.WriteTimeout))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := w.conn.Write(w.message); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+	w.conn.SetReadDeadline(time.Now().Add(w.options.AckTimeout))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ack, err := readFluentdAck(w.reader)
+	if err != nil {
+		return err
+	}
+	if ack != chunk {
+		return fmt.Errorf("nobslogger: unexpected ack %q for chunk %q", ack, chunk)
+	}
+	return nil
+}
+
+// watchClosure closes closed once conn can no longer be read; that is, once
+// the remote end has closed the connection (or conn has been closed).
+func watchClosure(conn net.Conn, closed chan struct{}) {
+	buffer := make([]byte, 512)
+	for {
+		if _, err := conn.Read(buffer); err != nil {
+			close(closed)
+			return
+		}
+	}
+}
+
+// readFluentdAck reads a response of the form {"ack": chunk}, and returns
+// the chunk.
+func readFluentdAck(r *bufio.Reader) (string, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if header&0xf0 != 0x80 {
+		return "", errMalformedAck
+	}
+	ack := ""
+	for i := 0; i < int(header&0x0f); i++ {
+		key, err := readMsgpackString(r)
+		if err != nil {
+			return "", err
+		}
+		value, err := readMsgpackString(r)
+		if err != nil {
+			return "", err
+		}
+		if key == "ack" {
+			ack = value
+		}
+	}
+	return ack, nil
+}
+
+// readMsgpackString reads a msgpack str (or bin).
+func readMsgpackString(r *bufio.Reader) (string, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	var length int
+	switch {
+	case header&0xe0 == 0xa0:
+		length = int(header & 0x1f)
+	case header == 0xc4 || header == 0xd9:
+		length, err = readBigEndian(r, 1)
+	case header == 0xc5 || header == 0xda:
+		length, err = readBigEndian(r, 2)
+	case header == 0xc6 || header == 0xdb:
+		length, err = readBigEndian(r, 4)
+	default:
+		return "", errMalformedAck
+	}
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func readBigEndian(r *bufio.Reader, size int) (int, error) {
+	n := 0
+	for i := 0; i < size; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
+
+func appendMsgpackArrayHeader(buffer []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buffer, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(buffer, 0xdc), uint16(n))
+	default:
+		return appendUint32(append(buffer, 0xdd), uint32(n))
+	}
+}
+
+func appendMsgpackMapHeader(buffer []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buffer, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(buffer, 0xde), uint16(n))
+	default:
+		return appendUint32(append(buffer, 0xdf), uint32(n))
+	}
+}
+
+func appendMsgpackStringHeader(buffer []byte, n int) []byte {
+	switch {
+	case n < 32:
+		return append(buffer, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		return append(buffer, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(buffer, 0xda), uint16(n))
+	default:
+		return appendUint32(append(buffer, 0xdb), uint32(n))
+	}
+}
+
+func appendMsgpackBinHeader(buffer []byte, n int) []byte {
+	switch {
+	case n <= math.MaxUint8:
+		return append(buffer, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(buffer, 0xc5), uint16(n))
+	default:
+		return appendUint32(append(buffer, 0xc6), uint32(n))
+	}
+}
+
+func appendMsgpackString(buffer []byte, s string) []byte {
+	buffer = appendMsgpackStringHeader(buffer, len(s))
+	return append(buffer, s...)
+}
+
+// appendMsgpackEscapedString appends a string that has been escaped for JSON
+// (see escape), unescaping it along the way.
+func appendMsgpackEscapedString(buffer []byte, s string) []byte {
+	buffer = appendMsgpackStringHeader(buffer, unescapedLength(s))
+	return appendUnescaped(buffer, s)
+}
+
+func appendMsgpackInt(buffer []byte, v int64) []byte {
+	if v >= -32 && v < 128 {
+		// positive and negative fixint
+		return append(buffer, byte(v))
+	}
+	return appendUint64(append(buffer, 0xd3), uint64(v))
+}
+
+func appendMsgpackBool(buffer []byte, v bool) []byte {
+	if v {
+		return append(buffer, 0xc3)
+	}
+	return append(buffer, 0xc2)
+}
+
+// appendMsgpackEventTime appends a Forward protocol EventTime; that is, a
+// fixext8 of type 0 holding big-endian seconds and nanoseconds.
+func appendMsgpackEventTime(buffer []byte, nanoseconds int64) []byte {
+	buffer = append(buffer, 0xd7, 0x00)
+	buffer = appendUint32(buffer, uint32(nanoseconds/int64(time.Second)))
+	return appendUint32(buffer, uint32(nanoseconds%int64(time.Second)))
+}
+
+func appendUint16(buffer []byte, v uint16) []byte {
+	return append(buffer, byte(v>>8), byte(v))
+}
+
+func appendUint32(buffer []byte, v uint32) []byte {
+	return append(buffer, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(buffer []byte, v uint64) []byte {
+	return append(buffer, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,462 @@
+package logger_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// eventTime is a decoded Forward protocol EventTime.
+type eventTime time.Time
+
+// decodeMsgpack decodes a single msgpack value. Maps are decoded as
+// map[string]interface{}, integers as int64, and str and bin as string.
+func decodeMsgpack(r *bufio.Reader) (interface{}, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readUint := func(size int) uint64 {
+		var n uint64
+		for i := 0; i < size; i++ {
+			c, _ := r.ReadByte()
+			n = n<<8 | uint64(c)
+		}
+		return n
+	}
+	readString := func(length int) (interface{}, error) {
+		s := make([]byte, length)
+		_, err := io.ReadFull(r, s)
+		return string(s), err
+	}
+	readArray := func(length int) (interface{}, error) {
+		array := []interface{}{}
+		for i := 0; i < length; i++ {
+			value, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	}
+	readMap := func(length int) (interface{}, error) {
+		m := map[string]interface{}{}
+		for i := 0; i < length; i++ {
+			key, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			m[key.(string)] = value
+		}
+		return m, nil
+	}
+	switch {
+	case header < 0x80:
+		return int64(header), nil
+	case header >= 0xe0:
+		return int64(int8(header)), nil
+	case header&0xf0 == 0x80:
+		return readMap(int(header & 0x0f))
+	case header&0xf0 == 0x90:
+		return readArray(int(header & 0x0f))
+	case header&0xe0 == 0xa0:
+		return readString(int(header & 0x1f))
+	}
+	switch header {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return readString(int(readUint(1)))
+	case 0xc5, 0xda:
+		return readString(int(readUint(2)))
+	case 0xc6, 0xdb:
+		return readString(int(readUint(4)))
+	case 0xcb:
+		return math.Float64frombits(readUint(8)), nil
+	case 0xd3:
+		return int64(readUint(8)), nil
+	case 0xd7:
+		if extType, _ := r.ReadByte(); extType != 0 {
+			return nil, fmt.Errorf("unexpected ext type %v", extType)
+		}
+		seconds := readUint(4)
+		nanoseconds := readUint(4)
+		return eventTime(time.Unix(int64(seconds), int64(nanoseconds))), nil
+	case 0xdc:
+		return readArray(int(readUint(2)))
+	case 0xde:
+		return readMap(int(readUint(2)))
+	}
+	return nil, fmt.Errorf("unexpected msgpack header %x", header)
+}
+
+// forwardMessage is a message received by a Forward server.
+type forwardMessage struct {
+	connection int
+	message    []interface{}
+}
+
+// acceptForward accepts connections on listener, and sends every message
+// received to the returned channel. If ack is true, chunks are acknowledged,
+// except on the first connection when dropFirst is true, which is closed
+// instead.
+func acceptForward(t *testing.T, listener net.Listener, ack, dropFirst bool) chan forwardMessage {
+	messages := make(chan forwardMessage, 16)
+	go func() {
+		for connection := 0; ; connection++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(connection int, conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					message, err := decodeMsgpack(reader)
+					if err != nil {
+						return
+					}
+					messages <- forwardMessage{connection, message.([]interface{})}
+					if dropFirst && connection == 0 {
+						return
+					}
+					if !ack {
+						continue
+					}
+					option := message.([]interface{})[len(message.([]interface{}))-1].(map[string]interface{})
+					chunk := option["chunk"].(string)
+					response := append([]byte{0x81, 0xa3}, "ack"...)
+					response = append(response, 0xa0|byte(len(chunk)))
+					response = append(response, chunk...)
+					conn.Write(response)
+				}
+			}(connection, conn)
+		}
+	}()
+	return messages
+}
+
+func receiveForward(t *testing.T, messages chan forwardMessage) forwardMessage {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return forwardMessage{}
+	}
+}
+
+func checkForwardRecord(t *testing.T, record map[string]interface{}, expected map[string]interface{}) {
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("expected %v to be %v, got %v", key, value, record[key])
+		}
+	}
+}
+
+func Test_FluentdMessageMode(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+	messages := acceptForward(t, listener, false, false)
+
+	loggerService, err := logger.InitializeFluentdWithOptions(listener.Addr().String(), syslogServiceContext, logger.LogServiceOptions{}, logger.FluentdOptions{
+		BatchSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("context \"site\"", "operation")
+	log = log.With(logger.String("request", "abc"))
+	log.InfoF("message", "details", logger.Int64("user", 1000), logger.Float64("ratio", 0.5), logger.Bool("retry", true))
+
+	message := receiveForward(t, messages).message
+	if len(message) != 3 {
+		t.Fatalf("expected [tag, time, record], got %v", message)
+	}
+	if tag := message[0]; tag != "billing" {
+		t.Errorf("expected tag billing, got %v", tag)
+	}
+	timestamp, ok := message[1].(eventTime)
+	if age := time.Since(time.Time(timestamp)); !ok || age < -time.Second || age > time.Minute {
+		t.Errorf("unexpected time: %v", message[1])
+	}
+	checkForwardRecord(t, message[2].(map[string]interface{}), map[string]interface{}{
+		"environment":         "test",
+		"system_name":         "system",
+		"service_name":        "billing",
+		"service_instance_id": "instance-1",
+		"site":                "context \"site\"",
+		"operation":           "operation",
+		"level":               "300",
+		"severity":            "info",
+		"msg":                 "message",
+		"details":             "details",
+		"request":             "abc",
+		"user":                int64(1000),
+		"ratio":               0.5,
+		"retry":               true,
+		"truncated":           false,
+	})
+}
+
+// Messages and details escaped by the J methods must be unescaped, like every
+// other string in the record.
+func Test_FluentdUnescapesJ(t *testing.T) {
+	var entry []byte
+	writer := writerFunc(func(bb []byte) (int, error) {
+		entry = append(entry[:0], bb...)
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewFluentdEncoder(),
+	})
+	log := loggerService.NewContext("site", "operation")
+	log.InfoJ("say \"hi\"\n", "C:\\temp\t")
+
+	decoded, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(entry)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkForwardRecord(t, decoded.([]interface{})[1].(map[string]interface{}), map[string]interface{}{
+		"msg":     "say \"hi\"\n",
+		"details": "C:\\temp\t",
+	})
+}
+
+func Test_FluentdPackedForwardAck(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+	messages := acceptForward(t, listener, true, true)
+
+	w, err := logger.NewFluentdWriter(listener.Addr().String(), logger.FluentdOptions{
+		Tag:        "app",
+		RequireAck: true,
+		BatchSize:  2,
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loggerService := logger.InitializeWriterWithOptions(w, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewFluentdEncoder(),
+	})
+	log := loggerService.NewContext("site", "operation")
+	log.Info("first")
+	log.Warn("second")
+
+	// The first connection is dropped without an ack, so the chunk is resent
+	// on a second connection.
+	first := receiveForward(t, messages)
+	second := receiveForward(t, messages)
+	if first.connection != 0 || second.connection != 1 {
+		t.Errorf("expected the chunk to be resent on a new connection, got %v and %v", first.connection, second.connection)
+	}
+	if !reflect.DeepEqual(first.message, second.message) {
+		t.Errorf("expected the same chunk to be resent, got %v and %v", first.message, second.message)
+	}
+
+	message := second.message
+	if len(message) != 3 || message[0] != "app" {
+		t.Fatalf("expected [tag, entries, option], got %v", message)
+	}
+	option := message[2].(map[string]interface{})
+	if option["size"] != int64(2) || option["chunk"] == "" {
+		t.Errorf("unexpected option: %v", option)
+	}
+	reader := bufio.NewReader(bytes.NewReader([]byte(message[1].(string))))
+	for _, expected := range []string{"first", "second"} {
+		entry, err := decodeMsgpack(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkForwardRecord(t, entry.([]interface{})[1].(map[string]interface{}), map[string]interface{}{"msg": expected})
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Awaiting an acknowledgement (and resending a batch that isn't
+// acknowledged) must not block logging.
+func Test_FluentdAckDoesNotBlockLogging(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+	messages := acceptForward(t, listener, false, false)
+
+	loggerService, err := logger.InitializeFluentdWithOptions(listener.Addr().String(), syslogServiceContext, logger.LogServiceOptions{}, logger.FluentdOptions{
+		RequireAck: true,
+		AckTimeout: time.Second,
+		BatchSize:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	start := time.Now()
+	log.Info("first")
+	receiveForward(t, messages)
+	log.Info("second")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected logging to continue while awaiting an ack, took %v", elapsed)
+	}
+}
+
+func Test_FluentdReconnect(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+	messages := acceptForward(t, listener, false, true)
+
+	loggerService, err := logger.InitializeFluentdWithOptions(listener.Addr().String(), syslogServiceContext, logger.LogServiceOptions{}, logger.FluentdOptions{
+		BatchSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	log.Info("first")
+	if message := receiveForward(t, messages); message.connection != 0 {
+		t.Fatalf("expected the first connection, got %v", message.connection)
+	}
+
+	// The server closes the first connection once it has received an entry,
+	// after which entries should arrive on a new connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		log.Info("next")
+		select {
+		case message := <-messages:
+			if message.connection == 1 {
+				return
+			}
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("timed out waiting for reconnection")
+}
+
+// MaxRetries must be passed through to the retry helper (see Test_Retry).
+func Test_FluentdMaxRetries(t *testing.T) {
+	var dials int32
+	w, err := logger.NewFluentdWriter("127.0.0.1:1", logger.FluentdOptions{
+		MaxRetries: 1,
+		MinBackoff: time.Millisecond,
+		Dial: func(network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nil, errors.New("refused")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte{0x92, 0x00, 0x80})
+	if err := w.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+	if actual := atomic.LoadInt32(&dials); actual != 2 {
+		t.Errorf("expected 2 attempts, got %v", actual)
+	}
+}
+
+// CloseContext must abandon backing off between attempts, and awaiting an
+// acknowledgement, once its context is done.
+func Test_FluentdCloseContext(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+	acceptForward(t, listener, false, false)
+
+	testCases := []struct {
+		name    string
+		options logger.FluentdOptions
+	}{
+		{"backoff", logger.FluentdOptions{
+			MinBackoff: time.Minute,
+			MaxBackoff: time.Minute,
+			Dial: func(network, address string) (net.Conn, error) {
+				return nil, errors.New("refused")
+			},
+		}},
+		{"ack", logger.FluentdOptions{
+			RequireAck: true,
+			AckTimeout: time.Minute,
+		}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			w, err := logger.NewFluentdWriter(listener.Addr().String(), testCase.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte{0x92, 0x00, 0x80})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if err := w.CloseContext(ctx); err == nil {
+				t.Error("expected an error")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected CloseContext to return promptly, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func Test_FluentdMalformedHost(t *testing.T) {
+	if _, err := logger.InitializeFluentd("localhost", syslogServiceContext); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func Test_FluentdEncoderLargeRecord(t *testing.T) {
+	var entry []byte
+	writer := writerFunc(func(bb []byte) (int, error) {
+		entry = append(entry[:0], bb...)
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewFluentdEncoder(),
+	})
+	log := loggerService.NewContext("site", "operation")
+	fields := []logger.Field{}
+	for i := 0; i < 20; i++ {
+		fields = append(fields, logger.Int64(fmt.Sprint("field", i), int64(-i*1000)))
+	}
+	log.InfoF(string(bytes.Repeat([]byte("x"), 300)), "", fields...)
+
+	decoded, err := decodeMsgpack(bufio.NewReader(bytes.NewReader(entry)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := decoded.([]interface{})[1].(map[string]interface{})
+	if len(record) != 31 || record["field19"] != int64(-19000) || len(record["msg"].(string)) != 300 {
+		t.Errorf("unexpected record: %v", record)
+	}
+	if entry[11] != 0xde || binary.BigEndian.Uint16(entry[12:14]) != 31 {
+		t.Errorf("expected a map16 header for 31 keys")
+	}
+}
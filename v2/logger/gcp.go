@@ -0,0 +1,169 @@
+package logger
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// GCPOptions exposes configuration settings for Google Cloud Logging output.
+type GCPOptions struct {
+	// SourceLocation determines whether the file, line, and function from
+	// which each entry was logged are recorded. Determining the source
+	// location requires walking the stack, which costs roughly a microsecond
+	// and an allocation per entry.
+	SourceLocation bool
+}
+
+// gcpEncoder encodes entries as structured JSON for Google Cloud Logging.
+type gcpEncoder struct {
+	sourceLocation bool
+}
+
+// NewGCPEncoder returns an Encoder that encodes entries in the structured JSON
+// format recognised by Google Cloud Logging (i.e. when written to stdout on
+// GKE or Cloud Run).
+//
+// The entry's severity is mapped to a Cloud Logging severity, and the
+// message and timestamp are written to message and time. The ServiceContext
+// is written as labels (logging.googleapis.com/labels), and the site,
+// operation, level, details, and any fields are written to the JSON payload.
+//
+// To link entries to a trace, attach the fields returned by CloudTrace and
+// CloudSpanID (i.e. via LogContext.With).
+//
+// A line based Framing (such as FramingNewline) should be used with this
+// encoder.
+func NewGCPEncoder(options GCPOptions) Encoder {
+	return &gcpEncoder{
+		sourceLocation: options.SourceLocation,
+	}
+}
+
+// CloudTrace returns a Field that links an entry to a Cloud Trace trace when
+// written with the GCP encoder (see NewGCPEncoder).
+func CloudTrace(projectID, traceID string) Field {
+	return String("logging.googleapis.com/trace", "projects/"+projectID+"/traces/"+traceID)
+}
+
+// CloudSpanID returns a Field that links an entry to a span within a Cloud
+// Trace trace when written with the GCP encoder (see NewGCPEncoder).
+func CloudSpanID(spanID string) Field {
+	return String("logging.googleapis.com/spanId", spanID)
+}
+
+func (e *gcpEncoder) begin(buffer []byte, r record) []byte {
+	buffer = append(buffer, `{"severity":"`...)
+	buffer = append(buffer, gcpSeverity(r.detail)...)
+	buffer = append(buffer, `","message":"`...)
+	buffer = append(buffer, r.detail.Message...)
+	buffer = append(buffer, `","time":"`...)
+	buffer = append(buffer, r.timestamp...)
+	buffer = append(buffer, `","logging.googleapis.com/labels":{"environment":"`...)
+	buffer = append(buffer, r.sc.Environment...)
+	buffer = append(buffer, `","system_name":"`...)
+	buffer = append(buffer, r.sc.SystemName...)
+	buffer = append(buffer, `","service_name":"`...)
+	buffer = append(buffer, r.sc.ServiceName...)
+	buffer = append(buffer, `","service_instance_id":"`...)
+	buffer = append(buffer, r.sc.ServiceInstanceID...)
+	buffer = append(buffer, `"}`...)
+	if r.source.file != "" {
+		buffer = append(buffer, `,"logging.googleapis.com/sourceLocation":{"file":"`...)
+		buffer = serializeEscaped(buffer, r.source.file)
+		buffer = append(buffer, `","line":"`...)
+		buffer = strconv.AppendInt(buffer, int64(r.source.line), 10)
+		buffer = append(buffer, `","function":"`...)
+		buffer = serializeEscaped(buffer, r.source.function)
+		buffer = append(buffer, `"}`...)
+	}
+	buffer = append(buffer, `,"site":"`...)
+	buffer = append(buffer, r.site...)
+	buffer = append(buffer, `","operation":"`...)
+	buffer = append(buffer, r.operation...)
+	buffer = append(buffer, `","level":"`...)
+	buffer = append(buffer, r.detail.Level...)
+	buffer = append(buffer, `","details":"`...)
+	buffer = append(buffer, r.detail.Details...)
+	buffer = append(buffer, '"')
+	return buffer
+}
+
+func (e *gcpEncoder) field(buffer []byte, f Field) []byte {
+	return serializeField(buffer, &f)
+}
+
+func (e *gcpEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, truncatedToken...)
+	}
+	return append(buffer, braceCloseToken...)
+}
+
+// gcpSeverity maps an entry's severity onto the Cloud Logging severities.
+// There is no Cloud Logging equivalent for trace, so trace entries are
+// written as debug.
+func gcpSeverity(ld LogDetail) string {
+	switch ld.Severity {
+	case LogSeverityTrace, LogSeverityDebug:
+		return "DEBUG"
+	case LogSeverityInfo:
+		return "INFO"
+	case LogSeverityWarn:
+		return "WARNING"
+	case LogSeverityError:
+		return "ERROR"
+	case LogSeverityFatal:
+		return "CRITICAL"
+	}
+	switch rank := ld.Level.rank(); {
+	case rank >= LogLevelFatal.rank():
+		return "CRITICAL"
+	case rank >= LogLevelError.rank():
+		return "ERROR"
+	case rank >= LogLevelWarn.rank():
+		return "WARNING"
+	case rank >= LogLevelInfo.rank():
+		return "INFO"
+	case rank > 0:
+		return "DEBUG"
+	default:
+		return "DEFAULT"
+	}
+}
+
+// packagePrefix is the prefix of the names of all functions in this package.
+var packagePrefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	slash := strings.LastIndex(name, "/")
+	return name[:slash+strings.Index(name[slash:], ".")+1]
+}()
+
+// sourceLocation is the location from which an entry was logged.
+type sourceLocation struct {
+	file     string
+	function string
+	line     int
+}
+
+func (e *gcpEncoder) locatesSource() bool {
+	return e.sourceLocation
+}
+
+// callerLocation returns the location of the first caller outside of this
+// package.
+func callerLocation() sourceLocation {
+	var pcs [32]uintptr
+	n := runtime.Callers(2, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, packagePrefix) {
+			return sourceLocation{file: frame.File, function: frame.Function, line: frame.Line}
+		}
+		if !more {
+			return sourceLocation{}
+		}
+	}
+}
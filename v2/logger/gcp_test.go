@@ -0,0 +1,137 @@
+package logger_test
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func Test_GCPEncoder(t *testing.T) {
+	writer, entry := entryWriter(t)
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewGCPEncoder(logger.GCPOptions{}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log = log.With(logger.CloudTrace("project", "0123456789abcdef"), logger.CloudSpanID("0000000000000001"))
+	log.InfoF("message", "details", logger.Int64("user", 42))
+
+	expected := map[string]interface{}{
+		"severity": "INFO",
+		"message":  "message",
+		"logging.googleapis.com/labels": map[string]interface{}{
+			"environment":         "test",
+			"system_name":         "system",
+			"service_name":        "billing",
+			"service_instance_id": "instance-1",
+		},
+		"logging.googleapis.com/trace":  "projects/project/traces/0123456789abcdef",
+		"logging.googleapis.com/spanId": "0000000000000001",
+		"site":                          "context site",
+		"operation":                     "operation",
+		"level":                         "300",
+		"details":                       "details",
+		"user":                          float64(42),
+	}
+	for key, value := range expected {
+		if !reflect.DeepEqual(entry()[key], value) {
+			t.Errorf("expected %v to be %v, got %v", key, value, entry()[key])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry()["time"].(string)); err != nil {
+		t.Errorf("unexpected time: %v", err)
+	}
+	if _, ok := entry()["logging.googleapis.com/sourceLocation"]; ok {
+		t.Error("expected no source location")
+	}
+}
+
+func Test_GCPEncoderSeverities(t *testing.T) {
+	writer, entry := entryWriter(t)
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewGCPEncoder(logger.GCPOptions{}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	testCases := []struct {
+		write    func(string)
+		severity string
+	}{
+		{log.Trace, "DEBUG"},
+		{log.Debug, "DEBUG"},
+		{log.Info, "INFO"},
+		{log.Warn, "WARNING"},
+		{log.Error, "ERROR"},
+		{log.Fatal, "CRITICAL"},
+	}
+	for _, testCase := range testCases {
+		testCase.write("message")
+		if entry()["severity"] != testCase.severity {
+			t.Errorf("expected severity %v, got %v", testCase.severity, entry()["severity"])
+		}
+	}
+}
+
+func Test_GCPEncoderSourceLocation(t *testing.T) {
+	writer, entry := entryWriter(t)
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		Encoder: logger.NewGCPEncoder(logger.GCPOptions{SourceLocation: true}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("message")
+
+	location, ok := entry()["logging.googleapis.com/sourceLocation"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a source location: %v", entry())
+	}
+	if file, _ := location["file"].(string); !strings.HasSuffix(file, "gcp_test.go") {
+		t.Errorf("expected file to be gcp_test.go, got %v", location["file"])
+	}
+	if function, _ := location["function"].(string); !strings.HasSuffix(function, "Test_GCPEncoderSourceLocation") {
+		t.Errorf("expected function to be Test_GCPEncoderSourceLocation, got %v", location["function"])
+	}
+	if line, _ := location["line"].(string); line == "" || line == "0" {
+		t.Errorf("expected a line number, got %v", location["line"])
+	}
+}
+
+// The source location must survive truncation, which encodes the entry more
+// than once.
+func Test_GCPEncoderSourceLocationTruncated(t *testing.T) {
+	writer, entry := entryWriter(t)
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		MaxEntrySize: 500,
+		Encoder:      logger.NewGCPEncoder(logger.GCPOptions{SourceLocation: true}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoD("message", strings.Repeat("d", 1000))
+
+	location, ok := entry()["logging.googleapis.com/sourceLocation"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a source location: %v", entry())
+	}
+	if function, _ := location["function"].(string); !strings.HasSuffix(function, "Test_GCPEncoderSourceLocationTruncated") {
+		t.Errorf("expected function to be Test_GCPEncoderSourceLocationTruncated, got %v", location["function"])
+	}
+	if entry()["truncated"] != true {
+		t.Errorf("expected entry to be marked as truncated: %v", entry())
+	}
+}
+
+func Test_GCPEncoderZeroAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewGCPEncoder(logger.GCPOptions{}),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	allocs := testing.AllocsPerRun(100, func() {
+		log.InfoF("message", "details", logger.Int64("user", 42))
+	})
+	if allocs != 0 {
+		t.Errorf("expected 0 allocations, got %v", allocs)
+	}
+}
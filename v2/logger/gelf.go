@@ -0,0 +1,305 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GELFCompression defines how GELF messages are compressed before they are
+// transmitted.
+type GELFCompression int
+
+// GELFCompression constants.
+const (
+	GELFCompressionNone GELFCompression = iota
+	GELFCompressionGzip
+	GELFCompressionZlib
+)
+
+const (
+	// defaultGELFChunkSize is the largest datagram that is sent by default.
+	// This is the size that Graylog recommends for networks whose MTU is not
+	// known.
+	defaultGELFChunkSize = 1420
+
+	// gelfChunkHeaderSize is the size of the header that precedes each chunk;
+	// two magic bytes, an 8-byte message ID, a sequence number, and a sequence
+	// count.
+	gelfChunkHeaderSize = 12
+
+	// maxGELFChunks is the most chunks that a message may be split into.
+	maxGELFChunks = 128
+)
+
+// ErrMessageTooLarge is returned by a GELFWriter when a message can't be sent
+// within the maximum number of chunks.
+var ErrMessageTooLarge = errors.New("nobslogger: message too large")
+
+// GELFOptions exposes configuration settings for GELF output.
+type GELFOptions struct {
+	// Hostname is written to the host field of each message. Defaults to the
+	// name reported by os.Hostname.
+	Hostname string
+
+	// ChunkSize is the largest datagram that is sent, including the chunk
+	// header. Messages that exceed this size are split into chunks. Defaults
+	// to 1420 bytes.
+	ChunkSize int
+
+	// Compression determines how messages are compressed. The default is
+	// GELFCompressionNone.
+	Compression GELFCompression
+}
+
+// InitializeGELF establishes a connection to a Graylog GELF UDP input, and
+// returns a LogService instance through which more detailed logging contexts
+// can be spawned (see NewContext).
+//
+// Each entry is written as a GELF message. The message is written to
+// short_message, the details are written to full_message, and the entry's
+// severity is mapped to a syslog level. The ServiceContext, site, operation,
+// severity, and any fields are written as additional fields (prefixed with an
+// underscore).
+//
+// Unlike InitializeUDP, messages that are larger than the chunk size are split
+// into GELF chunks, which are reassembled by Graylog. See GELFWriter.
+//
+// Since chunking lets messages exceed the size of a single datagram, the
+// MaxEntrySize defaults to the largest message that can be sent uncompressed
+// in 128 chunks; 180,224 bytes for the default ChunkSize.
+//
+// An error is returned if hostURI is malformed.
+//
+// hostURI: Must be a fully qualified URI including port.
+func InitializeGELF(hostURI string, serviceContext ServiceContext) (LogService, error) {
+	options := defaultLogServiceOptions()
+	options.MaxEntrySize = 0
+	return InitializeGELFWithOptions(hostURI, serviceContext, options, GELFOptions{})
+}
+
+// InitializeGELFWithOptions is the same as InitializeGELF, but with custom
+// LogServiceOptions and GELFOptions supplied. The Framing and Encoder options
+// are ignored, and if MaxEntrySize is not set, it defaults as described for
+// InitializeGELF. See InitializeGELF.
+func InitializeGELFWithOptions(hostURI string, serviceContext ServiceContext, options LogServiceOptions, gelfOptions GELFOptions) (LogService, error) {
+	udpWriter, err := NewUDPWriter(hostURI, UDPWriterOptions{
+		ResolveInterval: defaultResolveInterval,
+	})
+	if err != nil {
+		return LogService{}, err
+	}
+	options.Framing = FramingNone
+	w := NewGELFWriter(udpWriter, gelfOptions)
+	if options.MaxEntrySize <= 0 {
+		options.MaxEntrySize = maxGELFChunks * (w.options.ChunkSize - gelfChunkHeaderSize)
+	}
+	options.Encoder = NewGELFEncoder(gelfOptions)
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// gelfEncoder encodes entries as GELF (version 1.1) messages.
+type gelfEncoder struct {
+	host string
+}
+
+// NewGELFEncoder returns an Encoder that encodes entries as GELF messages (see
+// InitializeGELF). Only the Hostname option is used. NewGELFEncoder can be used
+// to write GELF messages to other writers; for instance, to a TCPWriter with
+// FramingNUL.
+func NewGELFEncoder(options GELFOptions) Encoder {
+	if options.Hostname == "" {
+		options.Hostname, _ = os.Hostname()
+	}
+	return &gelfEncoder{
+		host: string(serializeEscaped(nil, options.Hostname)),
+	}
+}
+
+func (e *gelfEncoder) begin(buffer []byte, r record) []byte {
+	buffer = append(buffer, `{"version":"1.1","host":"`...)
+	buffer = append(buffer, e.host...)
+	buffer = append(buffer, `","short_message":"`...)
+	if r.detail.Message == "" {
+		// GELF requires a short_message.
+		buffer = append(buffer, '-')
+	} else {
+		buffer = append(buffer, r.detail.Message...)
+	}
+	if r.detail.Details != "" {
+		buffer = append(buffer, `","full_message":"`...)
+		buffer = append(buffer, r.detail.Details...)
+	}
+	buffer = append(buffer, `","timestamp":`...)
+	nanoseconds := r.unixNano()
+	buffer = strconv.AppendInt(buffer, nanoseconds/int64(time.Second), 10)
+	buffer = append(buffer, '.')
+	microseconds := nanoseconds % int64(time.Second) / int64(time.Microsecond)
+	for scale := int64(100000); scale > 0; scale /= 10 {
+		buffer = append(buffer, byte('0'+microseconds/scale%10))
+	}
+	buffer = append(buffer, `,"level":`...)
+	buffer = strconv.AppendInt(buffer, int64(syslogSeverity(r.detail)), 10)
+	buffer = append(buffer, `,"_environment":"`...)
+	buffer = append(buffer, r.sc.Environment...)
+	buffer = append(buffer, `","_system_name":"`...)
+	buffer = append(buffer, r.sc.SystemName...)
+	buffer = append(buffer, `","_service_name":"`...)
+	buffer = append(buffer, r.sc.ServiceName...)
+	buffer = append(buffer, `","_service_instance_id":"`...)
+	buffer = append(buffer, r.sc.ServiceInstanceID...)
+	buffer = append(buffer, `","_site":"`...)
+	buffer = append(buffer, r.site...)
+	buffer = append(buffer, `","_operation":"`...)
+	buffer = append(buffer, r.operation...)
+	buffer = append(buffer, `","_severity":"`...)
+	buffer = append(buffer, r.detail.Severity...)
+	buffer = append(buffer, '"')
+	return buffer
+}
+
+// field appends a field as an additional field. GELF only permits letters,
+// digits, underscores, dashes, and dots in field names, so any other
+// characters are replaced with underscores. Note that Graylog ignores the
+// additional field "_id".
+func (e *gelfEncoder) field(buffer []byte, f Field) []byte {
+	buffer = append(buffer, `,"_`...)
+	for i := 0; i < len(f.key); i++ {
+		switch c := f.key[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+			buffer = append(buffer, c)
+		default:
+			buffer = append(buffer, '_')
+		}
+	}
+	buffer = append(buffer, fieldKeyCloseToken...)
+	return serializeFieldValue(buffer, &f)
+}
+
+func (e *gelfEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, `,"_truncated":true`...)
+	}
+	return append(buffer, braceCloseToken...)
+}
+
+// GELFWriter is an io.WriteCloser that transmits GELF messages via an
+// underlying datagram writer (such as a UDPWriter), compressing them, and
+// splitting them into chunks, as necessary.
+//
+// Each call to Write is treated as a single message.
+type GELFWriter struct {
+	w       io.Writer
+	options GELFOptions
+
+	mu         sync.Mutex
+	compressed bytes.Buffer
+	gzip       *gzip.Writer
+	zlib       *zlib.Writer
+	chunk      []byte
+	random     *rand.Rand
+}
+
+// NewGELFWriter returns a GELFWriter that transmits messages via w. Each
+// datagram is passed to w in a separate call to Write. Options other than
+// ChunkSize and Compression are ignored.
+func NewGELFWriter(w io.Writer, options GELFOptions) *GELFWriter {
+	if options.ChunkSize <= gelfChunkHeaderSize {
+		options.ChunkSize = defaultGELFChunkSize
+	}
+	return &GELFWriter{
+		w:       w,
+		options: options,
+		chunk:   make([]byte, 0, options.ChunkSize),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Write compresses p (if configured), and transmits it in one datagram, or
+// in as many chunks as needed. ErrMessageTooLarge is returned if p would
+// require more than 128 chunks.
+func (w *GELFWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	message, err := w.compress(p)
+	if err != nil {
+		return 0, err
+	}
+	if len(message) <= w.options.ChunkSize {
+		if _, err := w.w.Write(message); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	dataSize := w.options.ChunkSize - gelfChunkHeaderSize
+	count := (len(message) + dataSize - 1) / dataSize
+	if count > maxGELFChunks {
+		return 0, ErrMessageTooLarge
+	}
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], w.random.Uint64())
+	for sequence := 0; sequence < count; sequence++ {
+		data := message[sequence*dataSize:]
+		if len(data) > dataSize {
+			data = data[:dataSize]
+		}
+		w.chunk = append(w.chunk[:0], 0x1e, 0x0f)
+		w.chunk = append(w.chunk, id[:]...)
+		w.chunk = append(w.chunk, byte(sequence), byte(count))
+		w.chunk = append(w.chunk, data...)
+		if _, err := w.w.Write(w.chunk); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// compress returns p compressed according to the options. The result is only
+// valid until the next call to compress.
+func (w *GELFWriter) compress(p []byte) ([]byte, error) {
+	var compressor interface {
+		io.WriteCloser
+		Reset(io.Writer)
+	}
+	switch w.options.Compression {
+	case GELFCompressionGzip:
+		if w.gzip == nil {
+			w.gzip = gzip.NewWriter(nil)
+		}
+		compressor = w.gzip
+	case GELFCompressionZlib:
+		if w.zlib == nil {
+			w.zlib = zlib.NewWriter(nil)
+		}
+		compressor = w.zlib
+	default:
+		return p, nil
+	}
+	w.compressed.Reset()
+	compressor.Reset(&w.compressed)
+	if _, err := compressor.Write(p); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	return w.compressed.Bytes(), nil
+}
+
+// Close closes the underlying writer, if it is an io.Closer.
+func (w *GELFWriter) Close() error {
+	if closer, ok := w.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
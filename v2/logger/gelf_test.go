@@ -0,0 +1,209 @@
+package logger_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func decodeGELF(t *testing.T, message []byte) map[string]interface{} {
+	t.Helper()
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(message, &entry); err != nil {
+		t.Fatalf("Error: %v\nJSON: %s", err, message)
+	}
+	return entry
+}
+
+func Test_GELFMessage(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeGELFWithOptions(listener.LocalAddr().String(), syslogServiceContext,
+		logger.LogServiceOptions{}, logger.GELFOptions{Hostname: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoF("message", "details", logger.Int64("user", 42), logger.String("not valid", "value"))
+
+	entry := decodeGELF(t, []byte(receiveUDP(t, listener)))
+	expected := map[string]interface{}{
+		"version":              "1.1",
+		"host":                 "host",
+		"short_message":        "message",
+		"full_message":         "details",
+		"level":                float64(6),
+		"_environment":         "test",
+		"_system_name":         "system",
+		"_service_name":        "billing",
+		"_service_instance_id": "instance-1",
+		"_site":                "context site",
+		"_operation":           "operation",
+		"_severity":            "info",
+		"_user":                float64(42),
+		"_not_valid":           "value",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("expected %v to be %v, got %v", key, value, entry[key])
+		}
+	}
+	timestamp, _ := entry["timestamp"].(float64)
+	if age := time.Since(time.Unix(0, int64(timestamp*float64(time.Second)))); age < -time.Second || age > time.Minute {
+		t.Errorf("unexpected timestamp %v", entry["timestamp"])
+	}
+}
+
+// Messages larger than the chunk size must be split into chunks that can be
+// reassembled into the original message.
+func Test_GELFChunking(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeGELFWithOptions(listener.LocalAddr().String(), syslogServiceContext,
+		logger.LogServiceOptions{}, logger.GELFOptions{ChunkSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	details := make([]byte, 20*1024)
+	for i := range details {
+		details[i] = byte('a' + rand.Intn(26))
+	}
+	log.ErrorD("stack trace", string(details))
+
+	entry := decodeGELF(t, receiveGELFChunks(t, listener, 1000))
+	if entry["full_message"] != string(details) {
+		t.Error("expected details to be reassembled intact")
+	}
+}
+
+// With the default options, entries larger than 64 KiB must not be truncated,
+// as GELF chunking can transmit them.
+func Test_GELFLargeMessage(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeGELF(listener.LocalAddr().String(), syslogServiceContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	details := make([]byte, 100*1024)
+	for i := range details {
+		details[i] = byte('a' + rand.Intn(26))
+	}
+	log.ErrorD("stack trace", string(details))
+
+	entry := decodeGELF(t, receiveGELFChunks(t, listener, 1420))
+	if _, ok := entry["_truncated"]; ok {
+		t.Error("expected entry not to be marked as truncated")
+	}
+	if entry["full_message"] != string(details) {
+		t.Error("expected details to be reassembled intact")
+	}
+}
+
+// receiveGELFChunks receives the chunks of a single GELF message, checking
+// that they are no larger than chunkSize, and returns the reassembled
+// message.
+func receiveGELFChunks(t *testing.T, listener *net.UDPConn, chunkSize int) []byte {
+	t.Helper()
+	var id []byte
+	var chunks [][]byte
+	for count := 1; len(chunks) < count; {
+		datagram := []byte(receiveUDP(t, listener))
+		if len(datagram) > chunkSize {
+			t.Fatalf("expected datagrams of at most %v bytes, got %v", chunkSize, len(datagram))
+		}
+		if datagram[0] != 0x1e || datagram[1] != 0x0f {
+			t.Fatalf("expected chunk magic bytes, got %x", datagram[:2])
+		}
+		if id == nil {
+			id = datagram[2:10]
+			count = int(datagram[11])
+			chunks = make([][]byte, 0, count)
+		}
+		if !bytes.Equal(datagram[2:10], id) {
+			t.Fatalf("expected all chunks to share message ID %x, got %x", id, datagram[2:10])
+		}
+		if int(datagram[10]) != len(chunks) {
+			t.Fatalf("expected sequence number %v, got %v", len(chunks), datagram[10])
+		}
+		chunks = append(chunks, datagram[12:])
+	}
+	return bytes.Join(chunks, nil)
+}
+
+func Test_GELFCompression(t *testing.T) {
+	testCases := []struct {
+		name        string
+		compression logger.GELFCompression
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		{
+			name:        "gzip",
+			compression: logger.GELFCompressionGzip,
+			decompress:  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+		{
+			name:        "zlib",
+			compression: logger.GELFCompressionZlib,
+			decompress:  func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listener := listenUDP(t)
+			defer listener.Close()
+
+			loggerService, err := logger.InitializeGELFWithOptions(listener.LocalAddr().String(), syslogServiceContext,
+				logger.LogServiceOptions{}, logger.GELFOptions{Compression: tc.compression})
+			if err != nil {
+				t.Fatal(err)
+			}
+			log := loggerService.NewContext("context site", "operation")
+			for _, message := range []string{"first", "second"} {
+				log.Info(message)
+				r, err := tc.decompress(bytes.NewReader([]byte(receiveUDP(t, listener))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				message, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decodeGELF(t, message)
+			}
+		})
+	}
+}
+
+func Test_GELFWriterMessageTooLarge(t *testing.T) {
+	var datagrams int
+	w := logger.NewGELFWriter(writerFunc(func(bb []byte) (int, error) {
+		datagrams++
+		return len(bb), nil
+	}), logger.GELFOptions{ChunkSize: 100})
+
+	if _, err := w.Write(make([]byte, 128*88)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if datagrams != 128 {
+		t.Errorf("expected 128 chunks, got %v", datagrams)
+	}
+	if _, err := w.Write(make([]byte, 128*88+1)); err != logger.ErrMessageTooLarge {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultHTTPTimeout bounds each request made by the HTTP based writers.
+const defaultHTTPTimeout = 10 * time.Second
+
+// httpStatusError is returned when an HTTP endpoint responds with a status
+// other than 2xx.
+type httpStatusError struct {
+	endpoint   string
+	status     string
+	statusCode int
+
+	// retryAfter is the delay requested by the Retry-After header of a 429
+	// or 503 response, if any.
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("nobslogger: %s responded %s", e.endpoint, e.status)
+}
+
+// validateHTTPEndpoint returns an error if endpoint is not an absolute http
+// or https URL.
+func validateHTTPEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("nobslogger: endpoint must be an absolute http or https URL: %q", endpoint)
+	}
+	return nil
+}
+
+// newHTTPHeader returns the header for requests with the specified content
+// type and additional headers.
+func newHTTPHeader(contentType string, headers map[string]string) http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+	return header
+}
+
+// postHTTP POSTs body to endpoint, and returns an error (an *httpStatusError
+// if a response was received) unless a 2xx response is received. If response
+// is not nil, the body of a 2xx response is read into it. The request is
+// abandoned if ctx is done.
+func postHTTP(ctx context.Context, client *http.Client, endpoint string, header http.Header, body []byte, response *bytes.Buffer) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	r, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		io.Copy(ioutil.Discard, r.Body)
+		statusErr := &httpStatusError{endpoint: endpoint, status: r.Status, statusCode: r.StatusCode}
+		if r.StatusCode == http.StatusTooManyRequests || r.StatusCode == http.StatusServiceUnavailable {
+			statusErr.retryAfter = parseRetryAfter(r.Header.Get("Retry-After"), time.Now())
+		}
+		return statusErr
+	}
+	if response == nil {
+		io.Copy(ioutil.Discard, r.Body)
+		return nil
+	}
+	response.Reset()
+	_, err = response.ReadFrom(r.Body)
+	return err
+}
+
+// retryableHTTPError reports whether a request that failed with err may
+// succeed if it is retried; that is, if it failed without a response, or was
+// rate limited, or failed with a server error.
+func retryableHTTPError(err error) bool {
+	statusErr, ok := err.(*httpStatusError)
+	if !ok {
+		return true
+	}
+	return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, which
+// is either a number of seconds or an HTTP date, or zero if the header is
+// absent or malformed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryDelay returns the delay before retrying a request that failed with
+// err; the next delay from backoff, or the delay requested by the server, if
+// that is longer.
+func retryDelay(err error, backoff *backoff) time.Duration {
+	delay := backoff.delay()
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.retryAfter > delay {
+		delay = statusErr.retryAfter
+	}
+	return delay
+}
+
+// postHTTPWithRetry is the same as postHTTP, but retries requests that fail
+// with a retryable error (see retryableHTTPError), as described for retry.
+func postHTTPWithRetry(ctx context.Context, client *http.Client, endpoint string, header http.Header, body []byte, maxRetries int, backoff *backoff) error {
+	return retry(ctx, maxRetries, backoff, retryableHTTPError, func() error {
+		return postHTTP(ctx, client, endpoint, header, body, nil)
+	})
+}
@@ -0,0 +1,128 @@
+package logger
+
+// jsonKey identifies one of the fields that the JSON encoder writes for every
+// entry.
+type jsonKey int
+
+// jsonKey constants, in the order that the fields are written.
+const (
+	jsonKeyTimestamp jsonKey = iota
+	jsonKeyEnvironment
+	jsonKeySystemName
+	jsonKeyServiceName
+	jsonKeyServiceInstanceID
+	jsonKeySite
+	jsonKeyOperation
+	jsonKeyLevel
+	jsonKeySeverity
+	jsonKeyMessage
+	jsonKeyDetails
+	jsonKeyTruncated
+	jsonKeyCount
+)
+
+// jsonFieldNames are the default names of the fields that the JSON encoder
+// writes for every entry, indexed by jsonKey. These are the keys recognised by
+// LogServiceOptions.FieldNames.
+var jsonFieldNames = [jsonKeyCount]string{
+	"timestamp",
+	"environment",
+	"system_name",
+	"service_name",
+	"service_instance_id",
+	"site",
+	"operation",
+	"level",
+	"severity",
+	"msg",
+	"details",
+	"truncated",
+}
+
+// configuredJSONEncoder encodes entries as JSON objects, like jsonEncoder, but
+// with renamed and/or omitted fields. Each field's leading separator, name,
+// and opening quote are precomputed, so that encoding an entry costs no more
+// than it does with jsonEncoder.
+type configuredJSONEncoder struct {
+	keys                    [jsonKeyCount]string
+	omitEmptyDetails        bool
+	omitEmptyServiceContext bool
+}
+
+// newJSONEncoder returns the JSON encoder described by the FieldNames,
+// OmitEmptyDetails, and OmitEmptyServiceContext options. If none of these are
+// set, the default JSON encoder is returned.
+func newJSONEncoder(options LogServiceOptions) Encoder {
+	if len(options.FieldNames) == 0 && !options.OmitEmptyDetails && !options.OmitEmptyServiceContext {
+		return NewJSONEncoder()
+	}
+	e := &configuredJSONEncoder{
+		omitEmptyDetails:        options.OmitEmptyDetails,
+		omitEmptyServiceContext: options.OmitEmptyServiceContext,
+	}
+	for key, name := range jsonFieldNames {
+		if renamed, ok := options.FieldNames[name]; ok {
+			name = renamed
+		}
+		var token []byte
+		if jsonKey(key) != jsonKeyTimestamp {
+			// The timestamp is always written first, so every other field
+			// is preceded by a separator.
+			token = append(token, fieldSeparatorToken...)
+		}
+		token = append(token, quoteToken...)
+		token = serializeEscaped(token, name)
+		token = append(token, fieldKeyCloseToken...)
+		if jsonKey(key) == jsonKeyTruncated {
+			token = append(token, trueToken...)
+		} else {
+			token = append(token, quoteToken...)
+		}
+		e.keys[key] = string(token)
+	}
+	return e
+}
+
+func (e *configuredJSONEncoder) begin(buffer []byte, r record) []byte {
+	buffer = append(buffer, braceOpenToken...)
+	buffer = append(buffer, e.keys[jsonKeyTimestamp]...)
+	buffer = append(buffer, r.timestamp...)
+	buffer = append(buffer, finalFieldCloseToken...)
+	buffer = e.appendServiceContextField(buffer, jsonKeyEnvironment, r.sc.Environment)
+	buffer = e.appendServiceContextField(buffer, jsonKeySystemName, r.sc.SystemName)
+	buffer = e.appendServiceContextField(buffer, jsonKeyServiceName, r.sc.ServiceName)
+	buffer = e.appendServiceContextField(buffer, jsonKeyServiceInstanceID, r.sc.ServiceInstanceID)
+	buffer = e.appendField(buffer, jsonKeySite, r.site)
+	buffer = e.appendField(buffer, jsonKeyOperation, r.operation)
+	buffer = e.appendField(buffer, jsonKeyLevel, string(r.detail.Level))
+	buffer = e.appendField(buffer, jsonKeySeverity, string(r.detail.Severity))
+	buffer = e.appendField(buffer, jsonKeyMessage, r.detail.Message)
+	if r.detail.Details != "" || !e.omitEmptyDetails {
+		buffer = e.appendField(buffer, jsonKeyDetails, r.detail.Details)
+	}
+	return buffer
+}
+
+func (e *configuredJSONEncoder) appendField(buffer []byte, key jsonKey, value string) []byte {
+	buffer = append(buffer, e.keys[key]...)
+	buffer = append(buffer, value...)
+	return append(buffer, finalFieldCloseToken...)
+}
+
+func (e *configuredJSONEncoder) appendServiceContextField(buffer []byte, key jsonKey, value string) []byte {
+	if value == "" && e.omitEmptyServiceContext {
+		return buffer
+	}
+	return e.appendField(buffer, key, value)
+}
+
+func (e *configuredJSONEncoder) field(buffer []byte, f Field) []byte {
+	return serializeField(buffer, &f)
+}
+
+func (e *configuredJSONEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, e.keys[jsonKeyTruncated]...)
+	}
+	return append(buffer, braceCloseToken...)
+}
@@ -0,0 +1,99 @@
+package logger_test
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func keys(entry map[string]interface{}) []string {
+	result := []string{}
+	for key := range entry {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func Test_JSONFieldNames(t *testing.T) {
+	writer, entry := entryWriter(t)
+	loggerService := logger.InitializeWriterWithOptions(writer, syslogServiceContext, logger.LogServiceOptions{
+		FieldNames: map[string]string{
+			"msg":       "message",
+			"timestamp": "@timestamp",
+			"level":     "level\"number",
+			"unknown":   "ignored",
+		},
+	})
+	log := loggerService.NewContext("site", "operation")
+	log.InfoF("hello", "details", logger.String("msg", "field"))
+
+	expected := []string{"@timestamp", "details", "environment", "level\"number", "message", "msg", "operation",
+		"service_instance_id", "service_name", "severity", "site", "system_name"}
+	if actual := keys(entry()); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected keys %v, got %v", expected, actual)
+	}
+	if entry()["message"] != "hello" || entry()["msg"] != "field" || entry()["level\"number"] != "300" {
+		t.Errorf("unexpected entry: %v", entry())
+	}
+}
+
+func Test_JSONOmitEmpty(t *testing.T) {
+	sc := logger.ServiceContext{
+		Environment: "test",
+		ServiceName: "billing",
+	}
+	writer, entry := entryWriter(t)
+	loggerService := logger.InitializeWriterWithOptions(writer, sc, logger.LogServiceOptions{
+		OmitEmptyDetails:        true,
+		OmitEmptyServiceContext: true,
+	})
+	log := loggerService.NewContext("site", "operation")
+
+	log.Info("hello")
+	expected := []string{"environment", "level", "msg", "operation", "service_name", "severity", "site", "timestamp"}
+	if actual := keys(entry()); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected keys %v, got %v", expected, actual)
+	}
+
+	log.InfoD("hello", "details")
+	if entry()["details"] != "details" {
+		t.Errorf("expected details to be written, got %v", entry())
+	}
+}
+
+func Test_JSONFieldNamesTruncated(t *testing.T) {
+	writer, entry := entryWriter(t)
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		MaxEntrySize: 300,
+		FieldNames:   map[string]string{"truncated": "_truncated"},
+	})
+	log := loggerService.NewContext("site", "operation")
+	log.InfoD("hello", strings.Repeat("x", 1000))
+
+	if entry()["_truncated"] != true {
+		t.Errorf("expected entry to be marked as truncated, got %v", entry())
+	}
+}
+
+func Test_JSONFieldNamesZeroAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{
+		FieldNames:              map[string]string{"msg": "message"},
+		OmitEmptyDetails:        true,
+		OmitEmptyServiceContext: true,
+	})
+	log := loggerService.NewContext("site", "operation")
+	allocs := testing.AllocsPerRun(100, func() {
+		log.InfoF("message", "", logger.Int64("user", 42))
+	})
+	if allocs != 0 {
+		t.Errorf("expected 0 allocations, got %v", allocs)
+	}
+}
@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// levelFilter tracks the minimum LogLevel for a LogService along with any
+// per-site overrides. levelFilter is safe for concurrent use.
+//
+// Site overrides are stored as an immutable map that is replaced wholesale
+// whenever an override changes. This keeps the read path (which runs on every
+// log call) free of locks.
+type levelFilter struct {
+	level     int32
+	overrides atomic.Value // map[string]int32
+	mu        sync.Mutex
+}
+
+func newLevelFilter(level LogLevel) *levelFilter {
+	lf := &levelFilter{
+		level: level.rank(),
+	}
+	lf.overrides.Store(map[string]int32{})
+	return lf
+}
+
+func (lf *levelFilter) enabled(site string, level LogLevel) bool {
+	min := atomic.LoadInt32(&lf.level)
+	overrides := lf.overrides.Load().(map[string]int32)
+	if len(overrides) > 0 {
+		if siteMin, ok := overrides[site]; ok {
+			min = siteMin
+		}
+	}
+	return level.rank() >= min
+}
+
+func (lf *levelFilter) setLevel(level LogLevel) {
+	atomic.StoreInt32(&lf.level, level.rank())
+}
+
+func (lf *levelFilter) getLevel() LogLevel {
+	return levelFromRank(atomic.LoadInt32(&lf.level))
+}
+
+func (lf *levelFilter) setSiteLevel(site string, level LogLevel) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	current := lf.overrides.Load().(map[string]int32)
+	next := make(map[string]int32, len(current)+1)
+	for k, v := range current {
+		next[k] = v
+	}
+	next[site] = level.rank()
+	lf.overrides.Store(next)
+}
+
+func (lf *levelFilter) clearSiteLevel(site string) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	current := lf.overrides.Load().(map[string]int32)
+	if _, ok := current[site]; !ok {
+		return
+	}
+	next := make(map[string]int32, len(current))
+	for k, v := range current {
+		if k != site {
+			next[k] = v
+		}
+	}
+	lf.overrides.Store(next)
+}
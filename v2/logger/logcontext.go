@@ -10,7 +10,18 @@ import (
 // the general environment in which a series of related log calls will be made.
 type LogContext struct {
 	logService *LogService
-	buffer     []byte
+
+	// buffer is shared by all copies and children of this context. It is
+	// only accessed while the LogService is locked, and may be replaced with
+	// a larger buffer if the LogService permits buffer growth.
+	buffer *[]byte
+
+	// fields is the pre-serialized fragment of any fields attached to this
+	// context via With.
+	fields string
+
+	// fieldCount is the number of fields in fields.
+	fieldCount int
 
 	// Site specifies a general location in a codebase from which a group of
 	// log messages may emit.
@@ -22,6 +33,30 @@ type LogContext struct {
 	Operation string
 }
 
+// With returns a child LogContext which appends the supplied fields to every
+// entry that it writes, in addition to any fields inherited from this context.
+// The child context retains the Site and Operation of this context.
+//
+// Fields are serialized once, when With is called, so With is well suited to
+// attaching correlation values (such as a request ID) to a context that is
+// used for the life of a request.
+func (l *LogContext) With(fields ...Field) LogContext {
+	var fragment []byte
+	for i := range fields {
+		fragment = l.logService.options.Encoder.field(fragment, fields[i])
+	}
+	// The child shares this context's buffer, as buffers are only accessed
+	// while the LogService is locked, so With needn't allocate another.
+	return LogContext{
+		logService: l.logService,
+		buffer:     l.buffer,
+		fields:     l.fields + string(fragment),
+		fieldCount: l.fieldCount + len(fields),
+		Site:       l.Site,
+		Operation:  l.Operation,
+	}
+}
+
 // Trace logs the most granular information about system state.
 func (l *LogContext) Trace(message string) {
 	l.TraceD(message, "")
@@ -35,13 +70,33 @@ func (l *LogContext) TraceD(message, details string) {
 		Severity: LogSeverityTrace,
 		Message:  message,
 		Details:  details,
-	})
+	}, nil)
+}
+
+// TraceF logs the most granular information about system state along with extra
+// detail and typed fields.
+func (l *LogContext) TraceF(message, details string, fields ...Field) {
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelTrace,
+		Severity: LogSeverityTrace,
+		Message:  message,
+		Details:  details,
+	}, fields)
 }
 
 // TraceJ logs the most granular information about system state along with extra
 // detail, while also escaping all reserved JSON characters.
 func (l *LogContext) TraceJ(message, details string) {
-	l.TraceD(escape(message), escape(details))
+	if !l.Enabled(LogLevelTrace) {
+		return
+	}
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelTrace,
+		Severity: LogSeverityTrace,
+		Message:  escape(message),
+		Details:  escape(details),
+		escaped:  true,
+	}, nil)
 }
 
 // Debug logs fairly graunlar information about system state.
@@ -57,13 +112,33 @@ func (l *LogContext) DebugD(message, details string) {
 		Severity: LogSeverityDebug,
 		Message:  message,
 		Details:  details,
-	})
+	}, nil)
+}
+
+// DebugF logs relatively detailed information about system state along with
+// extra detail and typed fields.
+func (l *LogContext) DebugF(message, details string, fields ...Field) {
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelDebug,
+		Severity: LogSeverityDebug,
+		Message:  message,
+		Details:  details,
+	}, fields)
 }
 
 // DebugJ logs relatively detailed information about system state along with
 // extra detail, while also escaping all reserved JSON characters.
 func (l *LogContext) DebugJ(message, details string) {
-	l.DebugD(escape(message), escape(details))
+	if !l.Enabled(LogLevelDebug) {
+		return
+	}
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelDebug,
+		Severity: LogSeverityDebug,
+		Message:  escape(message),
+		Details:  escape(details),
+		escaped:  true,
+	}, nil)
 }
 
 // Info logs general informational messages useful for describing system state.
@@ -79,13 +154,33 @@ func (l *LogContext) InfoD(message, details string) {
 		Severity: LogSeverityInfo,
 		Message:  message,
 		Details:  details,
-	})
+	}, nil)
+}
+
+// InfoF logs general informational messages useful for describing system state
+// along with extra detail and typed fields.
+func (l *LogContext) InfoF(message, details string, fields ...Field) {
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelInfo,
+		Severity: LogSeverityInfo,
+		Message:  message,
+		Details:  details,
+	}, fields)
 }
 
 // InfoJ logs general informational messages useful for describing system state
 // along with extra detail, while also escaping all reserved JSON characters.
 func (l *LogContext) InfoJ(message, details string) {
-	l.InfoD(escape(message), escape(details))
+	if !l.Enabled(LogLevelInfo) {
+		return
+	}
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelInfo,
+		Severity: LogSeverityInfo,
+		Message:  escape(message),
+		Details:  escape(details),
+		escaped:  true,
+	}, nil)
 }
 
 // Warn logs information about potentially harmful situations of interest.
@@ -101,13 +196,33 @@ func (l *LogContext) WarnD(message, details string) {
 		Severity: LogSeverityWarn,
 		Message:  message,
 		Details:  details,
-	})
+	}, nil)
+}
+
+// WarnF logs information about potentially harmful situations of interest along
+// with extra detail and typed fields.
+func (l *LogContext) WarnF(message, details string, fields ...Field) {
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelWarn,
+		Severity: LogSeverityWarn,
+		Message:  message,
+		Details:  details,
+	}, fields)
 }
 
 // WarnJ logs information about potentially harmful situations of interest along
 // with extra detail, while also escaping all reserved JSON characters.
 func (l *LogContext) WarnJ(message, details string) {
-	l.WarnD(escape(message), escape(details))
+	if !l.Enabled(LogLevelWarn) {
+		return
+	}
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelWarn,
+		Severity: LogSeverityWarn,
+		Message:  escape(message),
+		Details:  escape(details),
+		escaped:  true,
+	}, nil)
 }
 
 // Error logs events of considerable importance that will prevent normal program
@@ -125,14 +240,35 @@ func (l *LogContext) ErrorD(message, details string) {
 		Severity: LogSeverityError,
 		Message:  message,
 		Details:  details,
-	})
+	}, nil)
+}
+
+// ErrorF logs events of considerable importance that will prevent normal program
+// execution, but might still allow the application to continue running along
+// with extra detail and typed fields.
+func (l *LogContext) ErrorF(message, details string, fields ...Field) {
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelError,
+		Severity: LogSeverityError,
+		Message:  message,
+		Details:  details,
+	}, fields)
 }
 
 // ErrorJ logs events of considerable importance that will prevent normal program
 // execution, but might still allow the application to continue running along
 // with extra detail, while also escaping all reserved JSON characters.
 func (l *LogContext) ErrorJ(message, details string) {
-	l.ErrorD(escape(message), escape(details))
+	if !l.Enabled(LogLevelError) {
+		return
+	}
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelError,
+		Severity: LogSeverityError,
+		Message:  escape(message),
+		Details:  escape(details),
+		escaped:  true,
+	}, nil)
 }
 
 // Fatal logs the most severe events. Fatal events are likely to have caused
@@ -149,13 +285,33 @@ func (l *LogContext) FatalD(message, details string) {
 		Severity: LogSeverityFatal,
 		Message:  message,
 		Details:  details,
-	})
+	}, nil)
+}
+
+// FatalF logs the most severe events along with extra detail and typed fields.
+// Fatal events are likely to have caused a service to terminate.
+func (l *LogContext) FatalF(message, details string, fields ...Field) {
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelFatal,
+		Severity: LogSeverityFatal,
+		Message:  message,
+		Details:  details,
+	}, fields)
 }
 
 // FatalJ logs the most severe events. Fatal events are likely to have caused
 // a service to terminate, while also escaping all reserved JSON characters.
 func (l *LogContext) FatalJ(message, details string) {
-	l.FatalD(escape(message), escape(details))
+	if !l.Enabled(LogLevelFatal) {
+		return
+	}
+	l.submit(l.logService.serviceContext, l, LogDetail{
+		Level:    LogLevelFatal,
+		Severity: LogSeverityFatal,
+		Message:  escape(message),
+		Details:  escape(details),
+		escaped:  true,
+	}, nil)
 }
 
 // Write enables this context to be used as an io.Writer.
@@ -163,12 +319,35 @@ func (l *LogContext) FatalJ(message, details string) {
 // The Write method always inspects the inbound message and escapes any JSON
 // characters to avoid unintentionally mangling the expected log entry.
 func (l LogContext) Write(message []byte) (int, error) {
-	l.Trace(escape(string(message)))
+	if !l.Enabled(LogLevelTrace) {
+		return len(message), nil
+	}
+	l.submit(l.logService.serviceContext, &l, LogDetail{
+		Level:    LogLevelTrace,
+		Severity: LogSeverityTrace,
+		Message:  escape(string(message)),
+		escaped:  true,
+	}, nil)
 	return len(message), nil
 }
 
-func (l LogContext) submit(sc *ServiceContext, lc *LogContext, ld LogDetail) {
+// Enabled reports whether entries of the specified level will be written by
+// this context. Enabled can be used to avoid constructing expensive details
+// for entries that would otherwise be discarded.
+func (l *LogContext) Enabled(level LogLevel) bool {
+	return l.logService.levels.enabled(l.Site, level)
+}
+
+func (l LogContext) submit(sc *ServiceContext, lc *LogContext, ld LogDetail, fields []Field) {
+	if !lc.Enabled(ld.Level) {
+		return
+	}
 	atomic.AddUint32(&l.logService.waiters, 1)
+	if atomic.LoadInt32(&l.logService.closed) == 1 {
+		atomic.AddUint64(l.logService.rejected, 1)
+		l.logService.release()
+		return
+	}
 	for {
 		if atomic.CompareAndSwapInt32(&l.logService.locked, 0, 1) {
 			break
@@ -177,8 +356,20 @@ func (l LogContext) submit(sc *ServiceContext, lc *LogContext, ld LogDetail) {
 		// benchmarks if altering this call.
 		runtime.Gosched()
 	}
-	offset := serialize(l.buffer, sc, lc, ld)
-	l.logService.writeEntry(lc.buffer[0:offset])
+	entry := l.logService.serializeEntry(*lc.buffer, sc, lc, ld, fields)
+	var overflow []byte
+	if !l.logService.dispatch(entry, ld.Level) {
+		// The queue is full. The entry is copied out of the (shared) buffer
+		// so that it can wait for room without holding the lock, which
+		// would otherwise stall every other logging goroutine.
+		overflow = append([]byte(nil), entry...)
+	}
+	if l.logService.options.GrowEntryBuffers && cap(entry) > cap(*lc.buffer) {
+		*lc.buffer = entry[:0]
+	}
 	atomic.SwapInt32(&l.logService.locked, 0)
-	atomic.AddUint32(&l.logService.waiters, ^uint32(0))
+	if overflow != nil {
+		l.logService.queue.pushWait(overflow, ld.Level.rank())
+	}
+	l.logService.release()
 }
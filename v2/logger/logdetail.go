@@ -7,4 +7,11 @@ type LogDetail struct {
 	Timestamp string
 	Message   string
 	Details   string
+
+	// escaped is set by the J methods (and LogContext.Write), which escape
+	// Message and Details for JSON on the caller's behalf. Encoders that
+	// don't produce JSON must reverse the escaping (see appendUnescaped)
+	// when escaped is set; otherwise, Message and Details are written as
+	// supplied.
+	escaped bool
 }
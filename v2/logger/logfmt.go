@@ -0,0 +1,155 @@
+package logger
+
+import (
+	"strconv"
+	"time"
+)
+
+// logfmtEncoder encodes entries as logfmt lines.
+type logfmtEncoder struct{}
+
+// NewLogfmtEncoder returns an Encoder that encodes entries as logfmt, i.e.
+//
+//	timestamp=2009-11-10T23:00:00Z environment=prod ... msg="hello world" details=""
+//
+// Entries contain the same fields, in the same order, as those written by the
+// JSON encoder. Values are quoted if they are empty, or if they contain
+// spaces, '=', '"', '\', or control characters, and use the same escaping as
+// the JSON encoder. Messages and details are quoted and escaped in the same
+// way as string fields, whether or not they were escaped by one of the J
+// methods of LogContext.
+//
+// A line based Framing (such as FramingNewline) should be used with this
+// encoder.
+func NewLogfmtEncoder() Encoder {
+	return logfmtEncoder{}
+}
+
+func (logfmtEncoder) begin(buffer []byte, r record) []byte {
+	buffer = append(buffer, "timestamp="...)
+	buffer = append(buffer, r.timestamp...)
+	buffer = append(buffer, " environment="...)
+	buffer = appendLogfmtEscaped(buffer, r.sc.Environment)
+	buffer = append(buffer, " system_name="...)
+	buffer = appendLogfmtEscaped(buffer, r.sc.SystemName)
+	buffer = append(buffer, " service_name="...)
+	buffer = appendLogfmtEscaped(buffer, r.sc.ServiceName)
+	buffer = append(buffer, " service_instance_id="...)
+	buffer = appendLogfmtEscaped(buffer, r.sc.ServiceInstanceID)
+	buffer = append(buffer, " site="...)
+	buffer = appendLogfmtEscaped(buffer, r.site)
+	buffer = append(buffer, " operation="...)
+	buffer = appendLogfmtEscaped(buffer, r.operation)
+	buffer = append(buffer, " level="...)
+	buffer = appendLogfmtEscaped(buffer, string(r.detail.Level))
+	buffer = append(buffer, " severity="...)
+	buffer = appendLogfmtEscaped(buffer, string(r.detail.Severity))
+	if r.detail.escaped {
+		buffer = append(buffer, " msg="...)
+		buffer = appendLogfmtUnescaped(buffer, r.detail.Message)
+		buffer = append(buffer, " details="...)
+		return appendLogfmtUnescaped(buffer, r.detail.Details)
+	}
+	buffer = append(buffer, " msg="...)
+	buffer = appendLogfmtString(buffer, r.detail.Message)
+	buffer = append(buffer, " details="...)
+	return appendLogfmtString(buffer, r.detail.Details)
+}
+
+func (logfmtEncoder) field(buffer []byte, f Field) []byte {
+	buffer = append(buffer, ' ')
+	for i := 0; i < len(f.key); i++ {
+		if logfmtReserved(f.key[i]) {
+			buffer = append(buffer, '_')
+		} else {
+			buffer = append(buffer, f.key[i])
+		}
+	}
+	buffer = append(buffer, '=')
+	switch f.kind {
+	case fieldKindString:
+		return appendLogfmtString(buffer, f.str)
+	case fieldKindInt64, fieldKindDuration:
+		return strconv.AppendInt(buffer, f.integer, 10)
+	case fieldKindFloat64:
+		return strconv.AppendFloat(buffer, f.float, 'g', -1, 64)
+	case fieldKindBool:
+		return strconv.AppendBool(buffer, f.integer != 0)
+	case fieldKindTime:
+		return f.time.AppendFormat(buffer, time.RFC3339Nano)
+	default:
+		return append(buffer, nullToken...)
+	}
+}
+
+func (logfmtEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, " truncated=true"...)
+	}
+	return buffer
+}
+
+// appendLogfmtString appends a value that has not been escaped, quoting and
+// escaping it if necessary.
+func appendLogfmtString(buffer []byte, s string) []byte {
+	if !logfmtRequiresQuotes(s) {
+		return append(buffer, s...)
+	}
+	buffer = append(buffer, quoteToken...)
+	buffer = serializeEscaped(buffer, s)
+	return append(buffer, quoteToken...)
+}
+
+// appendLogfmtEscaped appends a value that has already been escaped (see
+// escape), quoting it if necessary.
+func appendLogfmtEscaped(buffer []byte, s string) []byte {
+	if !logfmtRequiresQuotes(s) {
+		return append(buffer, s...)
+	}
+	buffer = append(buffer, quoteToken...)
+	buffer = append(buffer, s...)
+	return append(buffer, quoteToken...)
+}
+
+// appendLogfmtUnescaped appends a value that was escaped by one of the J
+// methods, quoting it if necessary. The value is unescaped, and escaped again
+// in the same way as string fields, so that control characters which escape
+// leaves alone (such as ESC) are escaped too.
+func appendLogfmtUnescaped(buffer []byte, s string) []byte {
+	if !logfmtRequiresQuotes(s) {
+		return append(buffer, s...)
+	}
+	buffer = append(buffer, quoteToken...)
+	for i := 0; i < len(s); {
+		start := i
+		var c byte
+		c, i = unescapeAt(s, i)
+		switch {
+		case i > start+1:
+			// Already escaped, as serializeEscaped would.
+			buffer = append(buffer, s[start:i]...)
+		case c < 0x20:
+			buffer = append(buffer, `\u00`...)
+			buffer = append(buffer, hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			buffer = append(buffer, c)
+		}
+	}
+	return append(buffer, quoteToken...)
+}
+
+func logfmtRequiresQuotes(s string) bool {
+	if s == "" {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if logfmtReserved(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func logfmtReserved(c byte) bool {
+	return c <= ' ' || c == '=' || c == '"' || c == '\\' || c == 0x7f
+}
@@ -0,0 +1,175 @@
+package logger_test
+
+import (
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// parseLogfmt splits a logfmt line into its keys and (unquoted) values.
+func parseLogfmt(t *testing.T, line string) ([]string, map[string]string) {
+	t.Helper()
+	var keys []string
+	values := map[string]string{}
+	for i := 0; i < len(line); {
+		start := i
+		for i < len(line) && line[i] != '=' {
+			i++
+		}
+		key := line[start:i]
+		i++
+		start = i
+		if i < len(line) && line[i] == '"' {
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		} else {
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+		}
+		if i > len(line) {
+			t.Fatalf("unterminated value in %q", line)
+		}
+		keys = append(keys, key)
+		values[key] = line[start:i]
+		i++
+	}
+	return keys, values
+}
+
+func Test_LogfmtEncoder(t *testing.T) {
+	var line string
+	writer := writerFunc(func(bb []byte) (int, error) {
+		line = string(bb)
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{
+		Environment:       "environment",
+		SystemName:        "system name",
+		ServiceName:       "service=name",
+		ServiceInstanceID: "",
+	}, logger.LogServiceOptions{
+		Encoder: logger.NewLogfmtEncoder(),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoF("hello world", "", logger.Int64("user", 42), logger.String("quote", `a "b"`),
+		logger.Bool("ok", true), logger.Time("at", time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC)))
+
+	keys, values := parseLogfmt(t, line)
+	expectedKeys := []string{"timestamp", "environment", "system_name", "service_name", "service_instance_id",
+		"site", "operation", "level", "severity", "msg", "details", "user", "quote", "ok", "at"}
+	if len(keys) != len(expectedKeys) {
+		t.Fatalf("expected keys %v, got %v", expectedKeys, keys)
+	}
+	for i := range expectedKeys {
+		if keys[i] != expectedKeys[i] {
+			t.Errorf("expected keys %v, got %v", expectedKeys, keys)
+			break
+		}
+	}
+	expected := map[string]string{
+		"environment":         "environment",
+		"system_name":         `"system name"`,
+		"service_name":        `"service=name"`,
+		"service_instance_id": `""`,
+		"site":                `"context site"`,
+		"level":               "300",
+		"severity":            "info",
+		"msg":                 `"hello world"`,
+		"details":             `""`,
+		"user":                "42",
+		"quote":               `"a \"b\""`,
+		"ok":                  "true",
+		"at":                  "2009-11-10T23:00:00Z",
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("expected %v to be %v, got %v", key, value, values[key])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, values["timestamp"]); err != nil {
+		t.Errorf("unexpected timestamp: %v", err)
+	}
+}
+
+// Messages and details must be quoted in the same way as string fields, so
+// that they unquote to the values supplied, whether or not they were escaped
+// by the J methods.
+func Test_LogfmtEncoderEscapesDetails(t *testing.T) {
+	var line string
+	writer := writerFunc(func(bb []byte) (int, error) {
+		line = string(bb)
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewLogfmtEncoder(),
+	})
+	log := loggerService.NewContext("site", "operation")
+	message, details := `say "hi" \ bye`, "line\nbreak\x1b[2J\ttab \"quoted\""
+
+	testCases := []struct {
+		name string
+		log  func(message, details string)
+	}{
+		{"InfoD", log.InfoD},
+		{"InfoJ", log.InfoJ},
+	}
+	for _, testCase := range testCases {
+		testCase.log(message, details)
+		_, values := parseLogfmt(t, line)
+		for key, expected := range map[string]string{"msg": message, "details": details} {
+			actual, err := strconv.Unquote(values[key])
+			if err != nil {
+				t.Errorf("%v: expected %v to be quoted: %v", testCase.name, values[key], err)
+				continue
+			}
+			if actual != expected {
+				t.Errorf("%v: expected %v to be %q, got %q", testCase.name, key, expected, actual)
+			}
+		}
+	}
+}
+
+func Test_LogfmtEncoderTruncated(t *testing.T) {
+	var line string
+	writer := writerFunc(func(bb []byte) (int, error) {
+		line = string(bb)
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		MaxEntrySize: 300,
+		Encoder:      logger.NewLogfmtEncoder(),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoD("message", string(make([]byte, 1000)))
+
+	if len(line) > 300 {
+		t.Errorf("expected entry of at most 300 bytes, got %v", len(line))
+	}
+	if _, values := parseLogfmt(t, line); values["truncated"] != "true" {
+		t.Errorf("expected entry to be marked as truncated: %v", line)
+	}
+}
+
+func Test_LogfmtEncoderZeroAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewLogfmtEncoder(),
+	})
+	log := loggerService.NewContext("context site", "operation")
+	allocs := testing.AllocsPerRun(100, func() {
+		log.InfoF("message", "details", logger.Int64("user", 42), logger.String("name", "value with spaces"))
+	})
+	if allocs != 0 {
+		t.Errorf("expected 0 allocations, got %v", allocs)
+	}
+}
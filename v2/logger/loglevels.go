@@ -27,3 +27,43 @@ const (
 	LogSeverityError LogSeverity = "error"
 	LogSeverityFatal LogSeverity = "fatal"
 )
+
+// rank returns the numeric value of a LogLevel for the purposes of level
+// comparison. Values other than the LogLevel constants rank as zero.
+func (l LogLevel) rank() int32 {
+	switch l {
+	case LogLevelTrace:
+		return 100
+	case LogLevelDebug:
+		return 200
+	case LogLevelInfo:
+		return 300
+	case LogLevelWarn:
+		return 400
+	case LogLevelError:
+		return 500
+	case LogLevelFatal:
+		return 600
+	default:
+		return 0
+	}
+}
+
+// levelFromRank is the inverse of LogLevel.rank. A rank of zero (which permits
+// all levels) is reported as LogLevelTrace.
+func levelFromRank(rank int32) LogLevel {
+	switch {
+	case rank <= 100:
+		return LogLevelTrace
+	case rank <= 200:
+		return LogLevelDebug
+	case rank <= 300:
+		return LogLevelInfo
+	case rank <= 400:
+		return LogLevelWarn
+	case rank <= 500:
+		return LogLevelError
+	default:
+		return LogLevelFatal
+	}
+}
@@ -1,11 +1,13 @@
 package logger
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
-	"runtime"
 	"sync/atomic"
 	"time"
 )
@@ -14,6 +16,10 @@ import (
 // theorhtical (max) MTU for UDP transmissions.
 const initialMsgBufferAllocation = 64 * 1024
 
+// defaultResolveInterval is how often NewUDPService re-resolves the host name
+// of the UDP server.
+const defaultResolveInterval = time.Minute
+
 // ServiceContext defines structural log elements that are applied to every
 // log entry from this log service instance.
 type ServiceContext struct {
@@ -34,11 +40,125 @@ type ServiceContext struct {
 // LogServiceOptions exposes configuration settings for LogService behavior.
 type LogServiceOptions struct {
 	CancellationDeadline time.Duration
+
+	// MinLevel is the lowest LogLevel that will be written. Entries below
+	// this level are discarded before they are serialized. The zero value
+	// permits entries of all levels. See also LogService.SetLevel.
+	MinLevel LogLevel
+
+	// MaxEntrySize is the maximum size, in bytes, of a serialized log entry.
+	// Entries that would exceed this size have their details (and then, if
+	// necessary, their message) truncated, and are marked with
+	// "truncated":true. If an entry's fields alone exceed this size, the
+	// fields are dropped. The zero value defaults to 64KiB, which matches
+	// the maximum size of a UDP datagram.
+	MaxEntrySize int
+
+	// GrowEntryBuffers permits entries larger than MaxEntrySize to be written
+	// in full rather than truncated. In this mode, MaxEntrySize is the
+	// initial size of each LogContext's buffer, and buffers grow as needed to
+	// hold the largest entry that they have written. GrowEntryBuffers should
+	// only be used with writers (such as files) that can accept entries of
+	// arbitrary size.
+	GrowEntryBuffers bool
+
+	// AsyncQueueSize enables asynchronous mode when greater than zero. In
+	// asynchronous mode, entries are serialized by the logging goroutine, and
+	// then placed in a queue of up to AsyncQueueSize entries, from which a
+	// dedicated goroutine transmits them to the writer. This prevents a slow
+	// writer from stalling the goroutines that are logging.
+	//
+	// By default (when AsyncQueueSize is zero), entries are written to the
+	// writer synchronously.
+	AsyncQueueSize int
+
+	// OverflowPolicy determines how the LogService behaves when the queue is
+	// full in asynchronous mode. The default is OverflowBlock.
+	OverflowPolicy OverflowPolicy
+
+	// OverflowMinLevel is the lowest LogLevel which will not be discarded when
+	// the queue is full under the OverflowDropBelowLevel policy.
+	OverflowMinLevel LogLevel
+
+	// ErrorHandler is called whenever the writer returns an error. See
+	// DiscardErrorHandler, StderrErrorHandler, and
+	// SecondaryWriterErrorHandler.
+	//
+	// If ErrorHandler is nil, the LogService dumps the failed entry to
+	// os.Stderr, and tries to transmit an error entry via the writer (see
+	// InitializeUDP).
+	ErrorHandler ErrorHandler
+
+	// Framing determines how entries are delimited when they are passed to
+	// the writer. The default, FramingNone, is appropriate for message
+	// oriented writers such as UDP. Stream oriented writers (such as files,
+	// stdout, or TCP) require one of the other framing modes so that
+	// entries can be separated downstream.
+	//
+	// Framing is not included when entries are measured against
+	// MaxEntrySize.
+	Framing Framing
+
+	// Encoder determines the format in which entries are written. The
+	// default is NewJSONEncoder.
+	Encoder Encoder
+
+	// FieldNames renames the fields that the default JSON encoder writes for
+	// every entry. Keys are the default names (timestamp, environment,
+	// system_name, service_name, service_instance_id, site, operation, level,
+	// severity, msg, details, and truncated), and values are the names to
+	// write in their place, i.e.
+	//
+	//	map[string]string{"msg": "message", "timestamp": "@timestamp"}
+	//
+	// Unrecognised keys are ignored. Field names are resolved once, when the
+	// LogService is initialized, so renaming fields has no per-entry cost.
+	// FieldNames is ignored if an Encoder is supplied.
+	FieldNames map[string]string
+
+	// OmitEmptyDetails omits the details field from entries whose details are
+	// empty. OmitEmptyDetails is ignored if an Encoder is supplied.
+	OmitEmptyDetails bool
+
+	// OmitEmptyServiceContext omits any ServiceContext fields that are empty
+	// (such as a SystemName that is not used) from every entry.
+	// OmitEmptyServiceContext is ignored if an Encoder is supplied.
+	OmitEmptyServiceContext bool
 }
 
+// Framing defines how entries are delimited from one another.
+type Framing int
+
+// Framing constants.
+const (
+	// FramingNone writes each entry as a bare JSON object.
+	FramingNone Framing = iota
+
+	// FramingNewline terminates each entry with a newline, as expected by
+	// JSON-lines tooling.
+	FramingNewline
+
+	// FramingNUL terminates each entry with a NUL byte, as expected by GELF
+	// over TCP.
+	FramingNUL
+
+	// FramingLengthPrefix precedes each entry with its length, as a 4-byte
+	// big-endian unsigned integer.
+	FramingLengthPrefix
+
+	// FramingOctetCounting precedes each entry with its length, in decimal,
+	// followed by a space, as expected by syslog over TCP (RFC 6587).
+	FramingOctetCounting
+)
+
+// maxFramingOverhead is the most space that framing adds to an entry; that
+// is, a ten digit octet count and a space.
+const maxFramingOverhead = 11
+
 func defaultLogServiceOptions() LogServiceOptions {
 	return LogServiceOptions{
 		CancellationDeadline: 30 * time.Second,
+		MaxEntrySize:         initialMsgBufferAllocation,
 	}
 }
 
@@ -47,29 +167,38 @@ func defaultLogServiceOptions() LogServiceOptions {
 type LogService struct {
 	locked         int32
 	waiters        uint32
+	closed         int32
+	drained        chan struct{}
+	rejected       *uint64
+	levels         *levelFilter
 	errMsgBuffer   []byte
 	serviceContext *ServiceContext
 	options        LogServiceOptions
 	logWriter      io.Writer
+	queue          *entryQueue
 }
 
 // InitializeUDP establishes a connection to a specified UDP server (such as
 // logstash),  and returns a LogService instance through which more detailed
 // logging contexts can be spawned (see NewContext)
 //
-// This function will panic if an error occurs while establishing the connection
-// to the UDP server.
+// The connection is established in the background, and the host name is
+// re-resolved every minute, as well as after any write error (see UDPWriter).
+//
+// InitializeUDP panics if hostURI is malformed.
 //
 // NobSlogger does not make any attempts at UDP MTU discovery, and will not
 // prohibit the host system from attempting to send log messages that exceed
-// the network's UDP MTU limit. If this limit is exceeded, one of two things
+// the network's UDP MTU limit (see InitializeGELF for a UDP transport that
+// splits large messages into chunks). If this limit is exceeded, one of two things
 // may occur:
 //
 // 1) The LogService may return an error while attempting to transmit the
 // message. In this case, the LogService will try to log (via UDP) that it
 // has received an error while shipping log data. This message will have a
 // severity of "Error". If the error log transmission fails, the LogService will
-// post the resulting error message to StdErr, and continue on.
+// post the resulting error message to StdErr, and continue on. This behavior
+// can be replaced by supplying an ErrorHandler via LogServiceOptions.
 //
 // 2) If an outbound UDP packet is split or lost downstream, the LogService may
 // not have any awareness that the it was lost. In this case the destination
@@ -78,18 +207,80 @@ type LogService struct {
 // and flag if/when an inbound message is incomplete.
 //
 // hostURI: Must be a fully qualified URI including port.
+//
+// Deprecated: Use NewUDPService, which returns an error rather than panicking.
 func InitializeUDP(hostURI string, serviceContext ServiceContext) LogService {
 	return InitializeUDPWithOptions(hostURI, serviceContext, defaultLogServiceOptions())
 }
 
 // InitializeUDPWithOptions is the samme as InitializeUDP, but with custom
-// LogServiceOptions supplied. See InitializeUDP.
+// LogServiceOptions supplied. Like InitializeUDP, it panics if hostURI is
+// malformed. See InitializeUDP.
+//
+// Deprecated: Use NewUDPService, which returns an error rather than panicking.
 func InitializeUDPWithOptions(hostURI string, serviceContext ServiceContext, options LogServiceOptions) LogService {
-	cn, err := net.Dial("udp", hostURI)
+	ls, err := NewUDPService(hostURI, serviceContext, options)
+	if err != nil {
+		panic(err.Error())
+	}
+	return ls
+}
+
+// NewUDPService is the same as InitializeUDPWithOptions, but it returns an
+// error, rather than panicking, if hostURI is malformed. See InitializeUDP.
+// To supply custom UDPWriterOptions, pass a UDPWriter (see NewUDPWriter) to
+// InitializeWriterWithOptions instead.
+func NewUDPService(hostURI string, serviceContext ServiceContext, options LogServiceOptions) (LogService, error) {
+	w, err := NewUDPWriter(hostURI, UDPWriterOptions{
+		ResolveInterval: defaultResolveInterval,
+	})
 	if err != nil {
-		panic("error occurred while establishing udp connection")
+		return LogService{}, err
 	}
-	return InitializeWriterWithOptions(cn, serviceContext, options)
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// InitializeTCP establishes a connection to a specified TCP server (such as
+// logstash with a json_lines codec), and returns a LogService instance through
+// which more detailed logging contexts can be spawned (see NewContext).
+//
+// Entries are delimited with newlines. The connection is established in the
+// background, and is re-established with backoff whenever it fails. Entries
+// are buffered while disconnected (see TCPWriter).
+//
+// An error is returned if hostURI is malformed.
+//
+// hostURI: Must be a fully qualified URI including port.
+func InitializeTCP(hostURI string, serviceContext ServiceContext) (LogService, error) {
+	return InitializeTCPWithOptions(hostURI, serviceContext, defaultLogServiceOptions(), TCPWriterOptions{})
+}
+
+// InitializeTCPWithOptions is the same as InitializeTCP, but with custom
+// LogServiceOptions and TCPWriterOptions supplied. If options.Framing is
+// FramingNone, FramingNewline is used instead. See InitializeTCP.
+func InitializeTCPWithOptions(hostURI string, serviceContext ServiceContext, options LogServiceOptions, tcpOptions TCPWriterOptions) (LogService, error) {
+	w, err := NewTCPWriter(hostURI, tcpOptions)
+	if err != nil {
+		return LogService{}, err
+	}
+	if options.Framing == FramingNone {
+		options.Framing = FramingNewline
+	}
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// InitializeTLS is the same as InitializeTCP, but the connection is secured
+// with TLS using the supplied configuration. The configuration can specify
+// the CAs that are trusted (RootCAs), client certificates for mutual TLS
+// (Certificates), and the expected server name (ServerName). If config is
+// nil, the system CAs are trusted. See InitializeTCP.
+//
+// hostURI: Must be a fully qualified URI including port.
+func InitializeTLS(hostURI string, serviceContext ServiceContext, config *tls.Config) (LogService, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return InitializeTCPWithOptions(hostURI, serviceContext, defaultLogServiceOptions(), TCPWriterOptions{TLSConfig: config})
 }
 
 // InitializeWriter establishes a logging service that transmits logs to the
@@ -106,20 +297,66 @@ func InitializeWriterWithOptions(w io.Writer, serviceContext ServiceContext, opt
 	serviceContext.ServiceName = escape(serviceContext.ServiceName)
 	serviceContext.SystemName = escape(serviceContext.SystemName)
 
+	if options.MaxEntrySize <= 0 {
+		options.MaxEntrySize = initialMsgBufferAllocation
+	}
+	if options.Encoder == nil {
+		options.Encoder = newJSONEncoder(options)
+	}
+
 	ls := LogService{
 		locked:         0,
 		waiters:        0,
-		errMsgBuffer:   make([]byte, initialMsgBufferAllocation),
+		closed:         0,
+		drained:        make(chan struct{}, 1),
+		rejected:       new(uint64),
+		levels:         newLevelFilter(options.MinLevel),
+		errMsgBuffer:   make([]byte, 0, options.MaxEntrySize+maxFramingOverhead),
 		serviceContext: &serviceContext,
 		options:        options,
 		logWriter:      w,
 	}
 
+	if options.AsyncQueueSize > 0 {
+		// The writer goroutine only relies on state that is fixed at this
+		// point (or is shared via pointer), so it remains valid for all
+		// copies of the LogService that is returned.
+		ls.queue = newEntryQueue(options.AsyncQueueSize, options.OverflowPolicy, options.OverflowMinLevel)
+		go ls.queue.run(ls.writeEntry)
+	}
+
 	return ls
 }
 
+// dispatch hands a serialized entry off to the writer; either directly, or
+// via the queue if the LogService is running in asynchronous mode. dispatch
+// returns false if the queue is full, and the entry must wait for room (see
+// entryQueue.push).
+func (ls *LogService) dispatch(entry []byte, level LogLevel) bool {
+	if ls.queue != nil {
+		return ls.queue.push(entry, level.rank())
+	}
+	ls.writeEntry(entry)
+	return true
+}
+
+// release marks the completion of an in-flight submission, and notifies Close
+// once the last in-flight submission completes.
+func (ls *LogService) release() {
+	if atomic.AddUint32(&ls.waiters, ^uint32(0)) == 0 && atomic.LoadInt32(&ls.closed) == 1 {
+		select {
+		case ls.drained <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (ls *LogService) writeEntry(msg []byte) {
 	_, err := ls.logWriter.Write(msg)
+	if err != nil && ls.options.ErrorHandler != nil {
+		ls.options.ErrorHandler(err, msg)
+		return
+	}
 	if err != nil {
 		// We dump the original message to stdErr and try to transmit the error
 		// notification back to the writer. If error transmission fails, we
@@ -131,7 +368,7 @@ func (ls *LogService) writeEntry(msg []byte) {
 		// `NewContext` and using the `LogContext.submit` method). This allows
 		// the error message to retain priority in the message pipeline.
 		stdErr := log.New(os.Stderr, "", 0)
-		offset := serialize(ls.errMsgBuffer, ls.serviceContext,
+		errMsg := ls.serializeEntry(ls.errMsgBuffer, ls.serviceContext,
 			&LogContext{
 				Site:      "log service",
 				Operation: "handleLogs",
@@ -140,55 +377,262 @@ func (ls *LogService) writeEntry(msg []byte) {
 				Level:     LogLevelError,
 				Severity:  LogSeverityError,
 				Message:   "error occurred while shipping log data",
-				Details:   err.Error(),
+				Details:   escape(err.Error()),
 				Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
 			},
+			nil,
 		)
 		stdErr.Println(string(msg))
-		_, err = ls.logWriter.Write(ls.errMsgBuffer[0:offset])
+		_, err = ls.logWriter.Write(errMsg)
 		if err != nil {
-			stdErr.Println(string(ls.errMsgBuffer[0:offset]))
+			stdErr.Println(string(errMsg))
 			stdErr.Println(err.Error())
 		}
 	}
 }
 
+// serializeEntry serializes and frames an entry into the supplied buffer,
+// subject to the MaxEntrySize, GrowEntryBuffers, and Framing options.
+func (ls *LogService) serializeEntry(buffer []byte, sc *ServiceContext, lc *LogContext, ld LogDetail, fields []Field) []byte {
+	maxSize := ls.options.MaxEntrySize
+	if ls.options.GrowEntryBuffers {
+		maxSize = 0
+	}
+	buffer = buffer[:0]
+	if ls.options.Framing == FramingLengthPrefix {
+		buffer = append(buffer, 0, 0, 0, 0)
+	}
+	entry := serializeEntry(buffer, maxSize, ls.options.Encoder, sc, lc, ld, fields)
+	switch ls.options.Framing {
+	case FramingNewline:
+		entry = append(entry, '\n')
+	case FramingNUL:
+		entry = append(entry, 0)
+	case FramingLengthPrefix:
+		binary.BigEndian.PutUint32(entry, uint32(len(entry)-4))
+	case FramingOctetCounting:
+		entry = prependOctetCount(entry)
+	}
+	return entry
+}
+
+// prependOctetCount shifts entry along to make room for its length (in
+// decimal) and a space, which are then written at the start of entry.
+func prependOctetCount(entry []byte) []byte {
+	length := len(entry)
+	digits := 1
+	for n := length; n >= 10; n /= 10 {
+		digits++
+	}
+	for i := 0; i <= digits; i++ {
+		entry = append(entry, ' ')
+	}
+	copy(entry[digits+1:], entry[:length])
+	for i, n := digits-1, length; i >= 0; i, n = i-1, n/10 {
+		entry[i] = byte('0' + n%10)
+	}
+	entry[digits] = ' '
+	return entry
+}
+
+// SetLevel changes the lowest LogLevel that will be written by this
+// LogService. SetLevel is safe to call while the LogService is in use, and
+// takes effect for all LogContexts spawned from this LogService.
+func (ls *LogService) SetLevel(level LogLevel) {
+	ls.levels.setLevel(level)
+}
+
+// Level returns the lowest LogLevel currently being written by this
+// LogService. Site specific overrides (see SetSiteLevel) are not reflected.
+func (ls *LogService) Level() LogLevel {
+	return ls.levels.getLevel()
+}
+
+// SetSiteLevel overrides the lowest LogLevel that will be written for all
+// LogContexts with the specified site. The override takes precedence over the
+// level set via SetLevel (or LogServiceOptions.MinLevel) until it is removed
+// via ClearSiteLevel. SetSiteLevel is safe to call while the LogService is in
+// use.
+func (ls *LogService) SetSiteLevel(site string, level LogLevel) {
+	ls.levels.setSiteLevel(escape(site), level)
+}
+
+// ClearSiteLevel removes any override established via SetSiteLevel for the
+// specified site.
+func (ls *LogService) ClearSiteLevel(site string) {
+	ls.levels.clearSiteLevel(escape(site))
+}
+
 // NewContext provides high level structured information used to decorate
 // log messages, and exposes methods for writing at various log levels.
 func (ls *LogService) NewContext(site, operation string) LogContext {
+	buffer := make([]byte, 0, ls.options.MaxEntrySize+maxFramingOverhead)
 	return LogContext{
 		logService: ls,
-		buffer:     make([]byte, initialMsgBufferAllocation),
+		buffer:     &buffer,
 		Site:       escape(site),
 		Operation:  escape(operation),
 	}
 }
 
-// Finish sets a deadline for any concurrent LogContexts to finish sending any
-// remaining messages; then blocks until that deadline has expired.
-// Finish will reset its internal deadline if any messages are received during
-// the waiting period. Finish will only unblock once the full deadline duration
-// has elapsed with no inbound log activity.
+// Finish gives any concurrent LogContexts the CancellationDeadline to finish
+// sending their remaining messages, and then closes the LogService, as for
+// Close, with a context that expires after another CancellationDeadline. That
+// is, once the first deadline has expired, Finish blocks until all in-flight
+// entries have been written (including any queued entries in asynchronous
+// mode), and the writer (if it implements io.Closer) has been closed, or until
+// the second deadline has expired.
 //
 // Finish makes a good faith attempt to flush all inbound messages during the
 // waiting period. However, it remains the host system's responsibility to wind
 // down all components that might be broadcasting logs to LogContexts before
-// calling Finish.
+// calling Finish. Any entries logged after the first deadline are discarded.
 //
-// If the host system continues to send log messages to the log service while
-// Finishing, the log service will either a) never exit because it keeps
-// receiving messages or b) exit before all messages have been processed.
+// Close is preferred over Finish, as it returns as soon as all in-flight
+// entries have been written, and reports any entries that were lost.
 func (ls *LogService) Finish() {
-	deadline := time.Now().Add(ls.options.CancellationDeadline)
-	for {
-		runtime.Gosched()
-		if time.Now().Before(deadline) {
-			continue
+	time.Sleep(ls.options.CancellationDeadline)
+	ctx := context.Background()
+	if ls.options.CancellationDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ls.options.CancellationDeadline)
+		defer cancel()
+	}
+	ls.Close(ctx)
+}
+
+// CloseError is returned by Close if any log entries were lost, or if an
+// error occurred while closing the LogService's writer.
+type CloseError struct {
+	// Lost is the number of entries that were accepted by LogContexts, but
+	// never written. This includes entries that were discarded due to an
+	// asynchronous queue overflow, entries that were still pending when the
+	// Close context expired, and entries that were logged after Close was
+	// called.
+	Lost uint64
+
+	// Err is the underlying error (if any), such as the error from the Close
+	// context, or from closing the writer.
+	Err error
+}
+
+func (e *CloseError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("nobslogger: %d log entries lost", e.Lost)
+	}
+	return fmt.Sprintf("nobslogger: %d log entries lost: %v", e.Lost, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// contextCloser is implemented by writers (such as the batching writers)
+// that can abandon the work remaining at Close once a context is done.
+type contextCloser interface {
+	CloseContext(ctx context.Context) error
+}
+
+// Close stops the LogService from accepting new entries, and blocks until all
+// in-flight entries have been written (including any queued entries in
+// asynchronous mode) or until ctx is done, whichever happens first. If the
+// writer implements io.Closer, it is then closed.
+//
+// Closing the writer is also bounded by ctx. If the writer has a
+// CloseContext(context.Context) error method (as the batching writers, such
+// as OTLPWriter, do), it is called with ctx in place of Close, so that the
+// writer can abandon any requests or retries that are in progress once ctx
+// is done. Otherwise, Close returns once ctx is done, and the writer finishes
+// closing in the background.
+//
+// If ctx is done while entries are still being written, the writer is not
+// closed from under them; instead, it is closed in the background once they
+// have been written.
+//
+// Any entries logged after Close is called are discarded.
+//
+// Close returns nil if every entry was written and the writer (if
+// applicable) closed successfully. Otherwise, Close returns a *CloseError
+// which reports the number of entries that were lost.
+func (ls *LogService) Close(ctx context.Context) error {
+	atomic.StoreInt32(&ls.closed, 1)
+
+	var err error
+	lost := uint64(0)
+	for err == nil && atomic.LoadUint32(&ls.waiters) > 0 {
+		select {
+		case <-ls.drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+			if ls.queue == nil {
+				// In asynchronous mode, in-flight entries are accounted
+				// for by the queue.
+				lost += uint64(atomic.LoadUint32(&ls.waiters))
+			}
 		}
-		if atomic.LoadUint32(&ls.waiters) > 0 {
-			deadline = time.Now().Add(ls.options.CancellationDeadline)
-			continue
+	}
+
+	if ls.queue != nil {
+		ls.queue.close()
+		if err == nil {
+			select {
+			case <-ls.queue.done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
 		}
-		return
+		ls.queue.abandon()
+		lost += atomic.LoadUint64(&ls.queue.dropped)
+	}
+
+	if closer, ok := ls.logWriter.(io.Closer); ok {
+		if err != nil {
+			go func() {
+				ls.awaitIdle()
+				closer.Close()
+			}()
+		} else if closeErr := closeWriter(ctx, closer); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	lost += atomic.LoadUint64(ls.rejected)
+	if lost == 0 && err == nil {
+		return nil
+	}
+	return &CloseError{
+		Lost: lost,
+		Err:  err,
+	}
+}
+
+// awaitIdle blocks until no entries are being written; that is, until every
+// in-flight submission has completed, and (in asynchronous mode) the writer
+// goroutine has exited. awaitIdle must only be called once the LogService has
+// been closed.
+func (ls *LogService) awaitIdle() {
+	for atomic.LoadUint32(&ls.waiters) > 0 {
+		<-ls.drained
+	}
+	if ls.queue != nil {
+		<-ls.queue.done
+	}
+}
+
+// closeWriter closes the writer, giving up once ctx is done (see Close).
+func closeWriter(ctx context.Context, closer io.Closer) error {
+	if c, ok := closer.(contextCloser); ok {
+		return c.CloseContext(ctx)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- closer.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
@@ -1,9 +1,16 @@
 package logger_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -165,8 +172,9 @@ func TestLogServiceEscapesJSON(t *testing.T) {
 // Here we're just verifying that all of the context methods result in a call
 // to the underlaying writer.
 func Test_ContextMethodHappyPath(t *testing.T) {
-	// 6 standard methods, 6 D methods, 6 J methods, and 1 Write method.
-	const numberOfLogMethods = 19
+	// 6 standard methods, 6 D methods, 6 F methods, 6 J methods, and 1 Write
+	// method.
+	const numberOfLogMethods = 25
 
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -175,15 +183,15 @@ func Test_ContextMethodHappyPath(t *testing.T) {
 	writer.EXPECT().Write(gomock.Any()).Return(0, nil).Times(numberOfLogMethods)
 
 	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{})
-	logger := loggerService.NewContext("context site", "operation")
+	log := loggerService.NewContext("context site", "operation")
 
 	plainLogMethods := []func(string){
-		logger.Trace,
-		logger.Info,
-		logger.Debug,
-		logger.Warn,
-		logger.Error,
-		logger.Fatal,
+		log.Trace,
+		log.Info,
+		log.Debug,
+		log.Warn,
+		log.Error,
+		log.Fatal,
 	}
 
 	for _, logMethod := range plainLogMethods {
@@ -191,25 +199,38 @@ func Test_ContextMethodHappyPath(t *testing.T) {
 	}
 
 	detailLogMethods := []func(string, string){
-		logger.TraceD,
-		logger.InfoD,
-		logger.DebugD,
-		logger.WarnD,
-		logger.ErrorD,
-		logger.FatalD,
+		log.TraceD,
+		log.InfoD,
+		log.DebugD,
+		log.WarnD,
+		log.ErrorD,
+		log.FatalD,
 	}
 
 	for _, logMethod := range detailLogMethods {
 		logMethod("test message", "test detail")
 	}
 
+	fieldLogMethods := []func(string, string, ...logger.Field){
+		log.TraceF,
+		log.InfoF,
+		log.DebugF,
+		log.WarnF,
+		log.ErrorF,
+		log.FatalF,
+	}
+
+	for _, logMethod := range fieldLogMethods {
+		logMethod("test message", "test detail", logger.String("test", "field"))
+	}
+
 	jsonLogMethods := []func(string, string){
-		logger.TraceJ,
-		logger.InfoJ,
-		logger.DebugJ,
-		logger.WarnJ,
-		logger.ErrorJ,
-		logger.FatalJ,
+		log.TraceJ,
+		log.InfoJ,
+		log.DebugJ,
+		log.WarnJ,
+		log.ErrorJ,
+		log.FatalJ,
 	}
 
 	for _, logMethod := range jsonLogMethods {
@@ -218,7 +239,683 @@ func Test_ContextMethodHappyPath(t *testing.T) {
 
 	// don't forget to excercise the Write method as well as the other
 	// J methods.
-	logger.Write([]byte("test message"))
+	log.Write([]byte("test message"))
+
+	loggerService.Finish()
+}
+
+// Entries below the LogService's MinLevel must never reach the writer.
+func Test_LogServiceMinLevelFiltersEntries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().Write(gomock.Any()).Return(0, nil).Times(3)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		MinLevel: logger.LogLevelWarn,
+	})
+	logger := loggerService.NewContext("context site", "operation")
+	logger.Trace("dropped")
+	logger.DebugJ("dropped", "dropped")
+	logger.InfoD("dropped", "dropped")
+	logger.Write([]byte("dropped"))
+	logger.Warn("written")
+	logger.ErrorD("written", "written")
+	logger.FatalJ("written", "written")
+	loggerService.Finish()
+}
+
+func Test_LogContextEnabled(t *testing.T) {
+	loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{
+		MinLevel: logger.LogLevelInfo,
+	})
+	log := loggerService.NewContext("context site", "operation")
+
+	testCases := map[logger.LogLevel]bool{
+		logger.LogLevelTrace: false,
+		logger.LogLevelDebug: false,
+		logger.LogLevelInfo:  true,
+		logger.LogLevelWarn:  true,
+		logger.LogLevelError: true,
+		logger.LogLevelFatal: true,
+	}
+	for level, expected := range testCases {
+		if actual := log.Enabled(level); actual != expected {
+			t.Errorf("Enabled(%v): expected %v, got %v", level, expected, actual)
+		}
+	}
+}
+
+func Test_LogServiceSetLevel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().Write(gomock.Any()).Return(0, nil).Times(2)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		MinLevel: logger.LogLevelInfo,
+	})
+	log := loggerService.NewContext("context site", "operation")
 
+	log.Debug("dropped")
+	loggerService.SetLevel(logger.LogLevelDebug)
+	if actual := loggerService.Level(); actual != logger.LogLevelDebug {
+		t.Errorf("expected level %v, got %v", logger.LogLevelDebug, actual)
+	}
+	log.Debug("written")
+	loggerService.SetLevel(logger.LogLevelInfo)
+	log.Debug("dropped")
+	log.Info("written")
 	loggerService.Finish()
 }
+
+func Test_LogServiceSiteLevelOverride(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().Write(gomock.Any()).Return(0, nil).Times(2)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		MinLevel: logger.LogLevelInfo,
+	})
+	noisy := loggerService.NewContext("noisy site", "operation")
+	quiet := loggerService.NewContext("quiet site", "operation")
+
+	loggerService.SetSiteLevel("noisy site", logger.LogLevelTrace)
+	noisy.Trace("written")
+	quiet.Trace("dropped")
+
+	loggerService.ClearSiteLevel("noisy site")
+	noisy.Trace("dropped")
+	quiet.Info("written")
+	loggerService.Finish()
+}
+
+// Level changes must be safe while LogContexts are actively logging.
+func Test_LogServiceSetLevelConcurrently(t *testing.T) {
+	loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{})
+	log := loggerService.NewContext("context site", "operation")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			log.Debug("message")
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		loggerService.SetLevel(logger.LogLevelInfo)
+		loggerService.SetSiteLevel("context site", logger.LogLevelTrace)
+		loggerService.SetLevel(logger.LogLevelDebug)
+		loggerService.ClearSiteLevel("context site")
+	}
+	<-done
+}
+
+// Typed fields must always produce valid JSON with the expected values, even
+// if keys or values contain reserved characters.
+func Test_LogContextFieldsSerializeAsJSON(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	timestamp := time.Date(2009, 1, 20, 12, 5, 0, 0, time.UTC)
+
+	var entry map[string]interface{}
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().Write(gomock.Any()).Times(1).DoAndReturn(
+		func(bb []byte) (int, error) {
+			if err := json.Unmarshal(bb, &entry); err != nil {
+				t.Errorf("Error: %v\nJSON: %s", err, bb)
+			}
+			return len(bb), nil
+		},
+	)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoF("message", "details",
+		logger.String("quoted \"key\"", "line\nbreak\x01"),
+		logger.Int64("int", -42),
+		logger.Float64("float", 1.5),
+		logger.Float64("nan", math.NaN()),
+		logger.Bool("bool", true),
+		logger.Duration("duration", time.Second),
+		logger.Time("time", timestamp),
+	)
+	loggerService.Finish()
+
+	expected := map[string]interface{}{
+		"quoted \"key\"": "line\nbreak\x01",
+		"int":            float64(-42),
+		"float":          1.5,
+		"nan":            "NaN",
+		"bool":           true,
+		"duration":       float64(time.Second),
+		"time":           "2009-01-20T12:05:00Z",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("field %q: expected %v, got %v", key, value, entry[key])
+		}
+	}
+}
+
+func Test_LogContextFieldsDoNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{})
+	log := loggerService.NewContext("context site", "operation")
+	timestamp := time.Now()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		log.InfoF("message", "details",
+			logger.String("string", "value"),
+			logger.Int64("int", 42),
+			logger.Float64("float", 1.5),
+			logger.Bool("bool", true),
+			logger.Duration("duration", time.Second),
+			logger.Time("time", timestamp),
+		)
+	})
+	if allocs != 0 {
+		t.Errorf("expected 0 allocations, got %v", allocs)
+	}
+}
+
+// With must not allocate an entry buffer for each child, as a child context is
+// typically created per request. Entries logged by the child must be
+// serialized into the parent's buffer.
+func Test_LogContextWithSharesBuffer(t *testing.T) {
+	var buffers []*byte
+	writer := writerFunc(func(bb []byte) (int, error) {
+		buffers = append(buffers, &bb[0])
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("message")
+	child := log.With(logger.String("request_id", "r-1"))
+	child.Info("message")
+	grandchild := child.With(logger.String("user", "u-1"))
+	grandchild.Info("message")
+
+	if len(buffers) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(buffers))
+	}
+	if buffers[1] != buffers[0] || buffers[2] != buffers[0] {
+		t.Error("expected child contexts to serialize entries into the parent's buffer")
+	}
+}
+
+// Fields attached via With must be inherited by grandchildren, and must not
+// leak back into the parent context.
+func Test_LogContextWithInheritsFields(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var entries []map[string]interface{}
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().Write(gomock.Any()).Times(3).DoAndReturn(
+		func(bb []byte) (int, error) {
+			entry := map[string]interface{}{}
+			if err := json.Unmarshal(bb, &entry); err != nil {
+				t.Errorf("Error: %v\nJSON: %s", err, bb)
+			}
+			entries = append(entries, entry)
+			return len(bb), nil
+		},
+	)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{})
+	parent := loggerService.NewContext("context site", "operation")
+	child := parent.With(logger.String("request_id", "r-1"))
+	grandchild := child.With(logger.Int64("attempt", 2))
+
+	parent.Info("parent")
+	child.Info("child")
+	grandchild.Info("grandchild")
+	loggerService.Finish()
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(entries))
+	}
+	if _, ok := entries[0]["request_id"]; ok {
+		t.Error("parent entry unexpectedly carries child fields")
+	}
+	if entries[1]["request_id"] != "r-1" {
+		t.Errorf("child entry: expected request_id r-1, got %v", entries[1]["request_id"])
+	}
+	if _, ok := entries[1]["attempt"]; ok {
+		t.Error("child entry unexpectedly carries grandchild fields")
+	}
+	if entries[2]["request_id"] != "r-1" || entries[2]["attempt"] != float64(2) {
+		t.Errorf("grandchild entry: unexpected fields %v", entries[2])
+	}
+	if entries[2]["site"] != "context site" || entries[2]["operation"] != "operation" {
+		t.Errorf("grandchild entry: unexpected site/operation %v", entries[2])
+	}
+}
+
+// Entries larger than the MaxEntrySize must be truncated to valid JSON rather
+// than panicking, and must be flagged as truncated.
+func Test_LogServiceTruncatesLargeEntries(t *testing.T) {
+	testCases := []struct {
+		name         string
+		maxEntrySize int
+		message      string
+		details      string
+		fields       []logger.Field
+	}{
+		{
+			name:    "details exceed default buffer",
+			message: "message",
+			details: strings.Repeat("d", 70*1024),
+		},
+		{
+			name:    "message exceeds default buffer",
+			message: strings.Repeat("m", 70*1024),
+			details: strings.Repeat("d", 70*1024),
+		},
+		{
+			name:         "escape sequences are not split",
+			maxEntrySize: 300,
+			message:      "message",
+			details:      strings.Repeat(`\"`, 200),
+		},
+		{
+			name:         "runes are not split",
+			maxEntrySize: 301,
+			message:      "message",
+			details:      strings.Repeat("é", 200),
+		},
+		{
+			name:         "oversized fields are dropped",
+			maxEntrySize: 512,
+			message:      "message",
+			details:      "details",
+			fields:       []logger.Field{logger.String("big", strings.Repeat("f", 1024))},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			maxEntrySize := tc.maxEntrySize
+			if maxEntrySize == 0 {
+				maxEntrySize = 64 * 1024
+			}
+
+			var entry map[string]interface{}
+			writer := writerFunc(func(bb []byte) (int, error) {
+				if len(bb) > maxEntrySize {
+					t.Errorf("expected at most %v bytes, got %v", maxEntrySize, len(bb))
+				}
+				if err := json.Unmarshal(bb, &entry); err != nil {
+					t.Errorf("Error: %v\nJSON: %s", err, bb)
+				}
+				return len(bb), nil
+			})
+
+			loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+				MaxEntrySize: tc.maxEntrySize,
+			})
+			log := loggerService.NewContext("context site", "operation")
+			log.InfoF(tc.message, tc.details, tc.fields...)
+
+			if entry["truncated"] != true {
+				t.Errorf("expected entry to be marked as truncated, got %v", entry)
+			}
+		})
+	}
+}
+
+// Entries that fit within the MaxEntrySize must never be altered.
+func Test_LogServiceDoesNotTruncateSmallEntries(t *testing.T) {
+	var entry map[string]interface{}
+	writer := writerFunc(func(bb []byte) (int, error) {
+		if err := json.Unmarshal(bb, &entry); err != nil {
+			t.Errorf("Error: %v\nJSON: %s", err, bb)
+		}
+		return len(bb), nil
+	})
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		MaxEntrySize: 1024,
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoD("message", "details")
+
+	if _, ok := entry["truncated"]; ok {
+		t.Errorf("expected entry not to be marked as truncated, got %v", entry)
+	}
+	if entry["msg"] != "message" || entry["details"] != "details" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+// With GrowEntryBuffers, large entries must be written in full.
+func Test_LogServiceGrowEntryBuffers(t *testing.T) {
+	details := strings.Repeat("d", 200*1024)
+
+	var entry map[string]interface{}
+	writer := writerFunc(func(bb []byte) (int, error) {
+		if err := json.Unmarshal(bb, &entry); err != nil {
+			t.Errorf("Error: %v\nJSON: %s", err, bb)
+		}
+		return len(bb), nil
+	})
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		GrowEntryBuffers: true,
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoD("message", details)
+	log.InfoD("message", details)
+
+	if _, ok := entry["truncated"]; ok {
+		t.Error("expected entry not to be marked as truncated")
+	}
+	if entry["details"] != details {
+		t.Errorf("expected details to be written in full, got %v bytes", len(entry["details"].(string)))
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (fn writerFunc) Write(bb []byte) (int, error) {
+	return fn(bb)
+}
+
+// entryWriter returns a writer that decodes each entry that it receives as a
+// JSON object, and a function that returns the most recent entry.
+func entryWriter(t *testing.T) (writerFunc, func() map[string]interface{}) {
+	var entry map[string]interface{}
+	writer := writerFunc(func(bb []byte) (int, error) {
+		entry = map[string]interface{}{}
+		if err := json.Unmarshal(bb, &entry); err != nil {
+			t.Errorf("Error: %v\nJSON: %s", err, bb)
+		}
+		return len(bb), nil
+	})
+	return writer, func() map[string]interface{} { return entry }
+}
+
+type closeRecorder struct {
+	io.Writer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// Close must return as soon as there is nothing in flight, rather than waiting
+// out the CancellationDeadline, and must close the writer.
+func Test_LogServiceCloseReturnsPromptly(t *testing.T) {
+	writer := &closeRecorder{Writer: ioutil.Discard}
+	loggerService := logger.InitializeWriter(writer, logger.ServiceContext{})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("message")
+
+	start := time.Now()
+	if err := loggerService.Close(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close to return promptly, took %v", elapsed)
+	}
+	if !writer.closed {
+		t.Error("expected writer to be closed")
+	}
+}
+
+// Finish must not wait indefinitely for an entry that is still being
+// written.
+func Test_LogServiceFinishIsBounded(t *testing.T) {
+	writer := newBlockingWriter()
+	defer close(writer.release)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		CancellationDeadline: 10 * time.Millisecond,
+	})
+	log := loggerService.NewContext("context site", "operation")
+	go log.Info("message")
+	<-writer.started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loggerService.Finish()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Finish to return once the deadline expired")
+	}
+}
+
+// Entries logged after Close must not reach the writer.
+func Test_LogServiceCloseRejectsNewEntries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	writer := mock_io.NewMockWriter(ctrl)
+	writer.EXPECT().Write(gomock.Any()).Times(0)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{})
+	log := loggerService.NewContext("context site", "operation")
+	if err := loggerService.Close(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	log.Info("message")
+}
+
+// If the Close context expires before queued entries are written, Close must
+// report how many entries were lost.
+func Test_LogServiceCloseReportsLostEntries(t *testing.T) {
+	writer := newBlockingWriter()
+	defer close(writer.release)
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		AsyncQueueSize: 10,
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("1")
+	<-writer.started
+	log.Info("2")
+	log.Info("3")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := loggerService.Close(ctx)
+
+	var closeErr *logger.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("expected a CloseError, got %v", err)
+	}
+	if closeErr.Lost != 2 {
+		t.Errorf("expected 2 lost entries, got %v", closeErr.Lost)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// slowCloser is a writer whose Close blocks until it is released.
+type slowCloser struct {
+	io.Writer
+	release chan struct{}
+}
+
+func (c *slowCloser) Close() error {
+	<-c.release
+	return nil
+}
+
+// Close must not wait on the writer's Close once its context has expired.
+func Test_LogServiceCloseBoundsWriterClose(t *testing.T) {
+	writer := &slowCloser{Writer: ioutil.Discard, release: make(chan struct{})}
+	defer close(writer.release)
+
+	loggerService := logger.InitializeWriter(writer, logger.ServiceContext{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := loggerService.Close(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close to return promptly, took %v", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// blockingCloser is a blockingWriter that records when it is closed.
+type blockingCloser struct {
+	*blockingWriter
+	closed chan struct{}
+}
+
+func (c *blockingCloser) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// If the Close context expires while an entry is still being written, the
+// writer must not be closed until that write has returned.
+func Test_LogServiceCloseAwaitsInFlightWrites(t *testing.T) {
+	writer := &blockingCloser{blockingWriter: newBlockingWriter(), closed: make(chan struct{})}
+
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		AsyncQueueSize: 10,
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("message")
+	<-writer.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := loggerService.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", err)
+	}
+
+	select {
+	case <-writer.closed:
+		t.Fatal("expected writer not to be closed while a write is in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(writer.release)
+	select {
+	case <-writer.closed:
+	case <-time.After(time.Second):
+		t.Error("expected writer to be closed once the write returned")
+	}
+}
+
+func Test_LogServiceFraming(t *testing.T) {
+	testCases := []struct {
+		name    string
+		framing logger.Framing
+		unframe func(t *testing.T, bb []byte) []byte
+	}{
+		{
+			name:    "none",
+			framing: logger.FramingNone,
+			unframe: func(t *testing.T, bb []byte) []byte { return bb },
+		},
+		{
+			name:    "newline",
+			framing: logger.FramingNewline,
+			unframe: func(t *testing.T, bb []byte) []byte {
+				if bb[len(bb)-1] != '\n' {
+					t.Errorf("expected entry to end with a newline: %q", bb)
+				}
+				return bb[:len(bb)-1]
+			},
+		},
+		{
+			name:    "nul",
+			framing: logger.FramingNUL,
+			unframe: func(t *testing.T, bb []byte) []byte {
+				if bb[len(bb)-1] != 0 {
+					t.Errorf("expected entry to end with a NUL byte: %q", bb)
+				}
+				return bb[:len(bb)-1]
+			},
+		},
+		{
+			name:    "length prefix",
+			framing: logger.FramingLengthPrefix,
+			unframe: func(t *testing.T, bb []byte) []byte {
+				length := binary.BigEndian.Uint32(bb)
+				if int(length) != len(bb)-4 {
+					t.Errorf("expected length prefix of %v, got %v", len(bb)-4, length)
+				}
+				return bb[4:]
+			},
+		},
+		{
+			name:    "octet counting",
+			framing: logger.FramingOctetCounting,
+			unframe: func(t *testing.T, bb []byte) []byte {
+				space := bytes.IndexByte(bb, ' ')
+				length, err := strconv.Atoi(string(bb[:space]))
+				if err != nil || length != len(bb)-space-1 {
+					t.Errorf("expected octet count of %v, got %q", len(bb)-space-1, bb[:space])
+				}
+				return bb[space+1:]
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writer := writerFunc(func(bb []byte) (int, error) {
+				entry := map[string]interface{}{}
+				if err := json.Unmarshal(tc.unframe(t, bb), &entry); err != nil {
+					t.Errorf("Error: %v\nJSON: %q", err, bb)
+				}
+				return len(bb), nil
+			})
+
+			loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+				Framing: tc.framing,
+			})
+			log := loggerService.NewContext("context site", "operation")
+			log.Info("message")
+			log.InfoD("message", strings.Repeat("d", 70*1024))
+		})
+	}
+}
+
+func Test_LogServiceFramingZeroAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	framings := []logger.Framing{
+		logger.FramingNone,
+		logger.FramingNewline,
+		logger.FramingNUL,
+		logger.FramingLengthPrefix,
+		logger.FramingOctetCounting,
+	}
+	for _, framing := range framings {
+		loggerService := logger.InitializeWriterWithOptions(ioutil.Discard, logger.ServiceContext{}, logger.LogServiceOptions{
+			Framing: framing,
+		})
+		log := loggerService.NewContext("context site", "operation")
+		allocs := testing.AllocsPerRun(100, func() {
+			log.Info("message")
+		})
+		if allocs != 0 {
+			t.Errorf("framing %v: expected 0 allocations, got %v", framing, allocs)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// lokiPushPath is the path of the Loki push API.
+const lokiPushPath = "/loki/api/v1/push"
+
+// LokiOptions exposes configuration settings for Loki output.
+type LokiOptions struct {
+	// Encoder determines the format of each log line. The default is
+	// NewJSONEncoder, which permits lines to be parsed with LogQL's json
+	// parser. NewLogfmtEncoder is also well suited to Loki.
+	Encoder Encoder
+
+	// Gzip compresses each request.
+	Gzip bool
+
+	// TenantID, if set, is sent as the X-Scope-OrgID header, which selects
+	// the tenant in a multi-tenant Loki.
+	TenantID string
+
+	// Headers are added to every push request (i.e. for authentication).
+	Headers map[string]string
+
+	// BatchSize is the most entries that are pushed in a single request.
+	// Defaults to 512.
+	BatchSize int
+
+	// FlushInterval is the longest that an entry is held before it is
+	// pushed. Defaults to 1s.
+	FlushInterval time.Duration
+
+	// MaxRetries limits the retries of each push (see the package doc).
+	MaxRetries int
+
+	// MinBackoff is the delay before the first retry (see the package doc).
+	MinBackoff time.Duration
+
+	// MaxBackoff is the longest delay between retries (see the package doc).
+	MaxBackoff time.Duration
+
+	// Client is used to send push requests. Defaults to an http.Client with
+	// a 10s timeout.
+	Client *http.Client
+
+	// ErrorHandler is passed each entry that can't be pushed (see the package doc).
+	ErrorHandler ErrorHandler
+}
+
+// InitializeLoki establishes a logging service that pushes entries to Grafana
+// Loki, and returns a LogService instance through which more detailed
+// logging contexts can be spawned (see NewContext).
+//
+// Entries are grouped into streams labelled by environment, system_name,
+// service_name (from the ServiceContext), and severity. These are all low
+// cardinality, as Loki requires; higher cardinality values (such as the
+// ServiceInstanceID, site, and operation) are only written to the log line.
+// Empty labels are omitted.
+//
+// Entries are pushed in batches. See LokiWriter.
+//
+// An error is returned if endpoint is malformed.
+//
+// endpoint: Must be the URL of the Loki server, i.e. http://loki:3100. If
+// the URL has no path, the push API path (/loki/api/v1/push) is appended.
+func InitializeLoki(endpoint string, serviceContext ServiceContext) (LogService, error) {
+	return InitializeLokiWithOptions(endpoint, serviceContext, defaultLogServiceOptions(), LokiOptions{})
+}
+
+// InitializeLokiWithOptions is the same as InitializeLoki, but with custom
+// LogServiceOptions and LokiOptions supplied. The Framing and Encoder options
+// are ignored; the format of log lines is determined by LokiOptions.Encoder.
+// See InitializeLoki.
+func InitializeLokiWithOptions(endpoint string, serviceContext ServiceContext, options LogServiceOptions, lokiOptions LokiOptions) (LogService, error) {
+	if lokiOptions.ErrorHandler == nil {
+		lokiOptions.ErrorHandler = batchErrorHandler(options)
+	}
+	w, err := NewLokiWriter(endpoint, serviceContext, lokiOptions)
+	if err != nil {
+		return LogService{}, err
+	}
+	options.Framing = FramingNone
+	options.Encoder = NewLokiEncoder(lokiOptions)
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// lokiEncoder prefixes each line, as encoded by another encoder, with the
+// entry's severity and timestamp, which the LokiWriter extracts.
+type lokiEncoder struct {
+	line Encoder
+}
+
+// NewLokiEncoder returns an Encoder that encodes entries for a LokiWriter
+// (see InitializeLoki). Only the Encoder option is used.
+//
+// Each entry is encoded as its severity and timestamp, followed by the log
+// line, so entries that are written by this encoder are only of use to a
+// LokiWriter.
+func NewLokiEncoder(options LokiOptions) Encoder {
+	if options.Encoder == nil {
+		options.Encoder = NewJSONEncoder()
+	}
+	return &lokiEncoder{
+		line: options.Encoder,
+	}
+}
+
+func (e *lokiEncoder) begin(buffer []byte, r record) []byte {
+	buffer = append(buffer, r.detail.Severity...)
+	buffer = append(buffer, 0)
+	buffer = strconv.AppendInt(buffer, r.unixNano(), 10)
+	buffer = append(buffer, 0)
+	return e.line.begin(buffer, r)
+}
+
+func (e *lokiEncoder) field(buffer []byte, f Field) []byte {
+	return e.line.field(buffer, f)
+}
+
+func (e *lokiEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	return e.line.end(buffer, r, truncated)
+}
+
+// lokiEntry is an entry that has been split into its parts.
+type lokiEntry struct {
+	severity  []byte
+	timestamp []byte
+	line      []byte
+}
+
+// splitLokiEntry splits an entry written by the Loki encoder.
+func splitLokiEntry(entry []byte) lokiEntry {
+	severityEnd := bytes.IndexByte(entry, 0)
+	if severityEnd < 0 {
+		return lokiEntry{line: entry}
+	}
+	timestampEnd := severityEnd + 1 + bytes.IndexByte(entry[severityEnd+1:], 0)
+	if timestampEnd <= severityEnd {
+		return lokiEntry{severity: entry[:severityEnd], line: entry[severityEnd+1:]}
+	}
+	return lokiEntry{
+		severity:  entry[:severityEnd],
+		timestamp: entry[severityEnd+1 : timestampEnd],
+		line:      entry[timestampEnd+1:],
+	}
+}
+
+// LokiWriter is an io.WriteCloser that pushes entries to Grafana Loki.
+// Entries must be encoded by the encoder returned by NewLokiEncoder.
+//
+// Entries are accumulated, and pushed in batches of up to BatchSize entries,
+// at least every FlushInterval. Within each push, entries are grouped into
+// one stream per severity. Pushes run in the background, so Write never
+// waits for Loki; if Loki falls behind, and several full batches are already
+// awaiting a push, Write returns ErrBufferFull. The entries of batches that
+// can't be pushed are passed to the ErrorHandler, and the error is returned
+// by the next call to Flush or Close.
+//
+// Pushes that fail with a network error, a 429, or a 5xx response are retried
+// in the background with backoff (or after the delay that is requested by a
+// Retry-After header), up to MaxRetries times, after which the batch is
+// discarded. Pushes that fail with any other response are not retried, as
+// they would fail again. Retries are abandoned if the context passed to
+// CloseContext is done.
+type LokiWriter struct {
+	endpoint   string
+	header     http.Header
+	client     *http.Client
+	maxRetries int
+	batch      *batcher
+
+	// labels is the JSON fragment of the labels taken from the
+	// ServiceContext, which are common to every stream.
+	labels []byte
+
+	// The following are only accessed while flushing, which the batcher
+	// serializes.
+	backoff    *backoff
+	entries    []lokiEntry
+	severities [][]byte
+	body       []byte
+	gzip       *gzip.Writer
+	compressed bytes.Buffer
+}
+
+// NewLokiWriter returns a LokiWriter that pushes entries to endpoint (see
+// InitializeLoki). The ServiceContext is used to label every stream.
+//
+// An error is returned if endpoint is malformed.
+func NewLokiWriter(endpoint string, serviceContext ServiceContext, options LokiOptions) (*LokiWriter, error) {
+	if err := validateHTTPEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	if u, _ := url.Parse(endpoint); u.Path == "" || u.Path == "/" {
+		u.Path = lokiPushPath
+		endpoint = u.String()
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	options.MaxRetries = retryLimit(options.MaxRetries)
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	w := &LokiWriter{
+		endpoint:   endpoint,
+		header:     newHTTPHeader("application/json", options.Headers),
+		client:     options.Client,
+		maxRetries: options.MaxRetries,
+		backoff:    newBackoff(options.MinBackoff, options.MaxBackoff),
+	}
+	if options.TenantID != "" {
+		w.header.Set("X-Scope-OrgID", options.TenantID)
+	}
+	if options.Gzip {
+		w.header.Set("Content-Encoding", "gzip")
+		w.gzip = gzip.NewWriter(nil)
+	}
+	labels := []struct{ name, value string }{
+		{"environment", serviceContext.Environment},
+		{"system_name", serviceContext.SystemName},
+		{"service_name", serviceContext.ServiceName},
+	}
+	for _, label := range labels {
+		if label.value == "" {
+			continue
+		}
+		if len(w.labels) > 0 {
+			w.labels = append(w.labels, fieldSeparatorToken...)
+		}
+		w.labels = append(w.labels, quoteToken...)
+		w.labels = append(w.labels, label.name...)
+		w.labels = append(w.labels, fieldKeyCloseToken...)
+		w.labels = append(w.labels, quoteToken...)
+		w.labels = serializeEscaped(w.labels, label.value)
+		w.labels = append(w.labels, quoteToken...)
+	}
+	w.batch = newBatcher(options.BatchSize, options.FlushInterval, w.push, options.ErrorHandler)
+	return w, nil
+}
+
+// Write adds an entry to the current batch, pushing the batch if it is full.
+func (w *LokiWriter) Write(p []byte) (int, error) {
+	return w.batch.Write(p)
+}
+
+// Flush pushes the current batch, if any.
+func (w *LokiWriter) Flush() error {
+	return w.batch.Flush()
+}
+
+// Close pushes the current batch, if any, and stops the periodic pushes.
+// Writes after Close return ErrWriterClosed.
+func (w *LokiWriter) Close() error {
+	return w.batch.Close()
+}
+
+// CloseContext is the same as Close, but if ctx is done before the remaining
+// batches have been pushed, the push in progress is abandoned, and the
+// remaining batches are discarded.
+func (w *LokiWriter) CloseContext(ctx context.Context) error {
+	return w.batch.CloseContext(ctx)
+}
+
+// push groups a batch of entries into streams by severity, and sends them to
+// Loki.
+func (w *LokiWriter) push(ctx context.Context, entries [][]byte) error {
+	w.entries = w.entries[:0]
+	w.severities = w.severities[:0]
+	for _, entry := range entries {
+		e := splitLokiEntry(entry)
+		w.entries = append(w.entries, e)
+		found := false
+		for _, severity := range w.severities {
+			if bytes.Equal(severity, e.severity) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			w.severities = append(w.severities, e.severity)
+		}
+	}
+
+	w.body = append(w.body[:0], `{"streams":[`...)
+	for i, severity := range w.severities {
+		if i > 0 {
+			w.body = append(w.body, fieldSeparatorToken...)
+		}
+		w.body = append(w.body, `{"stream":{`...)
+		w.body = append(w.body, w.labels...)
+		if len(severity) > 0 {
+			if len(w.labels) > 0 {
+				w.body = append(w.body, fieldSeparatorToken...)
+			}
+			w.body = append(w.body, `"severity":"`...)
+			w.body = serializeEscaped(w.body, string(severity))
+			w.body = append(w.body, quoteToken...)
+		}
+		w.body = append(w.body, `},"values":[`...)
+		first := true
+		for _, e := range w.entries {
+			if !bytes.Equal(e.severity, severity) {
+				continue
+			}
+			if !first {
+				w.body = append(w.body, fieldSeparatorToken...)
+			}
+			first = false
+			w.body = append(w.body, `["`...)
+			if len(e.timestamp) > 0 {
+				w.body = append(w.body, e.timestamp...)
+			} else {
+				w.body = strconv.AppendInt(w.body, time.Now().UnixNano(), 10)
+			}
+			w.body = append(w.body, `","`...)
+			w.body = serializeEscaped(w.body, string(e.line))
+			w.body = append(w.body, `"]`...)
+		}
+		w.body = append(w.body, "]}"...)
+	}
+	w.body = append(w.body, "]}"...)
+
+	body := w.body
+	if w.gzip != nil {
+		w.compressed.Reset()
+		w.gzip.Reset(&w.compressed)
+		if _, err := w.gzip.Write(w.body); err != nil {
+			return err
+		}
+		if err := w.gzip.Close(); err != nil {
+			return err
+		}
+		body = w.compressed.Bytes()
+	}
+	return postHTTPWithRetry(ctx, w.client, w.endpoint, w.header, body, w.maxRetries, w.backoff)
+}
@@ -0,0 +1,305 @@
+package logger_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// lokiPush is a decoded push request.
+type lokiPush struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][]string        `json:"values"`
+	} `json:"streams"`
+}
+
+func decodeLokiPush(t *testing.T, request collectorRequest) lokiPush {
+	body := request.body
+	if request.header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var push lokiPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		t.Fatalf("Error: %v\nJSON: %s", err, body)
+	}
+	return push
+}
+
+func Test_LokiStreams(t *testing.T) {
+	server, requests := startCollector(t, http.StatusNoContent)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeLokiWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{}, logger.LokiOptions{
+		Gzip:      true,
+		TenantID:  "tenant",
+		BatchSize: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	log.Info("first")
+	log.ErrorF("second", "", logger.Int64("user", 42))
+	log.Info("third")
+
+	request := receiveRequest(t, requests)
+	if request.path != "/loki/api/v1/push" {
+		t.Errorf("expected the push path, got %v", request.path)
+	}
+	if tenant := request.header.Get("X-Scope-OrgID"); tenant != "tenant" {
+		t.Errorf("expected tenant header, got %v", tenant)
+	}
+	push := decodeLokiPush(t, request)
+	if len(push.Streams) != 2 {
+		t.Fatalf("expected 2 streams, got %+v", push)
+	}
+
+	expectedLabels := map[string]string{"environment": "test", "system_name": "system", "service_name": "billing", "severity": "info"}
+	if !reflect.DeepEqual(push.Streams[0].Stream, expectedLabels) {
+		t.Errorf("expected labels %v, got %v", expectedLabels, push.Streams[0].Stream)
+	}
+	if severity := push.Streams[1].Stream["severity"]; severity != "error" {
+		t.Errorf("expected the second stream to be error, got %v", severity)
+	}
+
+	messages := []string{}
+	for _, stream := range push.Streams {
+		for _, value := range stream.Values {
+			nanoseconds, err := strconv.ParseInt(value[0], 10, 64)
+			if age := time.Since(time.Unix(0, nanoseconds)); err != nil || age < -time.Second || age > time.Minute {
+				t.Errorf("unexpected timestamp: %v", value[0])
+			}
+			var line map[string]interface{}
+			if err := json.Unmarshal([]byte(value[1]), &line); err != nil {
+				t.Fatalf("Error: %v\nJSON: %s", err, value[1])
+			}
+			messages = append(messages, line["msg"].(string))
+			if line["msg"] == "second" && line["user"] != float64(42) {
+				t.Errorf("expected fields in the line, got %v", line)
+			}
+		}
+	}
+	if expected := []string{"first", "third", "second"}; !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected %v, got %v", expected, messages)
+	}
+}
+
+func Test_LokiLogfmtLines(t *testing.T) {
+	server, requests := startCollector(t, http.StatusNoContent)
+	defer server.Close()
+
+	w, err := logger.NewLokiWriter(server.URL+"/custom/push", logger.ServiceContext{}, logger.LokiOptions{
+		Encoder: logger.NewLogfmtEncoder(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	loggerService := logger.InitializeWriterWithOptions(w, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewLokiEncoder(logger.LokiOptions{Encoder: logger.NewLogfmtEncoder()}),
+	})
+	log := loggerService.NewContext("site", "operation")
+	log.Warn("message")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := receiveRequest(t, requests)
+	if request.path != "/custom/push" {
+		t.Errorf("expected the custom path, got %v", request.path)
+	}
+	push := decodeLokiPush(t, request)
+	if labels := push.Streams[0].Stream; !reflect.DeepEqual(labels, map[string]string{"severity": "warn"}) {
+		t.Errorf("expected empty labels to be omitted, got %v", labels)
+	}
+	if line := push.Streams[0].Values[0][1]; !bytes.Contains([]byte(line), []byte(" msg=message ")) {
+		t.Errorf("expected a logfmt line, got %v", line)
+	}
+}
+
+func Test_LokiRetry(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   int
+		attempts int32
+	}{
+		{"too many requests", http.StatusTooManyRequests, 3},
+		{"server error", http.StatusBadGateway, 3},
+		{"bad request", http.StatusBadRequest, 1},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) < 3 {
+					w.WriteHeader(testCase.status)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			w, err := logger.NewLokiWriter(server.URL, syslogServiceContext, logger.LokiOptions{
+				MinBackoff: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeWriter(w)
+			w.Write([]byte("info\x000\x00line"))
+			err = w.Flush()
+			if actual := atomic.LoadInt32(&attempts); actual != testCase.attempts {
+				t.Errorf("expected %v attempts, got %v", testCase.attempts, actual)
+			}
+			if (err != nil) != (testCase.status == http.StatusBadRequest) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// Retries must run in the background, rather than blocking the entry that
+// filled the batch.
+func Test_LokiRetryDoesNotBlockLogging(t *testing.T) {
+	server, requests := startCollector(t, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeLokiWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{}, logger.LokiOptions{
+		BatchSize:  1,
+		MinBackoff: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	start := time.Now()
+	log.Info("first")
+	receiveRequest(t, requests)
+	log.Info("second")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected logging to continue during retries, took %v", elapsed)
+	}
+}
+
+// MaxRetries must be passed through to the retry helper (see Test_Retry).
+func Test_LokiMaxRetries(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	w, err := logger.NewLokiWriter(server.URL, syslogServiceContext, logger.LokiOptions{
+		MaxRetries: 1,
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte("info\x000\x00line"))
+	if err := w.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+	if actual := atomic.LoadInt32(&attempts); actual != 2 {
+		t.Errorf("expected 2 attempts, got %v", actual)
+	}
+}
+
+// A push that is rate limited must not be retried before the delay requested
+// by the Retry-After header.
+func Test_LokiRetryAfter(t *testing.T) {
+	testCases := []struct {
+		name       string
+		retryAfter func() string
+	}{
+		{"seconds", func() string { return "1" }},
+		{"date", func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			attempts := make(chan time.Time, 2)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts <- time.Now()
+				if len(attempts) == 1 {
+					w.Header().Set("Retry-After", testCase.retryAfter())
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			w, err := logger.NewLokiWriter(server.URL, syslogServiceContext, logger.LokiOptions{
+				MinBackoff: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeWriter(w)
+			w.Write([]byte("info\x000\x00line"))
+			if err := w.Flush(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			first, second := <-attempts, <-attempts
+			if delay := second.Sub(first); delay < 900*time.Millisecond {
+				t.Errorf("expected the retry to wait for Retry-After, waited %v", delay)
+			}
+		})
+	}
+}
+
+// CloseContext must abandon a retry that is waiting out its backoff once its
+// context is done.
+func Test_LokiCloseContextStopsRetries(t *testing.T) {
+	server, requests := startCollector(t, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	w, err := logger.NewLokiWriter(server.URL, syslogServiceContext, logger.LokiOptions{
+		BatchSize:  1,
+		MinBackoff: time.Minute,
+		MaxBackoff: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("info\x000\x00line"))
+	receiveRequest(t, requests)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := w.CloseContext(ctx); err == nil {
+		t.Error("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected CloseContext to return promptly, took %v", elapsed)
+	}
+}
+
+func Test_LokiMalformedEndpoint(t *testing.T) {
+	if _, err := logger.InitializeLoki("loki:3100", syslogServiceContext); err == nil {
+		t.Error("expected an error")
+	}
+}
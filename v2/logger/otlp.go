@@ -0,0 +1,538 @@
+package logger
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OTLPProtocol determines how batches of entries are encoded when they are
+// exported via OTLP/HTTP.
+type OTLPProtocol int
+
+// OTLPProtocol constants.
+const (
+	// OTLPProtocolProtobuf encodes batches as binary protobuf messages. This
+	// is the default, as recommended by the OTLP specification.
+	OTLPProtocolProtobuf OTLPProtocol = iota
+
+	// OTLPProtocolJSON encodes batches as JSON.
+	OTLPProtocolJSON
+)
+
+// OTLPOptions exposes configuration settings for OTLP output.
+type OTLPOptions struct {
+	// Protocol determines how batches are encoded. The default is
+	// OTLPProtocolProtobuf.
+	Protocol OTLPProtocol
+
+	// Headers are added to every export request (i.e. for authentication).
+	Headers map[string]string
+
+	// BatchSize is the most entries that are exported in a single request.
+	// Defaults to 512.
+	BatchSize int
+
+	// FlushInterval is the longest that an entry is held before it is
+	// exported. Defaults to 1s.
+	FlushInterval time.Duration
+
+	// Client is used to send export requests. Defaults to an http.Client
+	// with a 10s timeout.
+	Client *http.Client
+
+	// ErrorHandler is passed each entry that can't be exported (see the package doc).
+	ErrorHandler ErrorHandler
+}
+
+// InitializeOTLP establishes a logging service that exports entries to an
+// OpenTelemetry collector via OTLP/HTTP, and returns a LogService instance
+// through which more detailed logging contexts can be spawned (see
+// NewContext).
+//
+// Each entry is mapped onto the OpenTelemetry log data model. The
+// ServiceContext is written as the resource attributes service.name,
+// service.namespace (the system name), service.instance.id, and
+// deployment.environment. The site is written as the instrumentation scope,
+// the LogLevel is mapped onto a SeverityNumber, and the message is written as
+// the body. The operation, details, and any fields are written as attributes.
+//
+// Entries are exported in batches. See OTLPWriter.
+//
+// An error is returned if endpoint is malformed.
+//
+// endpoint: Must be the full URL of the collector's logs endpoint, i.e.
+// http://localhost:4318/v1/logs.
+func InitializeOTLP(endpoint string, serviceContext ServiceContext) (LogService, error) {
+	return InitializeOTLPWithOptions(endpoint, serviceContext, defaultLogServiceOptions(), OTLPOptions{})
+}
+
+// InitializeOTLPWithOptions is the same as InitializeOTLP, but with custom
+// LogServiceOptions and OTLPOptions supplied. The Framing and Encoder options
+// are ignored. See InitializeOTLP.
+func InitializeOTLPWithOptions(endpoint string, serviceContext ServiceContext, options LogServiceOptions, otlpOptions OTLPOptions) (LogService, error) {
+	if otlpOptions.ErrorHandler == nil {
+		otlpOptions.ErrorHandler = batchErrorHandler(options)
+	}
+	w, err := NewOTLPWriter(endpoint, serviceContext, otlpOptions)
+	if err != nil {
+		return LogService{}, err
+	}
+	options.Framing = FramingNone
+	options.Encoder = NewOTLPEncoder(otlpOptions)
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// otlpEncoder encodes entries as OTLP ScopeLogs, each holding a single
+// LogRecord.
+type otlpEncoder struct {
+	protobuf bool
+}
+
+// NewOTLPEncoder returns an Encoder that encodes entries for an OTLPWriter
+// (see InitializeOTLP). Only the Protocol option is used.
+//
+// Each entry is encoded as a fragment of an OTLP request, rather than a
+// complete request, so entries that are written by this encoder are only of
+// use to an OTLPWriter.
+func NewOTLPEncoder(options OTLPOptions) Encoder {
+	return &otlpEncoder{
+		protobuf: options.Protocol == OTLPProtocolProtobuf,
+	}
+}
+
+func (e *otlpEncoder) begin(buffer []byte, r record) []byte {
+	nanoseconds := r.unixNano()
+	severity := otlpSeverityNumber(r.detail)
+	if e.protobuf {
+		// The scope is written in full (as ScopeLogs.scope), followed by the
+		// fields of the LogRecord, which are wrapped by the OTLPWriter once
+		// the length of the record is known.
+		siteLength := unescapedLength(r.site)
+		buffer = appendProtoBytesHeader(buffer, 1, protoBytesSize(1, siteLength))
+		buffer = appendProtoBytesHeader(buffer, 1, siteLength)
+		buffer = appendUnescaped(buffer, r.site)
+		buffer = appendProtoFixed64(buffer, 1, uint64(nanoseconds))
+		buffer = appendProtoFixed64(buffer, 11, uint64(nanoseconds))
+		buffer = appendProtoTag(buffer, 2, protoWireVarint)
+		buffer = appendProtoVarint(buffer, uint64(severity))
+		buffer = appendProtoBytesHeader(buffer, 3, len(r.detail.Severity))
+		buffer = append(buffer, r.detail.Severity...)
+		messageLength := len(r.detail.Message)
+		if r.detail.escaped {
+			messageLength = unescapedLength(r.detail.Message)
+		}
+		buffer = appendProtoBytesHeader(buffer, 5, protoBytesSize(1, messageLength))
+		buffer = appendProtoBytesHeader(buffer, 1, messageLength)
+		if r.detail.escaped {
+			buffer = appendUnescaped(buffer, r.detail.Message)
+		} else {
+			buffer = append(buffer, r.detail.Message...)
+		}
+		buffer = appendProtoStringKeyValue(buffer, 6, "operation", r.operation, true)
+		if r.detail.Details != "" {
+			buffer = appendProtoStringKeyValue(buffer, 6, "details", r.detail.Details, r.detail.escaped)
+		}
+		return buffer
+	}
+
+	buffer = append(buffer, `{"scope":{"name":"`...)
+	buffer = append(buffer, r.site...)
+	buffer = append(buffer, `"},"logRecords":[{"timeUnixNano":"`...)
+	buffer = strconv.AppendInt(buffer, nanoseconds, 10)
+	buffer = append(buffer, `","observedTimeUnixNano":"`...)
+	buffer = strconv.AppendInt(buffer, nanoseconds, 10)
+	buffer = append(buffer, `","severityNumber":`...)
+	buffer = strconv.AppendInt(buffer, int64(severity), 10)
+	buffer = append(buffer, `,"severityText":"`...)
+	buffer = append(buffer, r.detail.Severity...)
+	buffer = append(buffer, `","body":{"stringValue":"`...)
+	buffer = append(buffer, r.detail.Message...)
+	buffer = append(buffer, `"},"attributes":[{"key":"operation","value":{"stringValue":"`...)
+	buffer = append(buffer, r.operation...)
+	buffer = append(buffer, `"}}`...)
+	if r.detail.Details != "" {
+		buffer = append(buffer, `,{"key":"details","value":{"stringValue":"`...)
+		buffer = append(buffer, r.detail.Details...)
+		buffer = append(buffer, `"}}`...)
+	}
+	return buffer
+}
+
+func (e *otlpEncoder) field(buffer []byte, f Field) []byte {
+	if e.protobuf {
+		return appendProtoFieldKeyValue(buffer, 6, &f)
+	}
+	buffer = append(buffer, `,{"key":"`...)
+	buffer = serializeEscaped(buffer, f.key)
+	buffer = append(buffer, `","value":{`...)
+	switch f.kind {
+	case fieldKindString:
+		buffer = append(buffer, `"stringValue":"`...)
+		buffer = serializeEscaped(buffer, f.str)
+		buffer = append(buffer, quoteToken...)
+	case fieldKindInt64, fieldKindDuration:
+		// 64-bit integers are written as strings, per the protobuf JSON
+		// mapping.
+		buffer = append(buffer, `"intValue":"`...)
+		buffer = strconv.AppendInt(buffer, f.integer, 10)
+		buffer = append(buffer, quoteToken...)
+	case fieldKindFloat64:
+		buffer = append(buffer, `"doubleValue":`...)
+		switch {
+		case math.IsNaN(f.float):
+			buffer = append(buffer, `"NaN"`...)
+		case math.IsInf(f.float, 1):
+			buffer = append(buffer, `"Infinity"`...)
+		case math.IsInf(f.float, -1):
+			buffer = append(buffer, `"-Infinity"`...)
+		default:
+			buffer = strconv.AppendFloat(buffer, f.float, 'g', -1, 64)
+		}
+	case fieldKindBool:
+		buffer = append(buffer, `"boolValue":`...)
+		buffer = strconv.AppendBool(buffer, f.integer != 0)
+	case fieldKindTime:
+		buffer = append(buffer, `"stringValue":"`...)
+		buffer = f.time.AppendFormat(buffer, time.RFC3339Nano)
+		buffer = append(buffer, quoteToken...)
+	}
+	return append(buffer, "}}"...)
+}
+
+func (e *otlpEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if e.protobuf {
+		if truncated {
+			buffer = appendProtoBytesHeader(buffer, 6, protoBytesSize(1, len("truncated"))+protoBytesSize(2, 2))
+			buffer = appendProtoBytesHeader(buffer, 1, len("truncated"))
+			buffer = append(buffer, "truncated"...)
+			buffer = appendProtoBytesHeader(buffer, 2, 2)
+			buffer = appendProtoTag(buffer, 2, protoWireVarint)
+			buffer = append(buffer, 1)
+		}
+		return buffer
+	}
+	if truncated {
+		buffer = append(buffer, `,{"key":"truncated","value":{"boolValue":true}}`...)
+	}
+	return append(buffer, "]}]}"...)
+}
+
+// otlpSeverityNumber maps an entry's severity onto the OpenTelemetry severity
+// numbers. Each severity is mapped onto the first number of its range (i.e.
+// INFO rather than INFO2).
+func otlpSeverityNumber(ld LogDetail) int {
+	switch ld.Severity {
+	case LogSeverityTrace:
+		return 1
+	case LogSeverityDebug:
+		return 5
+	case LogSeverityInfo:
+		return 9
+	case LogSeverityWarn:
+		return 13
+	case LogSeverityError:
+		return 17
+	case LogSeverityFatal:
+		return 21
+	}
+	rank := ld.Level.rank()
+	if rank == 0 {
+		// SEVERITY_NUMBER_UNSPECIFIED
+		return 0
+	}
+	switch levelFromRank(rank) {
+	case LogLevelTrace:
+		return 1
+	case LogLevelDebug:
+		return 5
+	case LogLevelInfo:
+		return 9
+	case LogLevelWarn:
+		return 13
+	case LogLevelError:
+		return 17
+	default:
+		return 21
+	}
+}
+
+// OTLPWriter is an io.WriteCloser that exports entries to an OpenTelemetry
+// collector via OTLP/HTTP. Entries must be encoded by the encoder returned
+// by NewOTLPEncoder, using the same Protocol.
+//
+// Entries are accumulated, and exported in batches of up to BatchSize
+// entries, at least every FlushInterval. Exports run in the background, so
+// Write never waits for the collector; if the collector falls behind, and
+// several full batches are already awaiting export, Write returns
+// ErrBufferFull. Batches that fail to export are discarded; their entries are
+// passed to the ErrorHandler, and the error is returned by the next call to
+// Flush or Close.
+type OTLPWriter struct {
+	endpoint string
+	header   http.Header
+	client   *http.Client
+	protobuf bool
+
+	// resource is the encoded Resource, which is the same for every request.
+	resource []byte
+
+	// body is reused for every request. It is only accessed while flushing,
+	// which the batcher serializes.
+	body  []byte
+	batch *batcher
+}
+
+// NewOTLPWriter returns an OTLPWriter that exports entries to endpoint. The
+// ServiceContext is written as the resource of every request.
+//
+// An error is returned if endpoint is malformed.
+func NewOTLPWriter(endpoint string, serviceContext ServiceContext, options OTLPOptions) (*OTLPWriter, error) {
+	if err := validateHTTPEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	w := &OTLPWriter{
+		endpoint: endpoint,
+		header:   newHTTPHeader("application/json", options.Headers),
+		client:   options.Client,
+		protobuf: options.Protocol == OTLPProtocolProtobuf,
+	}
+	if w.protobuf {
+		w.header.Set("Content-Type", "application/x-protobuf")
+	}
+	attributes := []struct{ key, value string }{
+		{"service.name", serviceContext.ServiceName},
+		{"service.namespace", serviceContext.SystemName},
+		{"service.instance.id", serviceContext.ServiceInstanceID},
+		{"deployment.environment", serviceContext.Environment},
+	}
+	if !w.protobuf {
+		w.resource = append(w.resource, `{"attributes":[`...)
+	}
+	first := true
+	for _, attribute := range attributes {
+		if attribute.value == "" {
+			continue
+		}
+		if w.protobuf {
+			w.resource = appendProtoStringKeyValue(w.resource, 1, attribute.key, attribute.value, false)
+			continue
+		}
+		if !first {
+			w.resource = append(w.resource, fieldSeparatorToken...)
+		}
+		first = false
+		w.resource = append(w.resource, `{"key":"`...)
+		w.resource = append(w.resource, attribute.key...)
+		w.resource = append(w.resource, `","value":{"stringValue":"`...)
+		w.resource = serializeEscaped(w.resource, attribute.value)
+		w.resource = append(w.resource, `"}}`...)
+	}
+	if !w.protobuf {
+		w.resource = append(w.resource, "]}"...)
+	}
+	w.batch = newBatcher(options.BatchSize, options.FlushInterval, w.export, options.ErrorHandler)
+	return w, nil
+}
+
+// Write adds an entry to the current batch, exporting the batch if it is
+// full.
+func (w *OTLPWriter) Write(p []byte) (int, error) {
+	return w.batch.Write(p)
+}
+
+// Flush exports the current batch, if any.
+func (w *OTLPWriter) Flush() error {
+	return w.batch.Flush()
+}
+
+// Close exports the current batch, if any, and stops the periodic exports.
+// Writes after Close return ErrWriterClosed.
+func (w *OTLPWriter) Close() error {
+	return w.batch.Close()
+}
+
+// CloseContext is the same as Close, but if ctx is done before the remaining
+// batches have been exported, the export in progress is abandoned, and the
+// remaining batches are discarded.
+func (w *OTLPWriter) CloseContext(ctx context.Context) error {
+	return w.batch.CloseContext(ctx)
+}
+
+// export wraps a batch of entries into a single ResourceLogs, and sends it
+// to the collector.
+func (w *OTLPWriter) export(ctx context.Context, entries [][]byte) error {
+	w.body = w.body[:0]
+	if !w.protobuf {
+		w.body = append(w.body, `{"resourceLogs":[{"resource":`...)
+		w.body = append(w.body, w.resource...)
+		w.body = append(w.body, `,"scopeLogs":[`...)
+		for i, entry := range entries {
+			if i > 0 {
+				w.body = append(w.body, fieldSeparatorToken...)
+			}
+			w.body = append(w.body, entry...)
+		}
+		w.body = append(w.body, "]}]}"...)
+		return postHTTP(ctx, w.client, w.endpoint, w.header, w.body, nil)
+	}
+
+	// Each entry is a complete ScopeLogs.scope, followed by the fields of a
+	// LogRecord, which are wrapped here as ScopeLogs.log_records.
+	resourceLogsSize := protoBytesSize(1, len(w.resource))
+	for _, entry := range entries {
+		scopeLength := otlpScopeLength(entry)
+		resourceLogsSize += protoBytesSize(2, scopeLength+protoBytesSize(2, len(entry)-scopeLength))
+	}
+	w.body = appendProtoBytesHeader(w.body, 1, resourceLogsSize)
+	w.body = appendProtoBytesHeader(w.body, 1, len(w.resource))
+	w.body = append(w.body, w.resource...)
+	for _, entry := range entries {
+		scopeLength := otlpScopeLength(entry)
+		w.body = appendProtoBytesHeader(w.body, 2, scopeLength+protoBytesSize(2, len(entry)-scopeLength))
+		w.body = append(w.body, entry[:scopeLength]...)
+		w.body = appendProtoBytesHeader(w.body, 2, len(entry)-scopeLength)
+		w.body = append(w.body, entry[scopeLength:]...)
+	}
+	return postHTTP(ctx, w.client, w.endpoint, w.header, w.body, nil)
+}
+
+// otlpScopeLength returns the length of the ScopeLogs.scope field at the start
+// of a protobuf encoded entry.
+func otlpScopeLength(entry []byte) int {
+	length, n := 0, 1
+	for shift := uint(0); n < len(entry); shift += 7 {
+		length |= int(entry[n]&0x7f) << shift
+		n++
+		if entry[n-1] < 0x80 {
+			break
+		}
+	}
+	if n+length > len(entry) {
+		return len(entry)
+	}
+	return n + length
+}
+
+// Protobuf wire types.
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+)
+
+func appendProtoTag(buffer []byte, field, wireType int) []byte {
+	return appendProtoVarint(buffer, uint64(field<<3|wireType))
+}
+
+func appendProtoVarint(buffer []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buffer = append(buffer, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buffer, byte(v))
+}
+
+func protoVarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// protoBytesSize returns the encoded size of a length delimited field whose
+// content is length bytes long.
+func protoBytesSize(field, length int) int {
+	return protoVarintSize(uint64(field<<3)) + protoVarintSize(uint64(length)) + length
+}
+
+// appendProtoBytesHeader appends the tag and length of a length delimited
+// field. The content of the field must be appended by the caller.
+func appendProtoBytesHeader(buffer []byte, field, length int) []byte {
+	buffer = appendProtoTag(buffer, field, protoWireBytes)
+	return appendProtoVarint(buffer, uint64(length))
+}
+
+func appendProtoFixed64(buffer []byte, field int, v uint64) []byte {
+	buffer = appendProtoTag(buffer, field, protoWireFixed64)
+	return append(buffer, byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+// appendProtoStringKeyValue appends a KeyValue with a string value as the
+// specified field. If escaped is true, value is unescaped (see escape).
+func appendProtoStringKeyValue(buffer []byte, field int, key, value string, escaped bool) []byte {
+	valueLength := len(value)
+	if escaped {
+		valueLength = unescapedLength(value)
+	}
+	anyValueSize := protoBytesSize(1, valueLength)
+	buffer = appendProtoBytesHeader(buffer, field, protoBytesSize(1, len(key))+protoBytesSize(2, anyValueSize))
+	buffer = appendProtoBytesHeader(buffer, 1, len(key))
+	buffer = append(buffer, key...)
+	buffer = appendProtoBytesHeader(buffer, 2, anyValueSize)
+	buffer = appendProtoBytesHeader(buffer, 1, valueLength)
+	if escaped {
+		return appendUnescaped(buffer, value)
+	}
+	return append(buffer, value...)
+}
+
+// appendProtoFieldKeyValue appends a Field as a KeyValue, with an AnyValue of
+// the corresponding type, as the specified field.
+func appendProtoFieldKeyValue(buffer []byte, field int, f *Field) []byte {
+	var scratch [64]byte
+	var timestamp []byte
+	anyValueSize := 0
+	switch f.kind {
+	case fieldKindString:
+		anyValueSize = protoBytesSize(1, len(f.str))
+	case fieldKindInt64, fieldKindDuration:
+		anyValueSize = 1 + protoVarintSize(uint64(f.integer))
+	case fieldKindFloat64:
+		anyValueSize = 9
+	case fieldKindBool:
+		anyValueSize = 2
+	case fieldKindTime:
+		timestamp = f.time.AppendFormat(scratch[:0], time.RFC3339Nano)
+		anyValueSize = protoBytesSize(1, len(timestamp))
+	}
+	buffer = appendProtoBytesHeader(buffer, field, protoBytesSize(1, len(f.key))+protoBytesSize(2, anyValueSize))
+	buffer = appendProtoBytesHeader(buffer, 1, len(f.key))
+	buffer = append(buffer, f.key...)
+	buffer = appendProtoBytesHeader(buffer, 2, anyValueSize)
+	switch f.kind {
+	case fieldKindString:
+		buffer = appendProtoBytesHeader(buffer, 1, len(f.str))
+		buffer = append(buffer, f.str...)
+	case fieldKindInt64, fieldKindDuration:
+		buffer = appendProtoTag(buffer, 3, protoWireVarint)
+		buffer = appendProtoVarint(buffer, uint64(f.integer))
+	case fieldKindFloat64:
+		buffer = appendProtoFixed64(buffer, 4, math.Float64bits(f.float))
+	case fieldKindBool:
+		buffer = appendProtoTag(buffer, 2, protoWireVarint)
+		if f.integer != 0 {
+			buffer = append(buffer, 1)
+		} else {
+			buffer = append(buffer, 0)
+		}
+	case fieldKindTime:
+		buffer = appendProtoBytesHeader(buffer, 1, len(timestamp))
+		buffer = append(buffer, timestamp...)
+	}
+	return buffer
+}
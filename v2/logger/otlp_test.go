@@ -0,0 +1,381 @@
+package logger_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// collectorRequest is a request received by an httptest collector.
+type collectorRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// startCollector starts an httptest server that responds to every request
+// with status, and returns it along with a channel of the requests received.
+func startCollector(t *testing.T, status int) (*httptest.Server, chan collectorRequest) {
+	requests := make(chan collectorRequest, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- collectorRequest{path: r.URL.Path, header: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	return server, requests
+}
+
+func receiveRequest(t *testing.T, requests chan collectorRequest) collectorRequest {
+	select {
+	case request := <-requests:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for request")
+		return collectorRequest{}
+	}
+}
+
+func Test_OTLPJSON(t *testing.T) {
+	server, requests := startCollector(t, http.StatusOK)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeOTLPWithOptions(server.URL+"/v1/logs", syslogServiceContext, logger.LogServiceOptions{}, logger.OTLPOptions{
+		Protocol:  logger.OTLPProtocolJSON,
+		Headers:   map[string]string{"Authorization": "Bearer token"},
+		BatchSize: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("context \"site\"", "operation")
+	log.Info("first")
+	log.ErrorF("second", "details", logger.Int64("user", 42), logger.Bool("retry", true), logger.Float64("ratio", math.Inf(1)))
+
+	request := receiveRequest(t, requests)
+	if contentType := request.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected application/json, got %v", contentType)
+	}
+	if authorization := request.header.Get("Authorization"); authorization != "Bearer token" {
+		t.Errorf("expected authorization header, got %v", authorization)
+	}
+
+	type keyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	var body struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []keyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				LogRecords []struct {
+					TimeUnixNano   string                 `json:"timeUnixNano"`
+					SeverityNumber int                    `json:"severityNumber"`
+					SeverityText   string                 `json:"severityText"`
+					Body           map[string]interface{} `json:"body"`
+					Attributes     []keyValue             `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.Unmarshal(request.body, &body); err != nil {
+		t.Fatalf("Error: %v\nJSON: %s", err, request.body)
+	}
+	if len(body.ResourceLogs) != 1 || len(body.ResourceLogs[0].ScopeLogs) != 2 {
+		t.Fatalf("expected one resource with two scopes, got %s", request.body)
+	}
+
+	expectedResource := []keyValue{
+		{"service.name", map[string]interface{}{"stringValue": "billing"}},
+		{"service.namespace", map[string]interface{}{"stringValue": "system"}},
+		{"service.instance.id", map[string]interface{}{"stringValue": "instance-1"}},
+		{"deployment.environment", map[string]interface{}{"stringValue": "test"}},
+	}
+	if actual := body.ResourceLogs[0].Resource.Attributes; !reflect.DeepEqual(actual, expectedResource) {
+		t.Errorf("expected resource %v, got %v", expectedResource, actual)
+	}
+
+	scope := body.ResourceLogs[0].ScopeLogs[1]
+	if scope.Scope.Name != "context \"site\"" || len(scope.LogRecords) != 1 {
+		t.Fatalf("unexpected scope: %s", request.body)
+	}
+	record := scope.LogRecords[0]
+	if record.SeverityNumber != 17 || record.SeverityText != "error" || record.Body["stringValue"] != "second" {
+		t.Errorf("unexpected record: %+v", record)
+	}
+	nanoseconds, _ := time.ParseDuration(record.TimeUnixNano + "ns")
+	if age := time.Since(time.Unix(0, int64(nanoseconds))); age < -time.Second || age > time.Minute {
+		t.Errorf("unexpected time: %v", record.TimeUnixNano)
+	}
+	expectedAttributes := []keyValue{
+		{"operation", map[string]interface{}{"stringValue": "operation"}},
+		{"details", map[string]interface{}{"stringValue": "details"}},
+		{"user", map[string]interface{}{"intValue": "42"}},
+		{"retry", map[string]interface{}{"boolValue": true}},
+		{"ratio", map[string]interface{}{"doubleValue": "Infinity"}},
+	}
+	if !reflect.DeepEqual(record.Attributes, expectedAttributes) {
+		t.Errorf("expected attributes %v, got %v", expectedAttributes, record.Attributes)
+	}
+}
+
+// protoField is a field decoded from the protobuf wire format.
+type protoField struct {
+	number int
+	value  uint64
+	bytes  []byte
+}
+
+// decodeProto decodes the fields of a protobuf message.
+func decodeProto(t *testing.T, b []byte) map[int][]protoField {
+	fields := map[int][]protoField{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("malformed tag: %x", b)
+		}
+		b = b[n:]
+		field := protoField{number: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			field.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("malformed varint: %x", b)
+			}
+			b = b[n:]
+		case 1:
+			field.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || len(b) < n+int(length) {
+				t.Fatalf("malformed length: %x", b)
+			}
+			field.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %v", tag&7)
+		}
+		fields[field.number] = append(fields[field.number], field)
+	}
+	return fields
+}
+
+// decodeProtoAttributes decodes KeyValues into a map of keys to AnyValues.
+func decodeProtoAttributes(t *testing.T, keyValues []protoField) map[string]map[int][]protoField {
+	attributes := map[string]map[int][]protoField{}
+	for _, keyValue := range keyValues {
+		fields := decodeProto(t, keyValue.bytes)
+		attributes[string(fields[1][0].bytes)] = decodeProto(t, fields[2][0].bytes)
+	}
+	return attributes
+}
+
+func Test_OTLPProtobuf(t *testing.T) {
+	server, requests := startCollector(t, http.StatusOK)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeOTLP(server.URL+"/v1/logs", syslogServiceContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context \"site\"", "operation")
+	log = log.With(logger.String("request", "abc"))
+	log.WarnF("message", "", logger.Int64("user", -1), logger.Float64("ratio", 0.5))
+	if err := loggerService.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := receiveRequest(t, requests)
+	if contentType := request.header.Get("Content-Type"); contentType != "application/x-protobuf" {
+		t.Errorf("expected application/x-protobuf, got %v", contentType)
+	}
+	logsData := decodeProto(t, request.body)
+	resourceLogs := decodeProto(t, logsData[1][0].bytes)
+	resource := decodeProto(t, resourceLogs[1][0].bytes)
+	resourceAttributes := decodeProtoAttributes(t, resource[1])
+	if name := string(resourceAttributes["service.name"][1][0].bytes); name != "billing" {
+		t.Errorf("expected service.name billing, got %v", name)
+	}
+	if len(resourceLogs[2]) != 1 {
+		t.Fatalf("expected 1 scope, got %v", len(resourceLogs[2]))
+	}
+
+	scopeLogs := decodeProto(t, resourceLogs[2][0].bytes)
+	scope := decodeProto(t, scopeLogs[1][0].bytes)
+	if name := string(scope[1][0].bytes); name != "context \"site\"" {
+		t.Errorf("expected scope name to be unescaped, got %v", name)
+	}
+	record := decodeProto(t, scopeLogs[2][0].bytes)
+	if severity := record[2][0].value; severity != 13 {
+		t.Errorf("expected severity number 13, got %v", severity)
+	}
+	if text := string(record[3][0].bytes); text != "warn" {
+		t.Errorf("expected severity text warn, got %v", text)
+	}
+	if age := time.Since(time.Unix(0, int64(record[1][0].value))); age < -time.Second || age > time.Minute {
+		t.Errorf("unexpected time: %v", record[1][0].value)
+	}
+	if body := string(decodeProto(t, record[5][0].bytes)[1][0].bytes); body != "message" {
+		t.Errorf("expected body message, got %v", body)
+	}
+	attributes := decodeProtoAttributes(t, record[6])
+	if _, ok := attributes["details"]; ok {
+		t.Error("expected empty details to be omitted")
+	}
+	if operation := string(attributes["operation"][1][0].bytes); operation != "operation" {
+		t.Errorf("expected operation attribute, got %v", operation)
+	}
+	if request := string(attributes["request"][1][0].bytes); request != "abc" {
+		t.Errorf("expected request attribute, got %v", request)
+	}
+	if user := int64(attributes["user"][3][0].value); user != -1 {
+		t.Errorf("expected user attribute -1, got %v", user)
+	}
+	if ratio := math.Float64frombits(attributes["ratio"][4][0].value); ratio != 0.5 {
+		t.Errorf("expected ratio attribute 0.5, got %v", ratio)
+	}
+}
+
+// Messages and details escaped by the J methods must reach the collector as
+// they were logged, as they do with the JSON protocol.
+func Test_OTLPProtobufUnescapesJ(t *testing.T) {
+	server, requests := startCollector(t, http.StatusOK)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeOTLP(server.URL+"/v1/logs", syslogServiceContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("site", "operation")
+	log.InfoJ("say \"hi\"\n", "C:\\temp\t")
+	if err := loggerService.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := receiveRequest(t, requests)
+	resourceLogs := decodeProto(t, decodeProto(t, request.body)[1][0].bytes)
+	scopeLogs := decodeProto(t, resourceLogs[2][0].bytes)
+	record := decodeProto(t, scopeLogs[2][0].bytes)
+	if body := string(decodeProto(t, record[5][0].bytes)[1][0].bytes); body != "say \"hi\"\n" {
+		t.Errorf("expected the body to be unescaped, got %q", body)
+	}
+	attributes := decodeProtoAttributes(t, record[6])
+	if details := string(attributes["details"][1][0].bytes); details != "C:\\temp\t" {
+		t.Errorf("expected details to be unescaped, got %q", details)
+	}
+}
+
+func Test_OTLPFlushInterval(t *testing.T) {
+	server, requests := startCollector(t, http.StatusOK)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeOTLPWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{}, logger.OTLPOptions{
+		Protocol:      logger.OTLPProtocolJSON,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	log.Info("message")
+	receiveRequest(t, requests)
+}
+
+func Test_OTLPExportError(t *testing.T) {
+	server, requests := startCollector(t, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	type failure struct {
+		err   error
+		entry string
+	}
+	failures := make(chan failure, 4)
+	loggerService, err := logger.InitializeOTLPWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{
+		ErrorHandler: func(err error, entry []byte) {
+			failures <- failure{err: err, entry: string(entry)}
+		},
+	}, logger.OTLPOptions{BatchSize: 1, Protocol: logger.OTLPProtocolJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("site", "operation")
+	log.Info("message")
+	receiveRequest(t, requests)
+
+	// Exports run in the background, so the entries of the failed batch are
+	// passed to the ErrorHandler by the exporting goroutine.
+	select {
+	case f := <-failures:
+		if f.err == nil {
+			t.Error("expected an error")
+		}
+		if !strings.Contains(f.entry, `"stringValue":"message"`) {
+			t.Errorf("expected the failed entry, got %s", f.entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+}
+
+// Close must abandon an export that is still in progress once its context
+// expires.
+func Test_OTLPCloseContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	loggerService, err := logger.InitializeOTLPWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{
+		ErrorHandler: func(error, []byte) {},
+	}, logger.OTLPOptions{BatchSize: 1, Protocol: logger.OTLPProtocolJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("site", "operation")
+	log.Info("message")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = loggerService.Close(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close to return promptly, took %v", elapsed)
+	}
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func Test_OTLPMalformedEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "ftp://localhost/v1/logs", "://"} {
+		if _, err := logger.InitializeOTLP(endpoint, syslogServiceContext); err == nil {
+			t.Errorf("expected an error for %q", endpoint)
+		}
+	}
+}
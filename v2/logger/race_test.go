@@ -0,0 +1,9 @@
+//go:build race
+// +build race
+
+package logger_test
+
+// raceEnabled reports whether the tests were built with the race detector,
+// which allocates on behalf of instrumented code, so allocation counts are
+// only checked without it.
+const raceEnabled = true
@@ -0,0 +1,348 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the format of the timestamp added to the names of
+// rotated files. It sorts lexically and is safe for use in file names on all
+// platforms.
+const backupTimeFormat = "2006-01-02T15-04-05.000000000"
+
+const compressSuffix = ".gz"
+
+// RotatingFileOptions exposes configuration settings for a RotatingFile.
+type RotatingFileOptions struct {
+	// Filename is the path of the active log file. Rotated files are kept in
+	// the same directory, and are named after the active file with the time
+	// of rotation appended, i.e. "service-2009-01-20T12-05-00.000000000.log"
+	// for an active file named "service.log".
+	Filename string
+
+	// MaxSize is the size, in bytes, at which the active file is rotated.
+	// If MaxSize is zero, the file is not rotated based on its size.
+	MaxSize int64
+
+	// RotationInterval is how long the active file is written to before it is
+	// rotated. The age of an existing file that is reopened (i.e. when the
+	// process restarts) is measured from its modification time. If
+	// RotationInterval is zero, the file is not rotated based on its age.
+	RotationInterval time.Duration
+
+	// MaxBackups is the number of rotated files to keep. If MaxBackups is
+	// zero, rotated files are not removed based on their number.
+	MaxBackups int
+
+	// MaxAge is how long rotated files are kept. If MaxAge is zero, rotated
+	// files are not removed based on their age.
+	MaxAge time.Duration
+
+	// Compress determines whether rotated files are compressed with gzip.
+	Compress bool
+
+	// FileMode is the mode used when creating new log files. Defaults to
+	// 0644.
+	FileMode os.FileMode
+}
+
+// RotatingFile is an io.WriteCloser that writes to a file, and rotates the
+// file based on its size and/or age (see RotatingFileOptions).
+//
+// A RotatingFile can be supplied directly to InitializeWriterWithOptions. A
+// line based Framing (such as FramingNewline) should be used so that
+// entries in the file can be told apart.
+//
+// Entries are never split across files. If a single entry is larger than
+// MaxSize, it is written to a file of its own.
+//
+// Once Close has been called, Write, Rotate, and Reopen return os.ErrClosed.
+type RotatingFile struct {
+	mu       sync.Mutex
+	options  RotatingFileOptions
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// millMu ensures that only one compression/cleanup pass runs at a time,
+	// and mills tracks any passes in progress so that Close can wait for
+	// them.
+	millMu sync.Mutex
+	mills  sync.WaitGroup
+}
+
+// NewRotatingFile opens (or creates) the file specified in the options, and
+// returns a RotatingFile that writes to it.
+func NewRotatingFile(options RotatingFileOptions) (*RotatingFile, error) {
+	if options.Filename == "" {
+		return nil, fmt.Errorf("nobslogger: a filename is required")
+	}
+	if options.FileMode == 0 {
+		options.FileMode = 0644
+	}
+	f := &RotatingFile{
+		options: options,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write writes p to the active file, rotating the file first if necessary.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the active file, moves it aside, and opens a new active
+// file.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.rotate()
+}
+
+// Reopen closes and reopens the active file, without rotating it. Reopen is
+// useful when the active file has been moved by an external tool (such as
+// logrotate).
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if err := f.close(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the active file, and waits for any compression or cleanup of
+// rotated files to finish.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	err := f.close()
+	f.mu.Unlock()
+	f.mills.Wait()
+	return err
+}
+
+func (f *RotatingFile) shouldRotate(writeSize int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.options.MaxSize > 0 && f.size+writeSize > f.options.MaxSize {
+		return true
+	}
+	if f.options.RotationInterval > 0 && time.Since(f.openedAt) >= f.options.RotationInterval {
+		return true
+	}
+	return false
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.options.Filename), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.options.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, f.options.FileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	if f.size > 0 {
+		f.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (f *RotatingFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.close(); err != nil {
+		return err
+	}
+	backup := f.backupName(time.Now().UTC())
+	if err := os.Rename(f.options.Filename, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.mills.Add(1)
+	go f.mill()
+	return nil
+}
+
+func (f *RotatingFile) backupName(t time.Time) string {
+	dir, prefix, ext := f.nameParts()
+	return filepath.Join(dir, prefix+t.Format(backupTimeFormat)+ext)
+}
+
+// nameParts splits the active filename into its directory, the prefix shared
+// by all rotated files, and its extension.
+func (f *RotatingFile) nameParts() (dir, prefix, ext string) {
+	dir = filepath.Dir(f.options.Filename)
+	base := filepath.Base(f.options.Filename)
+	ext = filepath.Ext(base)
+	prefix = strings.TrimSuffix(base, ext) + "-"
+	return
+}
+
+type backupFile struct {
+	path       string
+	rotatedAt  time.Time
+	compressed bool
+}
+
+// backups lists the rotated files, newest first.
+func (f *RotatingFile) backups() ([]backupFile, error) {
+	dir, prefix, ext := f.nameParts()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []backupFile
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		compressed := strings.HasSuffix(name, ext+compressSuffix)
+		if !compressed && !strings.HasSuffix(name, ext) {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), compressSuffix), ext)
+		rotatedAt, err := time.Parse(backupTimeFormat, timestamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{
+			path:       filepath.Join(dir, name),
+			rotatedAt:  rotatedAt,
+			compressed: compressed,
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].rotatedAt.After(backups[j].rotatedAt)
+	})
+	return backups, nil
+}
+
+// mill compresses and removes rotated files according to the options. Errors
+// are ignored, as there is no caller to report them to; any files that are
+// missed are retried after the next rotation.
+func (f *RotatingFile) mill() {
+	defer f.mills.Done()
+	f.millMu.Lock()
+	defer f.millMu.Unlock()
+
+	backups, err := f.backups()
+	if err != nil {
+		return
+	}
+
+	var keep []backupFile
+	cutoff := time.Now().Add(-f.options.MaxAge)
+	for i, backup := range backups {
+		expired := f.options.MaxAge > 0 && backup.rotatedAt.Before(cutoff)
+		excess := f.options.MaxBackups > 0 && i >= f.options.MaxBackups
+		if expired || excess {
+			os.Remove(backup.path)
+			continue
+		}
+		keep = append(keep, backup)
+	}
+
+	if !f.options.Compress {
+		return
+	}
+	for _, backup := range keep {
+		if !backup.compressed {
+			compressFile(backup.path)
+		}
+	}
+}
+
+// compressFile gzips the file at path to path.gz, and then removes the
+// original file.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = compress(src, path+compressSuffix)
+	src.Close()
+	if err != nil {
+		os.Remove(path + compressSuffix)
+		return err
+	}
+	return os.Remove(path)
+}
+
+func compress(src *os.File, path string) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
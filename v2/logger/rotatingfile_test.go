@@ -0,0 +1,305 @@
+package logger_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func readBackups(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = ioutil.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			data, err = ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+		contents[info.Name()] = string(data)
+	}
+	return contents
+}
+
+func Test_RotatingFileRotatesOnSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename: filepath.Join(dir, "service.log"),
+		MaxSize:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n"} {
+		if _, err := file.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readBackups(t, dir)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %v", files)
+	}
+	if files["service.log"] != "cccccc\n" {
+		t.Errorf("unexpected active file contents %q", files["service.log"])
+	}
+}
+
+func Test_RotatingFileRotatesOnInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename:         filepath.Join(dir, "service.log"),
+		RotationInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("first\n"))
+	time.Sleep(20 * time.Millisecond)
+	file.Write([]byte("second\n"))
+	file.Close()
+
+	if files := readBackups(t, dir); len(files) != 2 {
+		t.Errorf("expected 2 files, got %v", files)
+	}
+}
+
+// The age of a file that already exists must be measured from when it was last
+// written, rather than from when it was reopened, so that restarting doesn't
+// postpone rotation.
+func Test_RotatingFileRotatesExistingFileOnInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "service.log")
+	if err := ioutil.WriteFile(filename, []byte("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename:         filename,
+		RotationInterval: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("second\n"))
+	file.Close()
+
+	files := readBackups(t, dir)
+	if len(files) != 2 || files["service.log"] != "second\n" {
+		t.Errorf("expected the existing file to be rotated, got %v", files)
+	}
+}
+
+func Test_RotatingFileMaxBackupsAndCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename:   filepath.Join(dir, "service.log"),
+		MaxBackups: 2,
+		Compress:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"1\n", "2\n", "3\n", "4\n"} {
+		file.Write([]byte(entry))
+		if err := file.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	files := readBackups(t, dir)
+	if len(files) != 3 {
+		t.Fatalf("expected the active file and 2 backups, got %v", files)
+	}
+	var backups []string
+	for name, contents := range files {
+		if name == "service.log" {
+			continue
+		}
+		if !strings.HasSuffix(name, ".log.gz") {
+			t.Errorf("expected backup %v to be compressed", name)
+		}
+		backups = append(backups, contents)
+	}
+	if strings.Join(backups, "") != "3\n4\n" && strings.Join(backups, "") != "4\n3\n" {
+		t.Errorf("expected the newest backups to be kept, got %q", backups)
+	}
+}
+
+func Test_RotatingFileMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expired := filepath.Join(dir, "service-2009-01-20T12-05-00.000000000.log")
+	if err := ioutil.WriteFile(expired, []byte("expired\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename: filepath.Join(dir, "service.log"),
+		MaxAge:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("current\n"))
+	file.Rotate()
+	file.Close()
+
+	files := readBackups(t, dir)
+	if _, ok := files[filepath.Base(expired)]; ok {
+		t.Error("expected expired backup to be removed")
+	}
+	if len(files) != 2 {
+		t.Errorf("expected the active file and 1 backup, got %v", files)
+	}
+}
+
+// Reopen must start a new active file if the old one was moved externally.
+func Test_RotatingFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "service.log")
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename: filename,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("before\n"))
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("after\n"))
+	file.Close()
+
+	files := readBackups(t, dir)
+	if files["service.log"] != "after\n" || files["service.log.1"] != "before\n" {
+		t.Errorf("unexpected files %v", files)
+	}
+}
+
+func Test_RotatingFileClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename: filepath.Join(dir, "service.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("before\n"))
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("after\n")); err != os.ErrClosed {
+		t.Errorf("expected Write to return os.ErrClosed, got %v", err)
+	}
+	if err := file.Rotate(); err != os.ErrClosed {
+		t.Errorf("expected Rotate to return os.ErrClosed, got %v", err)
+	}
+	if err := file.Reopen(); err != os.ErrClosed {
+		t.Errorf("expected Reopen to return os.ErrClosed, got %v", err)
+	}
+
+	if files := readBackups(t, dir); len(files) != 1 || files["service.log"] != "before\n" {
+		t.Errorf("unexpected files %v", files)
+	}
+}
+
+func Test_RotatingFileWithLogService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatingfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := logger.NewRotatingFile(logger.RotatingFileOptions{
+		Filename: filepath.Join(dir, "service.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loggerService := logger.InitializeWriterWithOptions(file, logger.ServiceContext{}, logger.LogServiceOptions{
+		Framing: logger.FramingNewline,
+	})
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("first")
+	log.Info("second")
+	if err := loggerService.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readBackups(t, dir)
+	if lines := strings.Split(strings.TrimSpace(files["service.log"]), "\n"); len(lines) != 2 {
+		t.Errorf("expected 2 lines, got %q", lines)
+	}
+}
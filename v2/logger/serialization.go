@@ -1,7 +1,10 @@
 package logger
 
 import (
+	"math"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/kpango/fastime"
 )
@@ -23,67 +26,276 @@ const (
 	operationToken         = "\"operation\""
 	messageToken           = "\"msg\""
 	detailsToken           = "\"details\""
+	fieldSeparatorToken    = ","
+	fieldKeyCloseToken     = "\":"
+	quoteToken             = "\""
+	trueToken              = "true"
+	falseToken             = "false"
+	nullToken              = "null"
+	truncatedToken         = ",\"truncated\":true"
 )
 
+const hexDigits = "0123456789abcdef"
+
 func init() {
 	fastime.SetFormat(time.RFC3339Nano)
 }
 
-func serialize(buffer []byte, sc *ServiceContext, lc *LogContext, ld LogDetail) (offset int) {
-	timestamp := fastime.FormattedNow()
+// serializeEntry appends an entry, encoded by enc, to the supplied buffer,
+// keeping the entry within maxSize bytes. If the entry would otherwise exceed maxSize,
+// its details (and then, if necessary, its message) are truncated, and the
+// entry is marked as truncated. If the entry still does not fit, all fields
+// are dropped. A maxSize of zero or less disables truncation.
+//
+// serializeEntry never writes beyond the capacity of the supplied buffer;
+// if more space is required, a new buffer is allocated.
+func serializeEntry(buffer []byte, maxSize int, enc Encoder, sc *ServiceContext, lc *LogContext, ld LogDetail, fields []Field) []byte {
+	r := record{
+		timestamp:  fastime.FormattedNow(),
+		sc:         sc,
+		site:       lc.Site,
+		operation:  lc.Operation,
+		detail:     ld,
+		fieldCount: lc.fieldCount + len(fields),
+	}
+	if locator, ok := enc.(sourceLocator); ok && locator.locatesSource() {
+		r.source = callerLocation()
+	}
+	start := len(buffer)
+	if maxSize <= 0 {
+		return encodeEntry(buffer[:start], enc, r, lc.fields, fields, false)
+	}
+
+	// Anything that can't possibly fit is trimmed up front, so that an
+	// absurdly large message doesn't force an equally large allocation.
+	truncated := false
+	if len(r.detail.Details) > maxSize {
+		r.detail.Details = truncateEscaped(r.detail.Details, maxSize)
+		truncated = true
+	}
+	if len(r.detail.Message) > maxSize {
+		r.detail.Message = truncateEscaped(r.detail.Message, maxSize)
+		truncated = true
+	}
+
+	entry := encodeEntry(buffer[:start], enc, r, lc.fields, fields, truncated)
+	if len(entry)-start <= maxSize {
+		return entry
+	}
 
+	// The size of the truncation marker varies by encoder, so a second pass
+	// may be needed if the marker was not already present.
+	for pass := 0; pass < 2 && len(entry)-start > maxSize; pass++ {
+		excess := len(entry) - start - maxSize
+		if !truncated {
+			excess += len(truncatedToken)
+			truncated = true
+		}
+		r.detail.Details, excess = trimEscaped(r.detail.Details, excess)
+		r.detail.Message, _ = trimEscaped(r.detail.Message, excess)
+		entry = encodeEntry(buffer[:start], enc, r, lc.fields, fields, true)
+	}
+	if len(entry)-start <= maxSize {
+		return entry
+	}
+	r.fieldCount = 0
+	return encodeEntry(buffer[:start], enc, r, "", nil, true)
+}
+
+// trimEscaped removes up to excess bytes from the end of s (see
+// truncateEscaped), and returns the result along with the number of bytes
+// that still need to be removed from elsewhere.
+func trimEscaped(s string, excess int) (string, int) {
+	if excess <= 0 {
+		return s, excess
+	}
+	n := len(s) - excess
+	if n < 0 {
+		n = 0
+	}
+	trimmed := truncateEscaped(s, n)
+	return trimmed, excess - (len(s) - len(trimmed))
+}
+
+// truncateEscaped returns the longest prefix of s that is at most n bytes
+// long, and which doesn't split a UTF-8 encoded rune or a JSON escape
+// sequence.
+func truncateEscaped(s string, n int) string {
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	for i := 0; i < n; {
+		if s[i] != '\\' {
+			i++
+			continue
+		}
+		sequenceLength := 2
+		if i+1 < len(s) && s[i+1] == 'u' {
+			sequenceLength = 6
+		}
+		if i+sequenceLength > n {
+			n = i
+			break
+		}
+		i += sequenceLength
+	}
+	return s[:n]
+}
+
+// jsonEncoder encodes entries as JSON objects. This is the default encoder.
+type jsonEncoder struct{}
+
+// NewJSONEncoder returns an Encoder that encodes entries as JSON objects. This
+// is the default Encoder.
+func NewJSONEncoder() Encoder {
+	return jsonEncoder{}
+}
+
+func (jsonEncoder) begin(buffer []byte, r record) []byte {
+	sc := r.sc
 	// Avoiding a loop-construct saves a few cycles.
 	// Since we're being opinionated and know ahead of time how many fields
 	// we're processing, we can just explicitly construct the outbound message
 	// token by token.
 	// Verify with benchmarks if altering this section.
-	offset += copy(buffer[offset:offset+len(braceOpenToken)], braceOpenToken)
-	offset += copy(buffer[offset:offset+len(timestampToken)], timestampToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(timestamp)], timestamp)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(environmentToken)], environmentToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(sc.Environment)], sc.Environment)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(systemNameToken)], systemNameToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(sc.SystemName)], sc.SystemName)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(serviceNameToken)], serviceNameToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(sc.ServiceName)], sc.ServiceName)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(serviceInstanceIDToken)], serviceInstanceIDToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(sc.ServiceInstanceID)], sc.ServiceInstanceID)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(siteToken)], siteToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(lc.Site)], lc.Site)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(operationToken)], operationToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(lc.Operation)], lc.Operation)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(levelToken)], levelToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(string(ld.Level))], string(ld.Level))
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(severityToken)], severityToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(string(ld.Severity))], string(ld.Severity))
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(messageToken)], messageToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(ld.Message)], ld.Message)
-	offset += copy(buffer[offset:offset+len(fieldCloseToken)], fieldCloseToken)
-	offset += copy(buffer[offset:offset+len(detailsToken)], detailsToken)
-	offset += copy(buffer[offset:offset+len(fieldOpenToken)], fieldOpenToken)
-	offset += copy(buffer[offset:offset+len(ld.Details)], ld.Details)
-	offset += copy(buffer[offset:offset+len(finalFieldCloseToken)], finalFieldCloseToken)
-	offset += copy(buffer[offset:offset+len(braceCloseToken)], braceCloseToken)
-	return
+	buffer = append(buffer, braceOpenToken...)
+	buffer = append(buffer, timestampToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, r.timestamp...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, environmentToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, sc.Environment...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, systemNameToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, sc.SystemName...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, serviceNameToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, sc.ServiceName...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, serviceInstanceIDToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, sc.ServiceInstanceID...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, siteToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, r.site...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, operationToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, r.operation...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, levelToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, r.detail.Level...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, severityToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, r.detail.Severity...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, messageToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, r.detail.Message...)
+	buffer = append(buffer, fieldCloseToken...)
+	buffer = append(buffer, detailsToken...)
+	buffer = append(buffer, fieldOpenToken...)
+	buffer = append(buffer, r.detail.Details...)
+	buffer = append(buffer, finalFieldCloseToken...)
+	return buffer
+}
+
+func (jsonEncoder) field(buffer []byte, f Field) []byte {
+	return serializeField(buffer, &f)
+}
+
+func (jsonEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, truncatedToken...)
+	}
+	buffer = append(buffer, braceCloseToken...)
+	return buffer
+}
+
+// serializeField appends a single field, including its leading separator, to
+// the buffer.
+func serializeField(buffer []byte, f *Field) []byte {
+	buffer = append(buffer, fieldSeparatorToken...)
+	buffer = append(buffer, quoteToken...)
+	buffer = serializeEscaped(buffer, f.key)
+	buffer = append(buffer, fieldKeyCloseToken...)
+	return serializeFieldValue(buffer, f)
+}
+
+// serializeFieldValue appends the JSON representation of a field's value to
+// the buffer.
+func serializeFieldValue(buffer []byte, f *Field) []byte {
+	switch f.kind {
+	case fieldKindString:
+		buffer = append(buffer, quoteToken...)
+		buffer = serializeEscaped(buffer, f.str)
+		buffer = append(buffer, quoteToken...)
+	case fieldKindInt64, fieldKindDuration:
+		buffer = strconv.AppendInt(buffer, f.integer, 10)
+	case fieldKindFloat64:
+		if math.IsNaN(f.float) || math.IsInf(f.float, 0) {
+			buffer = append(buffer, quoteToken...)
+			buffer = strconv.AppendFloat(buffer, f.float, 'g', -1, 64)
+			buffer = append(buffer, quoteToken...)
+		} else {
+			buffer = strconv.AppendFloat(buffer, f.float, 'g', -1, 64)
+		}
+	case fieldKindBool:
+		if f.integer != 0 {
+			buffer = append(buffer, trueToken...)
+		} else {
+			buffer = append(buffer, falseToken...)
+		}
+	case fieldKindTime:
+		buffer = append(buffer, quoteToken...)
+		buffer = f.time.AppendFormat(buffer, time.RFC3339Nano)
+		buffer = append(buffer, quoteToken...)
+	default:
+		buffer = append(buffer, nullToken...)
+	}
+	return buffer
+}
+
+// serializeEscaped appends s to the buffer, escaping reserved JSON characters
+// along the way. Unlike escape, serializeEscaped does not allocate (so long as
+// the buffer has sufficient capacity).
+func serializeEscaped(buffer []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\b':
+			buffer = append(buffer, `\b`...)
+		case '\f':
+			buffer = append(buffer, `\f`...)
+		case '\n':
+			buffer = append(buffer, `\n`...)
+		case '\r':
+			buffer = append(buffer, `\r`...)
+		case '\t':
+			buffer = append(buffer, `\t`...)
+		case '"':
+			buffer = append(buffer, `\"`...)
+		case '\\':
+			buffer = append(buffer, `\\`...)
+		default:
+			if c < 0x20 {
+				buffer = append(buffer, `\u00`...)
+				buffer = append(buffer, hexDigits[c>>4], hexDigits[c&0xf])
+			} else {
+				buffer = append(buffer, c)
+			}
+		}
+	}
+	return buffer
 }
 
 func escape(s string) string {
@@ -116,3 +328,46 @@ func escape(s string) string {
 	}
 	return s
 }
+
+// unescapeAt decodes the character at s[i], which may be the start of an
+// escape sequence produced by escape, and returns it along with the index of
+// the character that follows.
+func unescapeAt(s string, i int) (byte, int) {
+	if s[i] != '\\' || i == len(s)-1 {
+		return s[i], i + 1
+	}
+	switch s[i+1] {
+	case 'b':
+		return '\b', i + 2
+	case 'f':
+		return '\f', i + 2
+	case 'n':
+		return '\n', i + 2
+	case 'r':
+		return '\r', i + 2
+	case 't':
+		return '\t', i + 2
+	default:
+		return s[i+1], i + 2
+	}
+}
+
+// unescapedLength returns the length of s once unescaped (see appendUnescaped).
+func unescapedLength(s string) int {
+	n := 0
+	for i := 0; i < len(s); n++ {
+		_, i = unescapeAt(s, i)
+	}
+	return n
+}
+
+// appendUnescaped appends s, reversing the escape sequences produced by
+// escape.
+func appendUnescaped(buffer []byte, s string) []byte {
+	for i := 0; i < len(s); {
+		var c byte
+		c, i = unescapeAt(s, i)
+		buffer = append(buffer, c)
+	}
+	return buffer
+}
@@ -0,0 +1,648 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// splunkEventPath is the path of the HTTP Event Collector's event
+	// endpoint.
+	splunkEventPath = "/services/collector/event"
+
+	// splunkAckPath is the path of the HTTP Event Collector's indexer
+	// acknowledgement endpoint.
+	splunkAckPath = "/services/collector/ack"
+
+	// splunkChannelHeader identifies the channel of a request.
+	splunkChannelHeader = "X-Splunk-Request-Channel"
+)
+
+// errSplunkAckTimeout is returned when a batch is not acknowledged within
+// the AckTimeout.
+var errSplunkAckTimeout = errors.New("nobslogger: timed out awaiting indexer acknowledgement")
+
+// SplunkOptions exposes configuration settings for Splunk HTTP Event
+// Collector output.
+type SplunkOptions struct {
+	// Token is the HEC token, which is sent as the Authorization header.
+	Token string
+
+	// SourceType is the sourcetype of every event. Defaults to "_json".
+	SourceType string
+
+	// Index, if set, is the index into which events are written. Otherwise,
+	// the token's default index is used.
+	Index string
+
+	// Encoder determines the format of each event, and must produce JSON.
+	// Defaults to NewJSONEncoder.
+	Encoder Encoder
+
+	// UseAck requests indexer acknowledgement for each batch, which the
+	// token must have enabled. Once a batch is accepted, its
+	// acknowledgement is polled for, and the batch is resent if it is not
+	// acknowledged within AckTimeout. This provides at-least-once delivery.
+	UseAck bool
+
+	// Channel is the channel (a GUID) through which requests are sent.
+	// Channels are required by indexer acknowledgement, so if UseAck is set,
+	// this defaults to a random GUID.
+	Channel string
+
+	// AckTimeout is the longest that an acknowledgement is awaited. Defaults
+	// to 30s.
+	AckTimeout time.Duration
+
+	// AckPollInterval is the delay between polls for an acknowledgement.
+	// Defaults to 1s.
+	AckPollInterval time.Duration
+
+	// Headers are added to every request.
+	Headers map[string]string
+
+	// BatchSize is the most events that are sent in a single request.
+	// Defaults to 512.
+	BatchSize int
+
+	// FlushInterval is the longest that an entry is held before it is sent.
+	// Defaults to 1s.
+	FlushInterval time.Duration
+
+	// MaxRetries limits the retries of each batch (see the package doc).
+	MaxRetries int
+
+	// MinBackoff is the delay before the first retry (see the package doc).
+	MinBackoff time.Duration
+
+	// MaxBackoff is the longest delay between retries (see the package doc).
+	MaxBackoff time.Duration
+
+	// Client is used to send requests. Defaults to an http.Client with a 10s
+	// timeout.
+	Client *http.Client
+
+	// ErrorHandler is passed each entry that can't be sent (see the package doc).
+	ErrorHandler ErrorHandler
+}
+
+// InitializeSplunk establishes a logging service that sends entries to a
+// Splunk HTTP Event Collector (HEC), and returns a LogService instance
+// through which more detailed logging contexts can be spawned (see
+// NewContext).
+//
+// Each entry is wrapped in an HEC event envelope, with the entry's timestamp
+// as the time, the ServiceInstanceID as the host, and the site as the
+// source. The entry itself is the event.
+//
+// Entries are sent in batches. See SplunkWriter.
+//
+// An error is returned if endpoint is malformed.
+//
+// endpoint: Must be the URL of the HEC, i.e. https://splunk:8088. If the URL
+// has no path, the event endpoint path (/services/collector/event) is
+// appended.
+//
+// token: The HEC token.
+func InitializeSplunk(endpoint, token string, serviceContext ServiceContext) (LogService, error) {
+	return InitializeSplunkWithOptions(endpoint, serviceContext, defaultLogServiceOptions(), SplunkOptions{Token: token})
+}
+
+// InitializeSplunkWithOptions is the same as InitializeSplunk, but with
+// custom LogServiceOptions and SplunkOptions supplied. The token is taken
+// from SplunkOptions.Token. The Framing and Encoder options are ignored; the
+// format of events is determined by SplunkOptions.Encoder. See
+// InitializeSplunk.
+func InitializeSplunkWithOptions(endpoint string, serviceContext ServiceContext, options LogServiceOptions, splunkOptions SplunkOptions) (LogService, error) {
+	if splunkOptions.ErrorHandler == nil {
+		splunkOptions.ErrorHandler = batchErrorHandler(options)
+	}
+	w, err := NewSplunkWriter(endpoint, splunkOptions)
+	if err != nil {
+		return LogService{}, err
+	}
+	options.Framing = FramingNone
+	options.Encoder = NewSplunkEncoder(splunkOptions)
+	return InitializeWriterWithOptions(w, serviceContext, options), nil
+}
+
+// splunkEncoder wraps each event, as encoded by another encoder, in an HEC
+// event envelope.
+type splunkEncoder struct {
+	event Encoder
+
+	// envelope is the part of the envelope that follows the source, up to
+	// the event.
+	envelope []byte
+}
+
+// NewSplunkEncoder returns an Encoder that encodes entries as HEC events
+// (see InitializeSplunk). Only the SourceType, Index, and Encoder options are
+// used.
+func NewSplunkEncoder(options SplunkOptions) Encoder {
+	if options.Encoder == nil {
+		options.Encoder = NewJSONEncoder()
+	}
+	if options.SourceType == "" {
+		options.SourceType = "_json"
+	}
+	e := &splunkEncoder{
+		event: options.Encoder,
+	}
+	e.envelope = append(e.envelope, `,"sourcetype":"`...)
+	e.envelope = serializeEscaped(e.envelope, options.SourceType)
+	e.envelope = append(e.envelope, quoteToken...)
+	if options.Index != "" {
+		e.envelope = append(e.envelope, `,"index":"`...)
+		e.envelope = serializeEscaped(e.envelope, options.Index)
+		e.envelope = append(e.envelope, quoteToken...)
+	}
+	e.envelope = append(e.envelope, `,"event":`...)
+	return e
+}
+
+func (e *splunkEncoder) begin(buffer []byte, r record) []byte {
+	// HEC times are in seconds, with up to millisecond precision.
+	milliseconds := r.unixNano() / int64(time.Millisecond)
+	buffer = append(buffer, `{"time":`...)
+	buffer = strconv.AppendInt(buffer, milliseconds/1000, 10)
+	buffer = append(buffer, '.')
+	fraction := milliseconds % 1000
+	if fraction < 100 {
+		buffer = append(buffer, '0')
+	}
+	if fraction < 10 {
+		buffer = append(buffer, '0')
+	}
+	buffer = strconv.AppendInt(buffer, fraction, 10)
+	if r.sc.ServiceInstanceID != "" {
+		buffer = append(buffer, `,"host":"`...)
+		buffer = append(buffer, r.sc.ServiceInstanceID...)
+		buffer = append(buffer, quoteToken...)
+	}
+	if r.site != "" {
+		buffer = append(buffer, `,"source":"`...)
+		buffer = append(buffer, r.site...)
+		buffer = append(buffer, quoteToken...)
+	}
+	buffer = append(buffer, e.envelope...)
+	return e.event.begin(buffer, r)
+}
+
+func (e *splunkEncoder) field(buffer []byte, f Field) []byte {
+	return e.event.field(buffer, f)
+}
+
+func (e *splunkEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	buffer = e.event.end(buffer, r, truncated)
+	return append(buffer, braceCloseToken...)
+}
+
+// maxSplunkPendingAcks is the most batches that a SplunkWriter sends before
+// they are acknowledged. Once reached, sending pauses until a batch is
+// acknowledged (or given up on).
+const maxSplunkPendingAcks = 64
+
+// SplunkWriter is an io.WriteCloser that sends entries to a Splunk HTTP Event
+// Collector. Entries must be encoded by the encoder returned by
+// NewSplunkEncoder.
+//
+// Entries are accumulated, and sent in batches of up to BatchSize events, at
+// least every FlushInterval. Requests run in the background, so Write never
+// waits for the HEC; if the HEC falls behind, and several full batches are
+// already awaiting sending, Write returns ErrBufferFull. The entries of
+// batches that can't be sent (or acknowledged) are passed to the
+// ErrorHandler, and the error is returned by the next call to Flush or
+// Close.
+//
+// Requests that fail with a network error, a 429, or a 5xx response (i.e.
+// because the HEC is busy) are retried with backoff (or after the delay that
+// is requested by a Retry-After header), up to MaxRetries times, after which
+// the batch is discarded. Requests that fail with any other response are not
+// retried, as they would fail again.
+//
+// If UseAck is set, the acknowledgement of each batch that has been sent is
+// polled for in the background, every AckPollInterval. A batch that is not
+// acknowledged within AckTimeout is resent, up to MaxRetries times. Flush
+// and Close wait until every batch has been acknowledged (or given up on),
+// which may take some time, as Splunk only acknowledges events once they are
+// indexed. CloseContext stops waiting, and stops polling, once its context is
+// done.
+type SplunkWriter struct {
+	endpoint        string
+	ackEndpoint     string
+	header          http.Header
+	client          *http.Client
+	maxRetries      int
+	useAck          bool
+	ackTimeout      time.Duration
+	ackPollInterval time.Duration
+	onError         ErrorHandler
+	batch           *batcher
+
+	// The following are only accessed while flushing, which the batcher
+	// serializes.
+	backoff  *backoff
+	body     []byte
+	response bytes.Buffer
+
+	// acks are the batches awaiting acknowledgement, and ackErr is the last
+	// error encountered while polling, or resending, which is returned by
+	// the next Flush or Close. acked is signalled whenever acks shrinks.
+	acksMu sync.Mutex
+	acks   []*splunkAck
+	ackErr error
+	acked  *sync.Cond
+
+	// The following are only accessed by the polling goroutine, which runs
+	// until stop is closed, and then closes stopped. Its requests are
+	// abandoned once pollCtx is cancelled.
+	pollCtx      context.Context
+	pollCancel   context.CancelFunc
+	pollBackoff  *backoff
+	pollBody     []byte
+	pollResponse bytes.Buffer
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+// splunkAck is a batch awaiting acknowledgement. ends holds the offset of
+// the end of each event within body.
+type splunkAck struct {
+	id      int64
+	body    []byte
+	ends    []int
+	sent    time.Time
+	retries int
+	failed  bool
+}
+
+// report passes each event of a batch that was given up on to the
+// ErrorHandler, if any.
+func (ack *splunkAck) report(err error, onError ErrorHandler) {
+	if onError == nil {
+		return
+	}
+	start := 0
+	for _, end := range ack.ends {
+		onError(err, ack.body[start:end])
+		start = end + 1
+	}
+}
+
+// NewSplunkWriter returns a SplunkWriter that sends entries to endpoint (see
+// InitializeSplunk).
+//
+// An error is returned if endpoint is malformed.
+func NewSplunkWriter(endpoint string, options SplunkOptions) (*SplunkWriter, error) {
+	if err := validateHTTPEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(endpoint)
+	if u.Path == "" || u.Path == "/" {
+		u.Path = splunkEventPath
+		endpoint = u.String()
+	}
+	u.Path = splunkAckPath
+	u.RawQuery = ""
+	if options.UseAck && options.Channel == "" {
+		channel, err := newSplunkChannel()
+		if err != nil {
+			return nil, err
+		}
+		options.Channel = channel
+	}
+	if options.AckTimeout <= 0 {
+		options.AckTimeout = 30 * time.Second
+	}
+	if options.AckPollInterval <= 0 {
+		options.AckPollInterval = time.Second
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaultFlushInterval
+	}
+	options.MaxRetries = retryLimit(options.MaxRetries)
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	w := &SplunkWriter{
+		endpoint:        endpoint,
+		ackEndpoint:     u.String(),
+		header:          newHTTPHeader("application/json", options.Headers),
+		client:          options.Client,
+		maxRetries:      options.MaxRetries,
+		useAck:          options.UseAck,
+		ackTimeout:      options.AckTimeout,
+		ackPollInterval: options.AckPollInterval,
+		onError:         options.ErrorHandler,
+		backoff:         newBackoff(options.MinBackoff, options.MaxBackoff),
+		pollBackoff:     newBackoff(options.MinBackoff, options.MaxBackoff),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+	w.acked = sync.NewCond(&w.acksMu)
+	w.pollCtx, w.pollCancel = context.WithCancel(context.Background())
+	if options.Token != "" {
+		w.header.Set("Authorization", "Splunk "+options.Token)
+	}
+	if options.Channel != "" {
+		w.header.Set(splunkChannelHeader, options.Channel)
+	}
+	w.batch = newBatcher(options.BatchSize, options.FlushInterval, w.send, options.ErrorHandler)
+	if w.useAck {
+		go w.poll()
+	} else {
+		close(w.stopped)
+	}
+	return w, nil
+}
+
+// newSplunkChannel returns a random (version 4) GUID.
+func newSplunkChannel() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]), nil
+}
+
+// Write adds an entry to the current batch, sending the batch if it is full.
+func (w *SplunkWriter) Write(p []byte) (int, error) {
+	return w.batch.Write(p)
+}
+
+// Flush sends the current batch, if any, and (if UseAck is set) waits until
+// every batch has been acknowledged, or given up on.
+func (w *SplunkWriter) Flush() error {
+	err := w.batch.Flush()
+	if ackErr := w.awaitAcks(context.Background()); err == nil {
+		err = ackErr
+	}
+	return err
+}
+
+// Close sends the current batch, if any, waits until every batch has been
+// acknowledged (if UseAck is set), and stops the periodic requests. Writes
+// after Close return ErrWriterClosed.
+func (w *SplunkWriter) Close() error {
+	return w.CloseContext(context.Background())
+}
+
+// CloseContext is the same as Close, but if ctx is done before the remaining
+// batches have been sent (and acknowledged), the request in progress is
+// abandoned, and the remaining batches are discarded, and passed to the
+// ErrorHandler.
+func (w *SplunkWriter) CloseContext(ctx context.Context) error {
+	err := w.batch.CloseContext(ctx)
+	if ackErr := w.awaitAcks(ctx); err == nil {
+		err = ackErr
+	}
+	w.pollCancel()
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.stopped
+
+	// Any batches that are still awaiting acknowledgement were abandoned.
+	w.acksMu.Lock()
+	abandoned := w.acks
+	w.acks = nil
+	w.acked.Broadcast()
+	w.acksMu.Unlock()
+	for _, ack := range abandoned {
+		ack.report(ctx.Err(), w.onError)
+	}
+	return err
+}
+
+// awaitAcks waits until no batches are awaiting acknowledgement, and returns
+// (and clears) the last error encountered while polling. If ctx is done
+// first, ctx.Err() is returned.
+func (w *SplunkWriter) awaitAcks(ctx context.Context) error {
+	w.acksMu.Lock()
+	defer w.acksMu.Unlock()
+	if err := w.waitAcked(ctx, func() bool { return len(w.acks) == 0 }); err != nil {
+		return err
+	}
+	err := w.ackErr
+	w.ackErr = nil
+	return err
+}
+
+// waitAcked waits until ready reports true, or until ctx is done, in which
+// case it returns ctx.Err(). ready is evaluated whenever acks shrinks.
+// waitAcked must be called with w.acksMu held.
+func (w *SplunkWriter) waitAcked(ctx context.Context, ready func() bool) error {
+	if ctx.Done() != nil {
+		// Cond can't wait on a channel, so ctx being done is broadcast as
+		// if acks had shrunk.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.acksMu.Lock()
+				w.acked.Broadcast()
+				w.acksMu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for !ready() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		w.acked.Wait()
+	}
+	return nil
+}
+
+// send sends a batch of events, and (if UseAck is set) adds it to the
+// batches awaiting acknowledgement.
+func (w *SplunkWriter) send(ctx context.Context, entries [][]byte) error {
+	w.body = w.body[:0]
+	for i, entry := range entries {
+		if i > 0 {
+			w.body = append(w.body, '\n')
+		}
+		w.body = append(w.body, entry...)
+	}
+	if !w.useAck {
+		return postHTTPWithRetry(ctx, w.client, w.endpoint, w.header, w.body, w.maxRetries, w.backoff)
+	}
+
+	w.acksMu.Lock()
+	err := w.waitAcked(ctx, func() bool { return len(w.acks) < maxSplunkPendingAcks })
+	w.acksMu.Unlock()
+	if err != nil {
+		return err
+	}
+	ackID, err := w.postEvents(ctx, w.body, w.backoff, &w.response)
+	if err != nil {
+		return err
+	}
+
+	ack := &splunkAck{
+		id:   ackID,
+		body: append([]byte(nil), w.body...),
+		ends: make([]int, 0, len(entries)),
+		sent: time.Now(),
+	}
+	end := -1
+	for _, entry := range entries {
+		end += len(entry) + 1
+		ack.ends = append(ack.ends, end)
+	}
+	w.acksMu.Lock()
+	w.acks = append(w.acks, ack)
+	w.acksMu.Unlock()
+	return nil
+}
+
+// postEvents sends body, retrying as for postHTTPWithRetry, and returns the
+// ackId of the accepted request.
+func (w *SplunkWriter) postEvents(ctx context.Context, body []byte, backoff *backoff, response *bytes.Buffer) (int64, error) {
+	err := retry(ctx, w.maxRetries, backoff, retryableHTTPError, func() error {
+		return postHTTP(ctx, w.client, w.endpoint, w.header, body, response)
+	})
+	if err != nil {
+		return 0, err
+	}
+	var r struct {
+		AckID *int64 `json:"ackId"`
+	}
+	if err := json.Unmarshal(response.Bytes(), &r); err != nil {
+		return 0, fmt.Errorf("nobslogger: malformed HEC response: %v", err)
+	}
+	if r.AckID == nil {
+		return 0, errors.New("nobslogger: HEC response has no ackId; is indexer acknowledgement enabled for the token?")
+	}
+	return *r.AckID, nil
+}
+
+// poll polls for acknowledgements every AckPollInterval, until the
+// SplunkWriter is closed.
+func (w *SplunkWriter) poll() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.ackPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.pollAcks()
+		}
+	}
+}
+
+// pollAcks requests the status of every batch awaiting acknowledgement,
+// and resends any batches whose acknowledgement has timed out.
+func (w *SplunkWriter) pollAcks() {
+	w.acksMu.Lock()
+	if len(w.acks) == 0 {
+		w.acksMu.Unlock()
+		return
+	}
+	w.pollBody = append(w.pollBody[:0], `{"acks":[`...)
+	for i, ack := range w.acks {
+		if i > 0 {
+			w.pollBody = append(w.pollBody, ',')
+		}
+		w.pollBody = strconv.AppendInt(w.pollBody, ack.id, 10)
+	}
+	w.pollBody = append(w.pollBody, "]}"...)
+	w.acksMu.Unlock()
+
+	var response struct {
+		Acks map[string]bool `json:"acks"`
+	}
+	err := postHTTP(w.pollCtx, w.client, w.ackEndpoint, w.header, w.pollBody, &w.pollResponse)
+	if err == nil {
+		if err := json.Unmarshal(w.pollResponse.Bytes(), &response); err != nil {
+			w.setAckErr(fmt.Errorf("nobslogger: malformed HEC ack response: %v", err))
+		}
+	} else if !retryableHTTPError(err) {
+		w.setAckErr(err)
+	}
+
+	// Acknowledged batches are removed, and those that have timed out are
+	// collected for resending. They remain in acks until they are resent, so
+	// that Flush doesn't return in the meantime.
+	w.acksMu.Lock()
+	now := time.Now()
+	expired := []*splunkAck{}
+	pending := w.acks[:0]
+	for _, ack := range w.acks {
+		if response.Acks[strconv.FormatInt(ack.id, 10)] {
+			continue
+		}
+		if now.Sub(ack.sent) > w.ackTimeout {
+			expired = append(expired, ack)
+		}
+		pending = append(pending, ack)
+	}
+	w.acks = pending
+	w.acked.Broadcast()
+	w.acksMu.Unlock()
+
+	for _, ack := range expired {
+		if ack.retries >= w.maxRetries {
+			ack.failed = true
+			w.setAckErr(errSplunkAckTimeout)
+			ack.report(errSplunkAckTimeout, w.onError)
+			continue
+		}
+		id, err := w.postEvents(w.pollCtx, ack.body, w.pollBackoff, &w.pollResponse)
+		if err != nil {
+			ack.failed = true
+			w.setAckErr(err)
+			ack.report(err, w.onError)
+			continue
+		}
+		w.acksMu.Lock()
+		ack.id = id
+		ack.sent = time.Now()
+		ack.retries++
+		w.acksMu.Unlock()
+	}
+
+	if len(expired) > 0 {
+		w.acksMu.Lock()
+		pending := w.acks[:0]
+		for _, ack := range w.acks {
+			if !ack.failed {
+				pending = append(pending, ack)
+			}
+		}
+		w.acks = pending
+		w.acked.Broadcast()
+		w.acksMu.Unlock()
+	}
+}
+
+// setAckErr records an error encountered while polling.
+func (w *SplunkWriter) setAckErr(err error) {
+	w.acksMu.Lock()
+	w.ackErr = err
+	w.acksMu.Unlock()
+}
@@ -0,0 +1,365 @@
+package logger_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// hecEvent is a decoded HEC event.
+type hecEvent struct {
+	Time       float64                `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      map[string]interface{} `json:"event"`
+}
+
+func decodeHECEvents(t *testing.T, body []byte) []hecEvent {
+	events := []hecEvent{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var event hecEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatalf("Error: %v\nJSON: %s", err, body)
+		}
+		events = append(events, event)
+	}
+}
+
+func Test_SplunkEvents(t *testing.T) {
+	server, requests := startCollector(t, http.StatusOK)
+	defer server.Close()
+
+	loggerService, err := logger.InitializeSplunkWithOptions(server.URL, syslogServiceContext, logger.LogServiceOptions{}, logger.SplunkOptions{
+		Token:      "token",
+		SourceType: "nobslogger",
+		Index:      "main",
+		BatchSize:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeService(&loggerService)
+	log := loggerService.NewContext("context \"site\"", "operation")
+	log.Info("first")
+	log.ErrorF("second", "details", logger.Int64("user", 42))
+
+	request := receiveRequest(t, requests)
+	if request.path != "/services/collector/event" {
+		t.Errorf("expected the event path, got %v", request.path)
+	}
+	if authorization := request.header.Get("Authorization"); authorization != "Splunk token" {
+		t.Errorf("expected token authorization, got %v", authorization)
+	}
+	if channel := request.header.Get("X-Splunk-Request-Channel"); channel != "" {
+		t.Errorf("expected no channel, got %v", channel)
+	}
+	events := decodeHECEvents(t, request.body)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %s", request.body)
+	}
+	for i, expected := range []string{"first", "second"} {
+		event := events[i]
+		seconds := int64(event.Time)
+		if age := time.Since(time.Unix(seconds, 0)); age < -time.Second || age > time.Minute {
+			t.Errorf("unexpected time: %v", event.Time)
+		}
+		if event.Host != "instance-1" || event.Source != "context \"site\"" || event.SourceType != "nobslogger" || event.Index != "main" {
+			t.Errorf("unexpected envelope: %+v", event)
+		}
+		if event.Event["msg"] != expected {
+			t.Errorf("expected message %v, got %v", expected, event.Event["msg"])
+		}
+	}
+	if user := events[1].Event["user"]; user != float64(42) {
+		t.Errorf("expected fields in the event, got %v", events[1].Event)
+	}
+}
+
+func Test_SplunkEncoderDefaults(t *testing.T) {
+	var entry []byte
+	writer := writerFunc(func(bb []byte) (int, error) {
+		entry = append(entry[:0], bb...)
+		return len(bb), nil
+	})
+	loggerService := logger.InitializeWriterWithOptions(writer, logger.ServiceContext{}, logger.LogServiceOptions{
+		Encoder: logger.NewSplunkEncoder(logger.SplunkOptions{}),
+	})
+	log := loggerService.NewContext("", "operation")
+	log.Info("message")
+
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(entry, &envelope); err != nil {
+		t.Fatalf("Error: %v\nJSON: %s", err, entry)
+	}
+	if envelope["sourcetype"] != "_json" {
+		t.Errorf("expected the _json sourcetype, got %v", envelope["sourcetype"])
+	}
+	for _, key := range []string{"host", "source", "index"} {
+		if _, ok := envelope[key]; ok {
+			t.Errorf("expected empty %v to be omitted, got %s", key, entry)
+		}
+	}
+}
+
+func Test_SplunkAck(t *testing.T) {
+	var events, polls int32
+	channels := make(chan string, 16)
+	acks := make(chan string, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		channels <- r.Header.Get("X-Splunk-Request-Channel")
+		switch r.URL.Path {
+		case "/services/collector/event":
+			ackID := atomic.AddInt32(&events, 1) - 1
+			fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, ackID)
+		case "/services/collector/ack":
+			acks <- string(body)
+			// The first batch is never acknowledged, so it should be resent;
+			// the second is acknowledged on its second poll.
+			acked := atomic.LoadInt32(&events) > 1 && atomic.AddInt32(&polls, 1) > 1
+			fmt.Fprintf(w, `{"acks":{"%d":%v}}`, atomic.LoadInt32(&events)-1, acked)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	w, err := logger.NewSplunkWriter(server.URL, logger.SplunkOptions{
+		Token:           "token",
+		UseAck:          true,
+		AckTimeout:      50 * time.Millisecond,
+		AckPollInterval: 5 * time.Millisecond,
+		MinBackoff:      time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte(`{"event":"first"}`))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual := atomic.LoadInt32(&events); actual != 2 {
+		t.Errorf("expected the batch to be resent once, got %v sends", actual)
+	}
+
+	channel := <-channels
+	if len(channel) != 36 {
+		t.Errorf("expected a GUID channel, got %q", channel)
+	}
+	for len(channels) > 0 {
+		if other := <-channels; other != channel {
+			t.Errorf("expected every request on channel %v, got %v", channel, other)
+		}
+	}
+	if first := <-acks; first != `{"acks":[0]}` {
+		t.Errorf("unexpected ack request: %v", first)
+	}
+}
+
+// Awaiting acknowledgement must not delay logging.
+func Test_SplunkAckDoesNotBlockWrite(t *testing.T) {
+	var events int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services/collector/event":
+			ackID := atomic.AddInt32(&events, 1) - 1
+			fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, ackID)
+		case "/services/collector/ack":
+			w.Write([]byte(`{"acks":{}}`))
+		}
+	}))
+	defer server.Close()
+
+	w, err := logger.NewSplunkWriter(server.URL, logger.SplunkOptions{
+		UseAck:          true,
+		AckTimeout:      time.Minute,
+		AckPollInterval: time.Millisecond,
+		BatchSize:       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		w.Write([]byte(`{"event":"entry"}`))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected writes to return immediately, took %v", elapsed)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&events) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 4 batches to be sent before any were acknowledged, got %v", atomic.LoadInt32(&events))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_SplunkAckDisabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer server.Close()
+
+	w, err := logger.NewSplunkWriter(server.URL, logger.SplunkOptions{
+		UseAck:  true,
+		Channel: "channel",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte(`{"event":"first"}`))
+	if err := w.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func Test_SplunkRetry(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   int
+		attempts int32
+	}{
+		{"server busy", http.StatusServiceUnavailable, 3},
+		{"invalid token", http.StatusForbidden, 1},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) < 3 {
+					w.WriteHeader(testCase.status)
+					return
+				}
+				w.Write([]byte(`{"text":"Success","code":0}`))
+			}))
+			defer server.Close()
+
+			w, err := logger.NewSplunkWriter(server.URL, logger.SplunkOptions{
+				MinBackoff: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeWriter(w)
+			w.Write([]byte(`{"event":"first"}`))
+			err = w.Flush()
+			if actual := atomic.LoadInt32(&attempts); actual != testCase.attempts {
+				t.Errorf("expected %v attempts, got %v", testCase.attempts, actual)
+			}
+			if (err != nil) != (testCase.status == http.StatusForbidden) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// MaxRetries must be passed through to the retry helper (see Test_Retry).
+func Test_SplunkMaxRetries(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	w, err := logger.NewSplunkWriter(server.URL, logger.SplunkOptions{
+		MaxRetries: 1,
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeWriter(w)
+	w.Write([]byte(`{"event":"first"}`))
+	if err := w.Flush(); err == nil {
+		t.Error("expected an error")
+	}
+	if actual := atomic.LoadInt32(&attempts); actual != 2 {
+		t.Errorf("expected 2 attempts, got %v", actual)
+	}
+}
+
+// CloseContext must stop awaiting acknowledgements, and stop polling, once its
+// context is done, and report the batches that were never acknowledged.
+func Test_SplunkCloseContextStopsAckWait(t *testing.T) {
+	var polls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services/collector/event":
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":0}`))
+		case "/services/collector/ack":
+			atomic.AddInt32(&polls, 1)
+			w.Write([]byte(`{"acks":{"0":false}}`))
+		}
+	}))
+	defer server.Close()
+
+	failed := make(chan string, 4)
+	w, err := logger.NewSplunkWriter(server.URL, logger.SplunkOptions{
+		UseAck:          true,
+		AckTimeout:      time.Minute,
+		AckPollInterval: time.Millisecond,
+		ErrorHandler: func(err error, entry []byte) {
+			failed <- string(entry)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(`{"event":"first"}`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := w.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected CloseContext to return promptly, took %v", elapsed)
+	}
+	select {
+	case entry := <-failed:
+		if entry != `{"event":"first"}` {
+			t.Errorf("expected the unacknowledged event to be reported, got %q", entry)
+		}
+	default:
+		t.Error("expected the unacknowledged event to be reported")
+	}
+
+	// A poll that was abandoned may still reach the server.
+	time.Sleep(20 * time.Millisecond)
+	polled := atomic.LoadInt32(&polls)
+	if polled == 0 {
+		t.Error("expected the acknowledgement to be polled for")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if actual := atomic.LoadInt32(&polls); actual != polled {
+		t.Errorf("expected polling to stop, got %v more polls", actual-polled)
+	}
+}
+
+func Test_SplunkMalformedEndpoint(t *testing.T) {
+	if _, err := logger.InitializeSplunk("splunk:8088", "token", syslogServiceContext); err == nil {
+		t.Error("expected an error")
+	}
+}
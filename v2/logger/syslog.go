@@ -0,0 +1,444 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SyslogFormat defines the syslog message format that is written.
+type SyslogFormat int
+
+// SyslogFormat constants.
+const (
+	// SyslogRFC5424 writes messages in the format defined by RFC 5424, with
+	// site, operation, and fields carried as structured data.
+	SyslogRFC5424 SyslogFormat = iota
+
+	// SyslogRFC3164 writes messages in the legacy BSD format defined by
+	// RFC 3164. Since this format has no structured data, the structured
+	// data element is written at the start of the message instead.
+	SyslogRFC3164
+)
+
+// SyslogFacility defines the syslog facility that messages are written to.
+type SyslogFacility int
+
+// SyslogFacility constants.
+const (
+	SyslogFacilityUser   SyslogFacility = 1
+	SyslogFacilityDaemon SyslogFacility = 3
+	SyslogFacilityLocal0 SyslogFacility = 16
+	SyslogFacilityLocal1 SyslogFacility = 17
+	SyslogFacilityLocal2 SyslogFacility = 18
+	SyslogFacilityLocal3 SyslogFacility = 19
+	SyslogFacilityLocal4 SyslogFacility = 20
+	SyslogFacilityLocal5 SyslogFacility = 21
+	SyslogFacilityLocal6 SyslogFacility = 22
+	SyslogFacilityLocal7 SyslogFacility = 23
+)
+
+// defaultStructuredDataID is the SD-ID of the structured data element that
+// carries nobslogger's fields. 32473 is the private enterprise number that
+// IANA reserves for documentation.
+const defaultStructuredDataID = "nobslogger@32473"
+
+// SyslogOptions exposes configuration settings for syslog output.
+type SyslogOptions struct {
+	// Format is the message format. The default is SyslogRFC5424.
+	Format SyslogFormat
+
+	// Facility is the facility that messages are written to. The zero value
+	// defaults to SyslogFacilityUser.
+	Facility SyslogFacility
+
+	// Hostname is written to the HOSTNAME field of each message. Defaults to
+	// the name reported by os.Hostname.
+	Hostname string
+
+	// StructuredDataID is the SD-ID of the structured data element that
+	// carries the site, operation, and fields of each entry. Defaults to
+	// "nobslogger@32473".
+	StructuredDataID string
+}
+
+// InitializeSyslog establishes a connection to a syslog server, and returns a
+// LogService instance through which more detailed logging contexts can be
+// spawned (see NewContext).
+//
+// Each entry is written as a syslog message. The ServiceName is written to
+// APP-NAME, the ServiceInstanceID is written to PROCID, and the entry's
+// severity is mapped to the nearest syslog severity. The site, operation,
+// environment, system name, level, and any fields are written as structured
+// data, and the message is followed by the details (if any).
+//
+// network must be one of:
+//
+// "udp": Each message is sent as a single datagram (see InitializeUDP).
+//
+// "tcp": Messages are framed using octet counting (see TCPWriter).
+//
+// "unix" (or ""): Messages are written to the local syslog socket. If address
+// is empty, /dev/log, /var/run/syslog, and /var/run/log are tried in turn.
+//
+// An error is returned if the address is malformed, or if the local syslog
+// socket can't be reached.
+func InitializeSyslog(network, address string, serviceContext ServiceContext) (LogService, error) {
+	return InitializeSyslogWithOptions(network, address, serviceContext, defaultLogServiceOptions(), SyslogOptions{})
+}
+
+// InitializeSyslogWithOptions is the same as InitializeSyslog, but with
+// custom LogServiceOptions and SyslogOptions supplied. The Framing and
+// Encoder options are ignored, as each network requires its own framing. See
+// InitializeSyslog.
+func InitializeSyslogWithOptions(network, address string, serviceContext ServiceContext, options LogServiceOptions, syslogOptions SyslogOptions) (LogService, error) {
+	enc := newSyslogEncoder(syslogOptions)
+	switch network {
+	case "udp":
+		w, err := NewUDPWriter(address, UDPWriterOptions{
+			ResolveInterval: defaultResolveInterval,
+		})
+		if err != nil {
+			return LogService{}, err
+		}
+		options.Framing = FramingNone
+		options.Encoder = enc
+		return InitializeWriterWithOptions(w, serviceContext, options), nil
+	case "tcp":
+		w, err := NewTCPWriter(address, TCPWriterOptions{})
+		if err != nil {
+			return LogService{}, err
+		}
+		options.Framing = FramingOctetCounting
+		options.Encoder = enc
+		return InitializeWriterWithOptions(w, serviceContext, options), nil
+	case "unix", "":
+		w, err := newLocalSyslogWriter(address)
+		if err != nil {
+			return LogService{}, err
+		}
+		// Local syslog daemons don't expect a HOSTNAME in RFC 3164 messages.
+		enc.omitHostname = true
+		options.Framing = FramingNewline
+		options.Encoder = enc
+		return InitializeWriterWithOptions(w, serviceContext, options), nil
+	default:
+		return LogService{}, fmt.Errorf("nobslogger: unsupported syslog network %q", network)
+	}
+}
+
+// syslogEncoder encodes entries as syslog messages.
+type syslogEncoder struct {
+	format       SyslogFormat
+	facility     int
+	hostname     string
+	omitHostname bool
+	sdID         string
+}
+
+// NewSyslogEncoder returns an Encoder that encodes entries as syslog messages
+// (see InitializeSyslog). NewSyslogEncoder can be used to write syslog
+// messages to writers other than those supported by InitializeSyslog.
+func NewSyslogEncoder(options SyslogOptions) Encoder {
+	return newSyslogEncoder(options)
+}
+
+func newSyslogEncoder(options SyslogOptions) *syslogEncoder {
+	if options.Facility == 0 {
+		options.Facility = SyslogFacilityUser
+	}
+	if options.Hostname == "" {
+		options.Hostname, _ = os.Hostname()
+	}
+	if options.StructuredDataID == "" {
+		options.StructuredDataID = defaultStructuredDataID
+	}
+	return &syslogEncoder{
+		format:   options.Format,
+		facility: int(options.Facility),
+		hostname: string(appendSyslogHeaderField(nil, options.Hostname, 255)),
+		sdID:     string(appendSyslogName(nil, options.StructuredDataID)),
+	}
+}
+
+func (e *syslogEncoder) begin(buffer []byte, r record) []byte {
+	buffer = append(buffer, '<')
+	buffer = strconv.AppendInt(buffer, int64(e.facility*8+syslogSeverity(r.detail)), 10)
+	buffer = append(buffer, '>')
+	if e.format == SyslogRFC3164 {
+		buffer = appendRFC3164Timestamp(buffer, r.timestamp)
+		buffer = append(buffer, ' ')
+		if !e.omitHostname {
+			buffer = append(buffer, e.hostname...)
+			buffer = append(buffer, ' ')
+		}
+		buffer = appendSyslogHeaderField(buffer, r.sc.ServiceName, 32)
+		if r.sc.ServiceInstanceID != "" {
+			buffer = append(buffer, '[')
+			buffer = appendSyslogHeaderField(buffer, r.sc.ServiceInstanceID, 128)
+			buffer = append(buffer, ']')
+		}
+		buffer = append(buffer, ": "...)
+	} else {
+		buffer = append(buffer, "1 "...)
+		// RFC 5424 permits at most six digits of fractional seconds.
+		buffer = appendTimestamp(buffer, r.timestamp, 6)
+		buffer = append(buffer, ' ')
+		buffer = append(buffer, e.hostname...)
+		buffer = append(buffer, ' ')
+		buffer = appendSyslogHeaderField(buffer, r.sc.ServiceName, 48)
+		buffer = append(buffer, ' ')
+		buffer = appendSyslogHeaderField(buffer, r.sc.ServiceInstanceID, 128)
+		buffer = append(buffer, " - "...)
+	}
+	buffer = append(buffer, '[')
+	buffer = append(buffer, e.sdID...)
+	buffer = appendSyslogEscapedParam(buffer, "site", r.site)
+	buffer = appendSyslogEscapedParam(buffer, "operation", r.operation)
+	buffer = appendSyslogEscapedParam(buffer, "environment", r.sc.Environment)
+	buffer = appendSyslogEscapedParam(buffer, "system_name", r.sc.SystemName)
+	buffer = appendSyslogEscapedParam(buffer, "level", string(r.detail.Level))
+	return buffer
+}
+
+func (e *syslogEncoder) field(buffer []byte, f Field) []byte {
+	buffer = append(buffer, ' ')
+	buffer = appendSyslogName(buffer, f.key)
+	buffer = append(buffer, "=\""...)
+	switch f.kind {
+	case fieldKindString:
+		buffer = appendSyslogParamValue(buffer, f.str)
+	case fieldKindInt64, fieldKindDuration:
+		buffer = strconv.AppendInt(buffer, f.integer, 10)
+	case fieldKindFloat64:
+		buffer = strconv.AppendFloat(buffer, f.float, 'g', -1, 64)
+	case fieldKindBool:
+		buffer = strconv.AppendBool(buffer, f.integer != 0)
+	case fieldKindTime:
+		buffer = f.time.AppendFormat(buffer, time.RFC3339Nano)
+	}
+	return append(buffer, '"')
+}
+
+func (e *syslogEncoder) end(buffer []byte, r record, truncated bool) []byte {
+	if truncated {
+		buffer = append(buffer, " truncated=\"true\""...)
+	}
+	buffer = append(buffer, "] "...)
+	buffer = appendSyslogMessage(buffer, r.detail.Message, r.detail.escaped)
+	if r.detail.Details != "" {
+		buffer = append(buffer, ' ')
+		buffer = appendSyslogMessage(buffer, r.detail.Details, r.detail.escaped)
+	}
+	return buffer
+}
+
+// appendSyslogMessage appends a message or its details. If escaped is set,
+// the escaping applied by the J methods is reversed, except for that of
+// control characters (such as newlines), which remain escaped so that the
+// message stays on a single line.
+func appendSyslogMessage(buffer []byte, s string, escaped bool) []byte {
+	if !escaped {
+		return append(buffer, s...)
+	}
+	for i := 0; i < len(s); {
+		start := i
+		var c byte
+		c, i = unescapeAt(s, i)
+		if c < 0x20 {
+			buffer = append(buffer, s[start:i]...)
+			continue
+		}
+		buffer = append(buffer, c)
+	}
+	return buffer
+}
+
+// syslogSeverity maps an entry's severity onto the syslog severities. There
+// is no syslog equivalent for trace, so trace entries are written as debug.
+func syslogSeverity(ld LogDetail) int {
+	switch ld.Severity {
+	case LogSeverityTrace, LogSeverityDebug:
+		return 7
+	case LogSeverityInfo:
+		return 6
+	case LogSeverityWarn:
+		return 4
+	case LogSeverityError:
+		return 3
+	case LogSeverityFatal:
+		return 2
+	}
+	switch rank := ld.Level.rank(); {
+	case rank >= LogLevelFatal.rank():
+		return 2
+	case rank >= LogLevelError.rank():
+		return 3
+	case rank >= LogLevelWarn.rank():
+		return 4
+	case rank >= LogLevelInfo.rank():
+		return 6
+	default:
+		return 7
+	}
+}
+
+var syslogMonths = [...]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+
+// appendRFC3164Timestamp converts an RFC 3339 timestamp to the "Mmm dd
+// hh:mm:ss" format of RFC 3164.
+func appendRFC3164Timestamp(buffer []byte, timestamp []byte) []byte {
+	if len(timestamp) < len("2006-01-02T15:04:05") {
+		return append(buffer, timestamp...)
+	}
+	month := int(timestamp[5]-'0')*10 + int(timestamp[6]-'0')
+	if month < 1 || month > 12 {
+		return append(buffer, timestamp...)
+	}
+	buffer = append(buffer, syslogMonths[month-1]...)
+	buffer = append(buffer, ' ')
+	if timestamp[8] == '0' {
+		buffer = append(buffer, ' ')
+	} else {
+		buffer = append(buffer, timestamp[8])
+	}
+	buffer = append(buffer, timestamp[9], ' ')
+	return append(buffer, timestamp[11:19]...)
+}
+
+// appendSyslogHeaderField appends a header field (such as APP-NAME),
+// replacing any characters that are not printable US-ASCII, and truncating
+// the field to maxLength bytes. Empty fields are written as "-".
+func appendSyslogHeaderField(buffer []byte, s string, maxLength int) []byte {
+	if s == "" {
+		return append(buffer, '-')
+	}
+	if len(s) > maxLength {
+		s = s[:maxLength]
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 33 || s[i] > 126 {
+			buffer = append(buffer, '_')
+		} else {
+			buffer = append(buffer, s[i])
+		}
+	}
+	return buffer
+}
+
+// appendSyslogName appends an SD-NAME, replacing any characters that are not
+// permitted, and truncating the name to 32 bytes.
+func appendSyslogName(buffer []byte, s string) []byte {
+	if len(s) > 32 {
+		s = s[:32]
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c < 33 || c > 126 || c == '=' || c == ']' || c == '"':
+			buffer = append(buffer, '_')
+		default:
+			buffer = append(buffer, c)
+		}
+	}
+	return buffer
+}
+
+// appendSyslogEscapedParam appends an SD-PARAM whose value has already been
+// escaped for JSON (see escape). Since JSON escaping already takes care of
+// '"' and '\', only ']' remains to be escaped.
+func appendSyslogEscapedParam(buffer []byte, name, value string) []byte {
+	buffer = append(buffer, ' ')
+	buffer = append(buffer, name...)
+	buffer = append(buffer, "=\""...)
+	for i := 0; i < len(value); i++ {
+		if value[i] == ']' {
+			buffer = append(buffer, '\\')
+		}
+		buffer = append(buffer, value[i])
+	}
+	return append(buffer, '"')
+}
+
+// appendSyslogParamValue appends an unescaped PARAM-VALUE, escaping the
+// characters that RFC 5424 reserves.
+func appendSyslogParamValue(buffer []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\\', ']':
+			buffer = append(buffer, '\\')
+		}
+		buffer = append(buffer, s[i])
+	}
+	return buffer
+}
+
+// localSyslogWriter is an io.WriteCloser that writes to the local syslog
+// socket. If a write fails (i.e. because the syslog daemon was restarted),
+// the socket is redialed, and the write is retried once.
+type localSyslogWriter struct {
+	address string
+	mu      sync.Mutex
+	conn    net.Conn
+	closed  bool
+}
+
+func newLocalSyslogWriter(address string) (*localSyslogWriter, error) {
+	w := &localSyslogWriter{address: address}
+	conn, err := w.dial()
+	if err != nil {
+		return nil, err
+	}
+	w.conn = conn
+	return w, nil
+}
+
+func (w *localSyslogWriter) dial() (net.Conn, error) {
+	addresses := []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+	if w.address != "" {
+		addresses = []string{w.address}
+	}
+	for _, address := range addresses {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, address); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("nobslogger: unable to connect to local syslog socket %v", addresses)
+}
+
+func (w *localSyslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	if w.conn != nil {
+		if n, err := w.conn.Write(p); err == nil {
+			return n, nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	conn, err := w.dial()
+	if err != nil {
+		return 0, err
+	}
+	w.conn = conn
+	return w.conn.Write(p)
+}
+
+func (w *localSyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
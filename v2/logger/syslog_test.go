@@ -0,0 +1,200 @@
+package logger_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+var syslogServiceContext = logger.ServiceContext{
+	Environment:       "test",
+	SystemName:        "system",
+	ServiceName:       "billing",
+	ServiceInstanceID: "instance-1",
+}
+
+func Test_SyslogRFC5424(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeSyslogWithOptions("udp", listener.LocalAddr().String(), syslogServiceContext,
+		logger.LogServiceOptions{}, logger.SyslogOptions{Hostname: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.WarnF("message", "details", logger.Int64("user", 42), logger.String("quote", `a"b]c\`))
+
+	actual := receiveUDP(t, listener)
+	expected := regexp.MustCompile(`^<12>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(\.\d{1,6})?(Z|[+-]\d\d:\d\d) host billing instance-1 - ` +
+		regexp.QuoteMeta(`[nobslogger@32473 site="context site" operation="operation" environment="test" system_name="system" level="400" user="42" quote="a\"b\]c\\"] message details`) + `$`)
+	if !expected.MatchString(actual) {
+		t.Errorf("unexpected message: %v", actual)
+	}
+}
+
+func Test_SyslogRFC3164(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeSyslogWithOptions("udp", listener.LocalAddr().String(), syslogServiceContext,
+		logger.LogServiceOptions{}, logger.SyslogOptions{
+			Format:   logger.SyslogRFC3164,
+			Facility: logger.SyslogFacilityLocal0,
+			Hostname: "host",
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.Error("message")
+
+	actual := receiveUDP(t, listener)
+	expected := regexp.MustCompile(`^<131>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d host billing\[instance-1\]: ` +
+		regexp.QuoteMeta(`[nobslogger@32473 site="context site" operation="operation" environment="test" system_name="system" level="500"] message`) + `$`)
+	if !expected.MatchString(actual) {
+		t.Errorf("unexpected message: %v", actual)
+	}
+}
+
+// Messages and details escaped by the J methods must be written as supplied,
+// except for control characters, which must not break the message across
+// lines.
+func Test_SyslogUnescapesJ(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeSyslogWithOptions("udp", listener.LocalAddr().String(), syslogServiceContext,
+		logger.LogServiceOptions{}, logger.SyslogOptions{Hostname: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.WarnJ(`say "hi" \ bye`, "line\nbreak")
+
+	actual := receiveUDP(t, listener)
+	if !strings.HasSuffix(actual, `] say "hi" \ bye line\nbreak`) {
+		t.Errorf("unexpected message: %q", actual)
+	}
+}
+
+func Test_SyslogSeverities(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeSyslog("udp", listener.LocalAddr().String(), syslogServiceContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	testCases := []struct {
+		write    func(string)
+		priority string
+	}{
+		{log.Trace, "<15>"},
+		{log.Debug, "<15>"},
+		{log.Info, "<14>"},
+		{log.Warn, "<12>"},
+		{log.Error, "<11>"},
+		{log.Fatal, "<10>"},
+	}
+	for _, testCase := range testCases {
+		testCase.write("message")
+		actual := receiveUDP(t, listener)
+		if actual[:4] != testCase.priority {
+			t.Errorf("expected priority %v, got %v", testCase.priority, actual)
+		}
+	}
+}
+
+// Over TCP, each message must be preceded by its length and a space.
+func Test_SyslogTCPOctetCounting(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeSyslog("tcp", listener.Addr().String(), syslogServiceContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.InfoD("first", "line one\nline two")
+	log.Info("second")
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"first line one\nline two", "second"} {
+		count, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, err := strconv.Atoi(count[:len(count)-1])
+		if err != nil {
+			t.Fatalf("expected an octet count, got %q", count)
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(`^<14>1 .*\] ` + regexp.QuoteMeta(expected) + `$`).Match(message) {
+			t.Errorf("unexpected message: %s", message)
+		}
+	}
+	loggerService.Close(context.Background())
+}
+
+func Test_SyslogUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nobslogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeSyslogWithOptions("unix", path, syslogServiceContext,
+		logger.LogServiceOptions{}, logger.SyslogOptions{Format: logger.SyslogRFC3164})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("message")
+
+	buffer := make([]byte, 64*1024)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := listener.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The hostname is omitted for the local socket.
+	expected := regexp.MustCompile(`^<14>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d billing\[instance-1\]: \[.*\] message\n$`)
+	if !expected.Match(buffer[:n]) {
+		t.Errorf("unexpected message: %q", buffer[:n])
+	}
+	loggerService.Close(context.Background())
+}
+
+func Test_SyslogUnsupportedNetwork(t *testing.T) {
+	if _, err := logger.InitializeSyslog("sctp", "localhost:514", syslogServiceContext); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,384 @@
+package logger
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrBufferFull is returned by a TCPWriter when it is disconnected and its
+// buffer cannot hold any more entries, and by the batching writers (such as
+// OTLPWriter) when their batches cannot be sent as fast as they are filled.
+var ErrBufferFull = errors.New("nobslogger: buffer full")
+
+// ConnectionState describes the state of a network writer's connection.
+type ConnectionState int32
+
+// ConnectionState constants.
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int32(s))
+	}
+}
+
+// TCPWriterOptions exposes configuration settings for a TCPWriter.
+type TCPWriterOptions struct {
+	// MinBackoff is the delay before the first reconnection attempt after a
+	// failure. Each subsequent attempt doubles the delay, up to MaxBackoff.
+	// Delays are jittered by up to half of their duration. Defaults to 100ms.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the longest delay between reconnection attempts.
+	// Defaults to 30s.
+	MaxBackoff time.Duration
+
+	// BufferSize is the maximum number of bytes of entries that are held
+	// while disconnected. Entries that would exceed this size are rejected
+	// with ErrBufferFull. Defaults to 1MiB.
+	BufferSize int
+
+	// DialTimeout bounds each connection attempt. Defaults to 10s.
+	DialTimeout time.Duration
+
+	// WriteTimeout bounds each write. Defaults to 10s.
+	WriteTimeout time.Duration
+
+	// OnStateChange, if set, is called whenever the connection state changes.
+	// It is called from the goroutine that caused the change, and must not
+	// call back into the TCPWriter.
+	OnStateChange func(ConnectionState)
+
+	// Dial is used to establish connections. Defaults to a net.Dialer with
+	// the DialTimeout.
+	Dial func(network, address string) (net.Conn, error)
+
+	// TLSConfig, if set, causes every connection to be secured with TLS. The
+	// handshake is bounded by DialTimeout, and a failed handshake is retried
+	// with backoff like any other connection failure. If TLSConfig.ServerName
+	// is empty, the host name from hostURI is used.
+	TLSConfig *tls.Config
+}
+
+// TCPWriter is an io.WriteCloser that transmits entries over a TCP
+// connection.
+//
+// TCPWriter connects in the background, and reconnects with jittered
+// exponential backoff whenever the connection fails. While disconnected,
+// entries are buffered (up to TCPWriterOptions.BufferSize bytes) and are
+// transmitted, in order, once the connection is re-established.
+//
+// If TCPWriterOptions.TLSConfig is set, connections are secured with TLS.
+//
+// Since TCP is a stream protocol, entries must be framed (see
+// LogServiceOptions.Framing) so that they can be told apart downstream.
+type TCPWriter struct {
+	network string
+	hostURI string
+	options TCPWriterOptions
+	done    chan struct{}
+
+	// writeMu serializes writes to the connection, so that entries are
+	// transmitted whole and in order. mu guards the remaining fields, and is
+	// never held while writing to the connection, so that State and Close
+	// are not held up by a slow peer.
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	conn     net.Conn
+	state    ConnectionState
+	buffer   []byte
+	flushing int
+}
+
+// NewTCPWriter returns a TCPWriter that transmits to the specified host. The
+// connection is established in the background; entries written in the
+// meantime are buffered.
+//
+// hostURI: Must be a fully qualified URI including port.
+func NewTCPWriter(hostURI string, options TCPWriterOptions) (*TCPWriter, error) {
+	return newTCPWriter("tcp", hostURI, options)
+}
+
+func newTCPWriter(network, hostURI string, options TCPWriterOptions) (*TCPWriter, error) {
+	if _, _, err := net.SplitHostPort(hostURI); err != nil {
+		return nil, fmt.Errorf("nobslogger: invalid host %q: %v", hostURI, err)
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaultMinBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = options.MinBackoff
+	}
+	if options.BufferSize <= 0 {
+		options.BufferSize = 1024 * 1024
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = 10 * time.Second
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = 10 * time.Second
+	}
+	if options.Dial == nil {
+		dialer := &net.Dialer{Timeout: options.DialTimeout}
+		options.Dial = dialer.Dial
+	}
+	if options.TLSConfig != nil {
+		options.Dial = dialTLS(options.Dial, options.TLSConfig, hostURI, options.DialTimeout)
+	}
+	w := &TCPWriter{
+		network: network,
+		hostURI: hostURI,
+		options: options,
+		done:    make(chan struct{}),
+		state:   StateConnecting,
+	}
+	go w.connect()
+	return w, nil
+}
+
+// dialTLS wraps dial so that each connection it establishes is secured with
+// TLS before being returned.
+func dialTLS(dial func(network, address string) (net.Conn, error), config *tls.Config, hostURI string, timeout time.Duration) func(network, address string) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(hostURI)
+		config.ServerName = host
+	}
+	return func(network, address string) (net.Conn, error) {
+		conn, err := dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
+
+// State returns the current state of the connection.
+func (w *TCPWriter) State() ConnectionState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+// Write transmits p if connected, or buffers it otherwise. If the write
+// fails, p is buffered, and the TCPWriter starts reconnecting.
+func (w *TCPWriter) Write(p []byte) (int, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	for {
+		w.mu.Lock()
+		switch w.state {
+		case StateClosed:
+			w.mu.Unlock()
+			return 0, ErrWriterClosed
+		case StateConnected:
+			conn := w.conn
+			w.mu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(w.options.WriteTimeout))
+			if _, err := conn.Write(p); err == nil {
+				return len(p), nil
+			}
+			w.mu.Lock()
+			if w.conn != conn {
+				// The connection was closed (by Close or watch) while it
+				// was being written to; start over in the current state.
+				w.mu.Unlock()
+				continue
+			}
+			// The entry may have been partially transmitted. It is resent
+			// in full once reconnected, as a partial entry is of no use
+			// downstream.
+			w.conn.Close()
+			w.conn = nil
+			w.state = StateDisconnected
+			fits := w.fits(p)
+			if fits {
+				w.buffer = append(w.buffer, p...)
+			}
+			w.mu.Unlock()
+			w.notify(StateDisconnected)
+			go w.connect()
+			if !fits {
+				return 0, ErrBufferFull
+			}
+			return len(p), nil
+		default:
+			if !w.fits(p) {
+				w.mu.Unlock()
+				return 0, ErrBufferFull
+			}
+			w.buffer = append(w.buffer, p...)
+			w.mu.Unlock()
+			return len(p), nil
+		}
+	}
+}
+
+// fits reports whether p can be buffered without exceeding BufferSize,
+// counting any entries that are being transmitted by flush. fits must be
+// called with w.mu held.
+func (w *TCPWriter) fits(p []byte) bool {
+	return w.flushing+len(w.buffer)+len(p) <= w.options.BufferSize
+}
+
+// Close closes the connection, and stops any reconnection attempts. If any
+// entries are still buffered, they are discarded, and an error is returned.
+func (w *TCPWriter) Close() error {
+	w.mu.Lock()
+	if w.state == StateClosed {
+		w.mu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.state = StateClosed
+	var err error
+	if w.conn != nil {
+		err = w.conn.Close()
+		w.conn = nil
+	}
+	if buffered := w.flushing + len(w.buffer); buffered > 0 && err == nil {
+		err = fmt.Errorf("nobslogger: %d bytes of buffered entries discarded", buffered)
+	}
+	w.buffer = nil
+	w.mu.Unlock()
+	w.notify(StateClosed)
+	return err
+}
+
+// notify reports a state change to OnStateChange. notify must be called
+// without w.mu held.
+func (w *TCPWriter) notify(state ConnectionState) {
+	if w.options.OnStateChange != nil {
+		w.options.OnStateChange(state)
+	}
+}
+
+// connect dials until a connection is established (or the TCPWriter is
+// closed), then transmits any buffered entries.
+func (w *TCPWriter) connect() {
+	backoff := newBackoff(w.options.MinBackoff, w.options.MaxBackoff)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-w.done:
+				return
+			case <-time.After(backoff.delay()):
+			}
+		}
+
+		conn, err := w.options.Dial(w.network, w.hostURI)
+		if err != nil {
+			continue
+		}
+
+		if !w.flush(conn) {
+			conn.Close()
+			continue
+		}
+		w.notify(StateConnected)
+		go w.watch(conn)
+		return
+	}
+}
+
+// flush transmits the buffered entries over conn, and then marks the
+// TCPWriter as connected. The buffer is swapped out before it is transmitted,
+// so that w.mu is not held during the write; entries written in the meantime
+// are buffered in turn, and transmitted in the next pass. flush reports
+// whether the TCPWriter is now connected.
+func (w *TCPWriter) flush(conn net.Conn) bool {
+	for {
+		w.mu.Lock()
+		if w.state == StateClosed {
+			w.mu.Unlock()
+			return false
+		}
+		// conn is published before it is written to so that Close can
+		// interrupt the write. Write only uses w.conn once connected.
+		w.conn = conn
+		if len(w.buffer) == 0 {
+			w.state = StateConnected
+			w.mu.Unlock()
+			return true
+		}
+		backlog := w.buffer
+		w.buffer = nil
+		w.flushing = len(backlog)
+		w.mu.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(w.options.WriteTimeout))
+		_, err := conn.Write(backlog)
+
+		w.mu.Lock()
+		w.flushing = 0
+		if err != nil {
+			if w.conn == conn {
+				w.conn = nil
+			}
+			// As in Write, the backlog may have been partially transmitted,
+			// so it is kept, and resent in full on the next connection.
+			if w.state != StateClosed {
+				w.buffer = append(backlog, w.buffer...)
+			}
+			w.mu.Unlock()
+			return false
+		}
+		if w.buffer == nil {
+			w.buffer = backlog[:0]
+		}
+		w.mu.Unlock()
+	}
+}
+
+// watch detects when the remote end closes the connection. Without it, a
+// closed connection would only be noticed when a write fails, by which time
+// at least one entry may have been silently lost.
+func (w *TCPWriter) watch(conn net.Conn) {
+	buffer := make([]byte, 512)
+	for {
+		if _, err := conn.Read(buffer); err != nil {
+			break
+		}
+	}
+
+	w.mu.Lock()
+	if w.conn != conn {
+		// The connection was already replaced or closed.
+		w.mu.Unlock()
+		return
+	}
+	w.conn.Close()
+	w.conn = nil
+	w.state = StateDisconnected
+	w.mu.Unlock()
+	w.notify(StateDisconnected)
+	w.connect()
+}
@@ -0,0 +1,385 @@
+package logger_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func listenTCP(t *testing.T, address string) net.Listener {
+	t.Helper()
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func acceptLines(t *testing.T, listener net.Listener) (net.Conn, *bufio.Scanner) {
+	t.Helper()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewScanner(conn)
+}
+
+func waitForState(t *testing.T, w *logger.TCPWriter, state logger.ConnectionState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state %v, got %v", state, w.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_InitializeTCPWritesJSONLines(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeTCP(listener.Addr().String(), logger.ServiceContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("first")
+	log.Info("second")
+
+	conn, lines := acceptLines(t, listener)
+	defer conn.Close()
+	for _, expected := range []string{"first", "second"} {
+		if !lines.Scan() {
+			t.Fatalf("expected a line: %v", lines.Err())
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			t.Fatalf("Error: %v\nJSON: %s", err, lines.Bytes())
+		}
+		if entry["msg"] != expected {
+			t.Errorf("expected %v, got %v", expected, entry["msg"])
+		}
+	}
+	loggerService.Close(context.Background())
+}
+
+func Test_InitializeTCPRejectsMalformedHost(t *testing.T) {
+	if _, err := logger.InitializeTCP("no port", logger.ServiceContext{}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// Entries written before the server is available must be delivered, in order,
+// once the connection is established.
+func Test_TCPWriterBuffersWhileDisconnected(t *testing.T) {
+	reserved := listenTCP(t, "")
+	address := reserved.Addr().String()
+	reserved.Close()
+
+	w, err := logger.NewTCPWriter(address, logger.TCPWriterOptions{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("first\n"))
+	w.Write([]byte("second\n"))
+	if state := w.State(); state == logger.StateConnected {
+		t.Fatalf("expected writer to be disconnected, got %v", state)
+	}
+
+	listener := listenTCP(t, address)
+	defer listener.Close()
+	conn, lines := acceptLines(t, listener)
+	defer conn.Close()
+	waitForState(t, w, logger.StateConnected)
+	w.Write([]byte("third\n"))
+
+	for _, expected := range []string{"first", "second", "third"} {
+		if !lines.Scan() {
+			t.Fatalf("expected a line: %v", lines.Err())
+		}
+		if lines.Text() != expected {
+			t.Errorf("expected %v, got %v", expected, lines.Text())
+		}
+	}
+}
+
+// partialConn transmits only the first half of a write, then fails, as a
+// connection that is closed partway through a write would.
+type partialConn struct {
+	net.Conn
+}
+
+func (c partialConn) Write(p []byte) (int, error) {
+	n, _ := c.Conn.Write(p[:len(p)/2])
+	c.Conn.Close()
+	return n, errors.New("test error")
+}
+
+// If the backlog is only partially transmitted, it must be resent in full,
+// rather than from partway through an entry.
+func Test_TCPWriterResendsPartialBacklog(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+
+	ready := make(chan struct{})
+	var dials int32
+	w, err := logger.NewTCPWriter(listener.Addr().String(), logger.TCPWriterOptions{
+		MinBackoff: time.Millisecond,
+		Dial: func(network, address string) (net.Conn, error) {
+			<-ready
+			conn, err := net.Dial(network, address)
+			if err != nil || atomic.AddInt32(&dials, 1) > 1 {
+				return conn, err
+			}
+			return partialConn{conn}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("first\n"))
+	w.Write([]byte("second\n"))
+	close(ready)
+
+	conn, _ := acceptLines(t, listener)
+	conn.Close()
+	conn, lines := acceptLines(t, listener)
+	defer conn.Close()
+	for _, expected := range []string{"first", "second"} {
+		if !lines.Scan() {
+			t.Fatalf("expected a line: %v", lines.Err())
+		}
+		if lines.Text() != expected {
+			t.Errorf("expected %v, got %v", expected, lines.Text())
+		}
+	}
+}
+
+// If the server drops the connection, the writer must reconnect.
+func Test_TCPWriterReconnects(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+
+	var mu sync.Mutex
+	var states []logger.ConnectionState
+	w, err := logger.NewTCPWriter(listener.Addr().String(), logger.TCPWriterOptions{
+		MinBackoff: time.Millisecond,
+		OnStateChange: func(state logger.ConnectionState) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, state)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	conn, _ := acceptLines(t, listener)
+	waitForState(t, w, logger.StateConnected)
+	conn.Close()
+
+	conn, lines := acceptLines(t, listener)
+	defer conn.Close()
+	waitForState(t, w, logger.StateConnected)
+	w.Write([]byte("entry\n"))
+	if !lines.Scan() || lines.Text() != "entry" {
+		t.Errorf("expected entry, got %q (%v)", lines.Text(), lines.Err())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []logger.ConnectionState{logger.StateConnected, logger.StateDisconnected, logger.StateConnected}
+	if len(states) != len(expected) {
+		t.Fatalf("expected states %v, got %v", expected, states)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Errorf("expected states %v, got %v", expected, states)
+		}
+	}
+}
+
+func Test_TCPWriterBufferFull(t *testing.T) {
+	w, err := logger.NewTCPWriter("127.0.0.1:1", logger.TCPWriterOptions{
+		BufferSize: 10,
+		Dial: func(network, address string) (net.Conn, error) {
+			return nil, errors.New("test error")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.Write([]byte("0123456789")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := w.Write([]byte("0")); err != logger.ErrBufferFull {
+		t.Errorf("expected ErrBufferFull, got %v", err)
+	}
+}
+
+// Delays between reconnection attempts must grow exponentially.
+func Test_TCPWriterBacksOff(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []time.Time
+	w, err := logger.NewTCPWriter("127.0.0.1:1", logger.TCPWriterOptions{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 40 * time.Millisecond,
+		Dial: func(network, address string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, time.Now())
+			return nil, errors.New("test error")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) < 4 {
+		t.Fatalf("expected at least 4 attempts, got %v", len(attempts))
+	}
+	first := attempts[1].Sub(attempts[0])
+	third := attempts[3].Sub(attempts[2])
+	if third <= first {
+		t.Errorf("expected delays to grow, got %v then %v", first, third)
+	}
+}
+
+func Test_TCPWriterClose(t *testing.T) {
+	listener := listenTCP(t, "")
+	defer listener.Close()
+
+	w, err := logger.NewTCPWriter(listener.Addr().String(), logger.TCPWriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := acceptLines(t, listener)
+	defer conn.Close()
+	waitForState(t, w, logger.StateConnected)
+
+	if err := w.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if state := w.State(); state != logger.StateClosed {
+		t.Errorf("expected state %v, got %v", logger.StateClosed, state)
+	}
+	if _, err := w.Write([]byte("entry\n")); err != logger.ErrWriterClosed {
+		t.Errorf("expected ErrWriterClosed, got %v", err)
+	}
+}
+
+// pipeDial returns a Dial function whose connections accept writes only as
+// fast as they are read, which is never.
+func pipeDial(ready chan struct{}) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		<-ready
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+}
+
+// expectPromptly fails the test if fn does not return within a second.
+func expectPromptly(t *testing.T, name string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected %v to return promptly", name)
+	}
+}
+
+// A write that is held up by the peer must not hold up State or Close.
+func Test_TCPWriterBlockedWrite(t *testing.T) {
+	ready := make(chan struct{})
+	close(ready)
+	w, err := logger.NewTCPWriter("127.0.0.1:1", logger.TCPWriterOptions{
+		WriteTimeout: time.Minute,
+		Dial:         pipeDial(ready),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, w, logger.StateConnected)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("entry\n"))
+		written <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	expectPromptly(t, "State", func() { w.State() })
+	expectPromptly(t, "Close", func() { w.Close() })
+	select {
+	case err := <-written:
+		if err != logger.ErrWriterClosed {
+			t.Errorf("expected ErrWriterClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to interrupt the write")
+	}
+}
+
+// Transmitting the backlog on reconnection must not hold up State, Write or
+// Close.
+func Test_TCPWriterBlockedBacklog(t *testing.T) {
+	ready := make(chan struct{})
+	w, err := logger.NewTCPWriter("127.0.0.1:1", logger.TCPWriterOptions{
+		WriteTimeout: time.Minute,
+		Dial:         pipeDial(ready),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("first\n"))
+	close(ready)
+	time.Sleep(10 * time.Millisecond)
+
+	expectPromptly(t, "State", func() {
+		if state := w.State(); state != logger.StateConnecting {
+			t.Errorf("expected state %v, got %v", logger.StateConnecting, state)
+		}
+	})
+	expectPromptly(t, "Write", func() {
+		if _, err := w.Write([]byte("second\n")); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	expectPromptly(t, "Close", func() {
+		if err := w.Close(); err == nil {
+			t.Error("expected an error for the discarded entries")
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package logger_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+// selfSignedCertificate generates a certificate that is valid for the
+// specified DNS name (and 127.0.0.1), and that can be used by both servers
+// and clients.
+func selfSignedCertificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// acceptTLS accepts a connection, and completes the handshake.
+func acceptTLS(t *testing.T, listener net.Listener) (net.Conn, error) {
+	t.Helper()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.(*tls.Conn).Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func Test_InitializeTLSWritesJSONLines(t *testing.T) {
+	certificate, pool := selfSignedCertificate(t, "logs.example.com")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	loggerService, err := logger.InitializeTLS(listener.Addr().String(), logger.ServiceContext{}, &tls.Config{
+		RootCAs:    pool,
+		ServerName: "logs.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("encrypted")
+
+	conn, err := acceptTLS(t, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+	if !lines.Scan() {
+		t.Fatalf("expected a line: %v", lines.Err())
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+		t.Fatalf("Error: %v\nJSON: %s", err, lines.Bytes())
+	}
+	if entry["msg"] != "encrypted" {
+		t.Errorf("expected encrypted, got %v", entry["msg"])
+	}
+	loggerService.Close(context.Background())
+}
+
+func Test_TLSWriterMutualTLS(t *testing.T) {
+	serverCertificate, serverPool := selfSignedCertificate(t, "server")
+	clientCertificate, clientPool := selfSignedCertificate(t, "client")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    clientPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	w, err := logger.NewTCPWriter(listener.Addr().String(), logger.TCPWriterOptions{
+		TLSConfig: &tls.Config{
+			RootCAs:      serverPool,
+			Certificates: []tls.Certificate{clientCertificate},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	conn, err := acceptTLS(t, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peers := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(peers) != 1 || peers[0].Subject.CommonName != "client" {
+		t.Errorf("expected the client certificate to be presented")
+	}
+	waitForState(t, w, logger.StateConnected)
+}
+
+// A server that can't be verified must never be sent any entries.
+func Test_TLSWriterRejectsUntrustedServer(t *testing.T) {
+	certificate, _ := selfSignedCertificate(t, "untrusted")
+	_, pool := selfSignedCertificate(t, "trusted")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	w, err := logger.NewTCPWriter(listener.Addr().String(), logger.TCPWriterOptions{
+		MinBackoff: time.Hour,
+		TLSConfig:  &tls.Config{RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write([]byte("secret\n"))
+
+	if _, err := acceptTLS(t, listener); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if state := w.State(); state == logger.StateConnected {
+		t.Errorf("expected writer not to be connected, got %v", state)
+	}
+}
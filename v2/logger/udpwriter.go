@@ -0,0 +1,191 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWriterClosed is returned when writing to a writer that has been closed.
+var ErrWriterClosed = errors.New("nobslogger: writer closed")
+
+// UDPWriterOptions exposes configuration settings for a UDPWriter.
+type UDPWriterOptions struct {
+	// ResolveInterval is how often the host name is re-resolved (and the
+	// connection re-established). If ResolveInterval is zero, the host name
+	// is only re-resolved after write errors.
+	ResolveInterval time.Duration
+
+	// ErrorThreshold is the number of consecutive write errors after which
+	// the host name is re-resolved. Defaults to 1.
+	ErrorThreshold int
+
+	// Dial is used to establish connections. Defaults to net.Dial.
+	Dial func(network, address string) (net.Conn, error)
+}
+
+// UDPWriter is an io.WriteCloser that transmits each write as a single UDP
+// datagram.
+//
+// UDPWriter re-resolves the host name periodically and after consecutive
+// write errors (see UDPWriterOptions). Writes never wait for the host name to
+// be resolved: dialing happens in the background, and the new connection is
+// swapped in once it has been established. Until then, writes continue to use
+// the previous connection, or, if there is none yet, fail (and the datagram is
+// dropped).
+type UDPWriter struct {
+	// resolvedAt is first so that it is 64-bit aligned for atomic access.
+	resolvedAt int64
+
+	hostURI string
+	options UDPWriterOptions
+
+	conn              atomic.Value // *udpConn
+	consecutiveErrors int32
+	resolving         int32
+	retiring          int32
+	closed            int32
+
+	mu      sync.Mutex
+	retired net.Conn
+}
+
+// udpConn is the connection published by a UDPWriter. A nil *udpConn means
+// that the writer is not connected.
+type udpConn struct {
+	net.Conn
+}
+
+// NewUDPWriter returns a UDPWriter that transmits to the specified host.
+//
+// If the host is an IP address, it is dialed immediately, since there is no
+// name to resolve. Otherwise, it is dialed in the background, so that
+// NewUDPWriter never waits on DNS.
+//
+// hostURI: Must be a fully qualified URI including port.
+func NewUDPWriter(hostURI string, options UDPWriterOptions) (*UDPWriter, error) {
+	host, _, err := net.SplitHostPort(hostURI)
+	if err != nil {
+		return nil, fmt.Errorf("nobslogger: invalid host %q: %v", hostURI, err)
+	}
+	if options.ErrorThreshold <= 0 {
+		options.ErrorThreshold = 1
+	}
+	if options.Dial == nil {
+		options.Dial = net.Dial
+	}
+	w := &UDPWriter{
+		hostURI: hostURI,
+		options: options,
+	}
+	w.conn.Store((*udpConn)(nil))
+	if net.ParseIP(host) != nil {
+		atomic.StoreInt32(&w.resolving, 1)
+		w.dial()
+	} else {
+		w.resolve()
+	}
+	return w, nil
+}
+
+// Write transmits p as a single datagram.
+func (w *UDPWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.closed) != 0 {
+		return 0, ErrWriterClosed
+	}
+	if atomic.LoadInt32(&w.retiring) != 0 {
+		w.closeRetired()
+	}
+	conn := w.conn.Load().(*udpConn)
+	if conn == nil {
+		w.resolve()
+		return 0, fmt.Errorf("nobslogger: not connected to %v", w.hostURI)
+	}
+	if w.options.ResolveInterval > 0 && time.Since(time.Unix(0, atomic.LoadInt64(&w.resolvedAt))) >= w.options.ResolveInterval {
+		w.resolve()
+	}
+	n, err := conn.Write(p)
+	if err != nil {
+		if atomic.AddInt32(&w.consecutiveErrors, 1) >= int32(w.options.ErrorThreshold) {
+			w.resolve()
+		}
+		return n, err
+	}
+	atomic.StoreInt32(&w.consecutiveErrors, 0)
+	return n, nil
+}
+
+// Close closes the current connection. Subsequent writes return
+// ErrWriterClosed.
+func (w *UDPWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	atomic.StoreInt32(&w.closed, 1)
+	if w.retired != nil {
+		w.retired.Close()
+		w.retired = nil
+	}
+	conn := w.conn.Load().(*udpConn)
+	if conn == nil {
+		return nil
+	}
+	w.conn.Store((*udpConn)(nil))
+	return conn.Close()
+}
+
+// closeRetired closes the connection that was replaced by the most recent
+// dial. Writes are expected to be serialized (as they are by LogService), so
+// by the time the next write starts, the previous connection is no longer in
+// use.
+func (w *UDPWriter) closeRetired() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.retired != nil {
+		w.retired.Close()
+		w.retired = nil
+	}
+	atomic.StoreInt32(&w.retiring, 0)
+}
+
+// resolve re-dials the host in the background, unless a dial is already in
+// progress.
+func (w *UDPWriter) resolve() {
+	if !atomic.CompareAndSwapInt32(&w.resolving, 0, 1) {
+		return
+	}
+	go w.dial()
+}
+
+// dial dials the host, and swaps in the new connection once it is
+// established. dial must only be called by the goroutine that set
+// w.resolving.
+func (w *UDPWriter) dial() {
+	defer atomic.StoreInt32(&w.resolving, 0)
+	conn, err := w.options.Dial("udp", w.hostURI)
+	atomic.StoreInt64(&w.resolvedAt, time.Now().UnixNano())
+	if err != nil {
+		// The existing connection (if any) is retained, and resolution is
+		// retried after the next interval or write error.
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if atomic.LoadInt32(&w.closed) != 0 {
+		conn.Close()
+		return
+	}
+	if w.retired != nil {
+		w.retired.Close()
+	}
+	w.retired = nil
+	if previous := w.conn.Load().(*udpConn); previous != nil {
+		w.retired = previous.Conn
+		atomic.StoreInt32(&w.retiring, 1)
+	}
+	w.conn.Store(&udpConn{conn})
+	atomic.StoreInt32(&w.consecutiveErrors, 0)
+}
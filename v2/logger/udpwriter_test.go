@@ -0,0 +1,218 @@
+package logger_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eltorocorp/nobslogger/v2/logger"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func receiveUDP(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	buffer := make([]byte, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buffer[:n])
+}
+
+// failingConn is a net.Conn whose writes always fail.
+type failingConn struct {
+	net.Conn
+}
+
+func (failingConn) Write([]byte) (int, error) {
+	return 0, errors.New("test error")
+}
+
+func Test_NewUDPWriterRejectsMalformedHost(t *testing.T) {
+	if _, err := logger.NewUDPWriter("no port", logger.UDPWriterOptions{}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func Test_NewUDPService(t *testing.T) {
+	if _, err := logger.NewUDPService("no port", logger.ServiceContext{}, logger.LogServiceOptions{}); err == nil {
+		t.Error("expected an error")
+	}
+
+	listener := listenUDP(t)
+	defer listener.Close()
+	loggerService, err := logger.NewUDPService(listener.LocalAddr().String(), logger.ServiceContext{}, logger.LogServiceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := loggerService.NewContext("context site", "operation")
+	log.Info("message")
+	if entry := receiveUDP(t, listener); !strings.Contains(entry, `"msg":"message"`) {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func Test_InitializeUDPPanicsOnMalformedHost(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	logger.InitializeUDP("no port", logger.ServiceContext{})
+}
+
+// Neither NewUDPWriter nor Write may wait for a host name to be resolved.
+// Writes fail until the connection has been established in the background.
+func Test_UDPWriterDialsInBackground(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.LocalAddr().String())
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+	var w *logger.UDPWriter
+	go func() {
+		defer close(done)
+		var err error
+		w, err = logger.NewUDPWriter(net.JoinHostPort("localhost", port), logger.UDPWriterOptions{
+			Dial: func(network, address string) (net.Conn, error) {
+				<-release
+				return net.Dial(network, listener.LocalAddr().String())
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := w.Write([]byte("dropped")); err == nil {
+			t.Error("expected an error before the connection is established")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected NewUDPWriter and Write not to wait for the host to be dialed")
+	}
+	close(release)
+	if w == nil {
+		t.FailNow()
+	}
+	defer w.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := w.Write([]byte("entry")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be established")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if actual := receiveUDP(t, listener); actual != "entry" {
+		t.Errorf("expected entry, got %q", actual)
+	}
+}
+
+func Test_UDPWriterResolvesPeriodically(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	var dials int32
+	w, err := logger.NewUDPWriter(listener.LocalAddr().String(), logger.UDPWriterOptions{
+		ResolveInterval: 10 * time.Millisecond,
+		Dial: func(network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, address)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&dials) < 3 && time.Now().Before(deadline) {
+		if _, err := w.Write([]byte("entry")); err != nil {
+			t.Fatal(err)
+		}
+		receiveUDP(t, listener)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&dials) < 3 {
+		t.Errorf("expected the host to be re-resolved, got %v dials", dials)
+	}
+}
+
+// After a write error, the UDPWriter must swap in a new connection.
+func Test_UDPWriterResolvesAfterErrors(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	var mu sync.Mutex
+	dials := 0
+	w, err := logger.NewUDPWriter(listener.LocalAddr().String(), logger.UDPWriterOptions{
+		Dial: func(network, address string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dials++
+			conn, err := net.Dial(network, address)
+			if dials == 1 {
+				return failingConn{conn}, err
+			}
+			return conn, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.Write([]byte("lost")); err == nil {
+		t.Fatal("expected the first write to fail")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := w.Write([]byte("entry")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if actual := receiveUDP(t, listener); actual != "entry" {
+		t.Errorf("expected entry, got %q", actual)
+	}
+}
+
+func Test_UDPWriterClose(t *testing.T) {
+	listener := listenUDP(t)
+	defer listener.Close()
+
+	w, err := logger.NewUDPWriter(listener.LocalAddr().String(), logger.UDPWriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("entry"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("entry")); err != logger.ErrWriterClosed {
+		t.Errorf("expected ErrWriterClosed, got %v", err)
+	}
+}